@@ -0,0 +1,19 @@
+module github.com/rsanandres/hc_ai/POC_embeddings
+
+go 1.25.0
+
+require (
+	github.com/segmentio/kafka-go v0.4.51
+	golang.org/x/net v0.57.0
+	golang.org/x/time v0.14.0
+	google.golang.org/grpc v1.84.0
+	google.golang.org/protobuf v1.36.11
+)
+
+require (
+	github.com/klauspost/compress v1.15.9 // indirect
+	github.com/pierrec/lz4/v4 v4.1.15 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	golang.org/x/text v0.40.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20260706201446-f0a921348800 // indirect
+)
@@ -0,0 +1,238 @@
+// The gRPC service called with -sink grpc. Each record is sent in its own
+// Ingest call; a non-OK status fails that record.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: ingest.proto
+
+package ingestpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type IngestRequest struct {
+	state        protoimpl.MessageState `protogen:"open.v1"`
+	Id           string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	FullUrl      string                 `protobuf:"bytes,2,opt,name=full_url,json=fullUrl,proto3" json:"full_url,omitempty"`
+	ResourceType string                 `protobuf:"bytes,3,opt,name=resource_type,json=resourceType,proto3" json:"resource_type,omitempty"`
+	Content      string                 `protobuf:"bytes,4,opt,name=content,proto3" json:"content,omitempty"`
+	PatientId    string                 `protobuf:"bytes,5,opt,name=patient_id,json=patientId,proto3" json:"patient_id,omitempty"`
+	ResourceJson string                 `protobuf:"bytes,6,opt,name=resource_json,json=resourceJson,proto3" json:"resource_json,omitempty"`
+	SourceFile   string                 `protobuf:"bytes,7,opt,name=source_file,json=sourceFile,proto3" json:"source_file,omitempty"`
+	// Any other record fields, such as sourceLine, sourceEntry, or embedding.
+	Metadata      map[string]string `protobuf:"bytes,8,rep,name=metadata,proto3" json:"metadata,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *IngestRequest) Reset() {
+	*x = IngestRequest{}
+	mi := &file_ingest_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *IngestRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*IngestRequest) ProtoMessage() {}
+
+func (x *IngestRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_ingest_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use IngestRequest.ProtoReflect.Descriptor instead.
+func (*IngestRequest) Descriptor() ([]byte, []int) {
+	return file_ingest_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *IngestRequest) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *IngestRequest) GetFullUrl() string {
+	if x != nil {
+		return x.FullUrl
+	}
+	return ""
+}
+
+func (x *IngestRequest) GetResourceType() string {
+	if x != nil {
+		return x.ResourceType
+	}
+	return ""
+}
+
+func (x *IngestRequest) GetContent() string {
+	if x != nil {
+		return x.Content
+	}
+	return ""
+}
+
+func (x *IngestRequest) GetPatientId() string {
+	if x != nil {
+		return x.PatientId
+	}
+	return ""
+}
+
+func (x *IngestRequest) GetResourceJson() string {
+	if x != nil {
+		return x.ResourceJson
+	}
+	return ""
+}
+
+func (x *IngestRequest) GetSourceFile() string {
+	if x != nil {
+		return x.SourceFile
+	}
+	return ""
+}
+
+func (x *IngestRequest) GetMetadata() map[string]string {
+	if x != nil {
+		return x.Metadata
+	}
+	return nil
+}
+
+type IngestResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *IngestResponse) Reset() {
+	*x = IngestResponse{}
+	mi := &file_ingest_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *IngestResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*IngestResponse) ProtoMessage() {}
+
+func (x *IngestResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_ingest_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use IngestResponse.ProtoReflect.Descriptor instead.
+func (*IngestResponse) Descriptor() ([]byte, []int) {
+	return file_ingest_proto_rawDescGZIP(), []int{1}
+}
+
+var File_ingest_proto protoreflect.FileDescriptor
+
+const file_ingest_proto_rawDesc = "" +
+	"\n" +
+	"\fingest.proto\x12\tingest.v1\"\xdf\x02\n" +
+	"\rIngestRequest\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x19\n" +
+	"\bfull_url\x18\x02 \x01(\tR\afullUrl\x12#\n" +
+	"\rresource_type\x18\x03 \x01(\tR\fresourceType\x12\x18\n" +
+	"\acontent\x18\x04 \x01(\tR\acontent\x12\x1d\n" +
+	"\n" +
+	"patient_id\x18\x05 \x01(\tR\tpatientId\x12#\n" +
+	"\rresource_json\x18\x06 \x01(\tR\fresourceJson\x12\x1f\n" +
+	"\vsource_file\x18\a \x01(\tR\n" +
+	"sourceFile\x12B\n" +
+	"\bmetadata\x18\b \x03(\v2&.ingest.v1.IngestRequest.MetadataEntryR\bmetadata\x1a;\n" +
+	"\rMetadataEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"\x10\n" +
+	"\x0eIngestResponse2N\n" +
+	"\rIngestService\x12=\n" +
+	"\x06Ingest\x12\x18.ingest.v1.IngestRequest\x1a\x19.ingest.v1.IngestResponseB5Z3github.com/rsanandres/hc_ai/POC_embeddings/ingestpbb\x06proto3"
+
+var (
+	file_ingest_proto_rawDescOnce sync.Once
+	file_ingest_proto_rawDescData []byte
+)
+
+func file_ingest_proto_rawDescGZIP() []byte {
+	file_ingest_proto_rawDescOnce.Do(func() {
+		file_ingest_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_ingest_proto_rawDesc), len(file_ingest_proto_rawDesc)))
+	})
+	return file_ingest_proto_rawDescData
+}
+
+var file_ingest_proto_msgTypes = make([]protoimpl.MessageInfo, 3)
+var file_ingest_proto_goTypes = []any{
+	(*IngestRequest)(nil),  // 0: ingest.v1.IngestRequest
+	(*IngestResponse)(nil), // 1: ingest.v1.IngestResponse
+	nil,                    // 2: ingest.v1.IngestRequest.MetadataEntry
+}
+var file_ingest_proto_depIdxs = []int32{
+	2, // 0: ingest.v1.IngestRequest.metadata:type_name -> ingest.v1.IngestRequest.MetadataEntry
+	0, // 1: ingest.v1.IngestService.Ingest:input_type -> ingest.v1.IngestRequest
+	1, // 2: ingest.v1.IngestService.Ingest:output_type -> ingest.v1.IngestResponse
+	2, // [2:3] is the sub-list for method output_type
+	1, // [1:2] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
+}
+
+func init() { file_ingest_proto_init() }
+func file_ingest_proto_init() {
+	if File_ingest_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_ingest_proto_rawDesc), len(file_ingest_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   3,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_ingest_proto_goTypes,
+		DependencyIndexes: file_ingest_proto_depIdxs,
+		MessageInfos:      file_ingest_proto_msgTypes,
+	}.Build()
+	File_ingest_proto = out.File
+	file_ingest_proto_goTypes = nil
+	file_ingest_proto_depIdxs = nil
+}
@@ -0,0 +1,124 @@
+// The gRPC service called with -sink grpc. Each record is sent in its own
+// Ingest call; a non-OK status fails that record.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.6.2
+// - protoc             (unknown)
+// source: ingest.proto
+
+package ingestpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	IngestService_Ingest_FullMethodName = "/ingest.v1.IngestService/Ingest"
+)
+
+// IngestServiceClient is the client API for IngestService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type IngestServiceClient interface {
+	Ingest(ctx context.Context, in *IngestRequest, opts ...grpc.CallOption) (*IngestResponse, error)
+}
+
+type ingestServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewIngestServiceClient(cc grpc.ClientConnInterface) IngestServiceClient {
+	return &ingestServiceClient{cc}
+}
+
+func (c *ingestServiceClient) Ingest(ctx context.Context, in *IngestRequest, opts ...grpc.CallOption) (*IngestResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(IngestResponse)
+	err := c.cc.Invoke(ctx, IngestService_Ingest_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// IngestServiceServer is the server API for IngestService service.
+// All implementations must embed UnimplementedIngestServiceServer
+// for forward compatibility.
+type IngestServiceServer interface {
+	Ingest(context.Context, *IngestRequest) (*IngestResponse, error)
+	mustEmbedUnimplementedIngestServiceServer()
+}
+
+// UnimplementedIngestServiceServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedIngestServiceServer struct{}
+
+func (UnimplementedIngestServiceServer) Ingest(context.Context, *IngestRequest) (*IngestResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method Ingest not implemented")
+}
+func (UnimplementedIngestServiceServer) mustEmbedUnimplementedIngestServiceServer() {}
+func (UnimplementedIngestServiceServer) testEmbeddedByValue()                       {}
+
+// UnsafeIngestServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to IngestServiceServer will
+// result in compilation errors.
+type UnsafeIngestServiceServer interface {
+	mustEmbedUnimplementedIngestServiceServer()
+}
+
+func RegisterIngestServiceServer(s grpc.ServiceRegistrar, srv IngestServiceServer) {
+	// If the following call panics, it indicates UnimplementedIngestServiceServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&IngestService_ServiceDesc, srv)
+}
+
+func _IngestService_Ingest_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(IngestRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IngestServiceServer).Ingest(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: IngestService_Ingest_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IngestServiceServer).Ingest(ctx, req.(*IngestRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// IngestService_ServiceDesc is the grpc.ServiceDesc for IngestService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var IngestService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "ingest.v1.IngestService",
+	HandlerType: (*IngestServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Ingest",
+			Handler:    _IngestService_Ingest_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "ingest.proto",
+}
@@ -2,382 +2,6905 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"log/slog"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
-)
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
+	"text/template"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
-type Bundle struct {
-	Type         string  `json:"type"`
-	Entry        []Entry `json:"entry"`
-	ResourceType string  `json:"resourceType"`
-}
+	"github.com/rsanandres/hc_ai/POC_embeddings/ingestpb"
+	"github.com/segmentio/kafka-go"
+	"golang.org/x/net/html"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	grpcgzip "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
 
+// Entry is one element of a Bundle's entry array.
 type Entry struct {
 	FullURL  string                 `json:"fullUrl"`
 	Resource map[string]interface{} `json:"resource"`
 }
 
-func main() {
-	// Process all JSON files in a folder
-	dataDir := "../data/fhir"
+// TypeCounts tallies entry outcomes for a single resourceType.
+type TypeCounts struct {
+	Ingested           int `json:"ingested"`
+	SkippedEmpty       int `json:"skippedEmpty"`
+	SkippedFiltered    int `json:"skippedFiltered"`
+	SkippedHeadingOnly int `json:"skippedHeadingOnly"`
+	SkippedTooShort    int `json:"skippedTooShort"`
+	Duplicates         int `json:"duplicates"`
+	Unchanged          int `json:"unchanged"`
+	Invalid            int `json:"invalid"`
+	PipelineFailures   int `json:"pipelineFailures"`
+	EstimatedTokens    int `json:"estimatedTokens"` // of the content of ingested records
+}
+
+// Summary tallies entry outcomes across one or more files.
+type Summary struct {
+	Ingested            int                    `json:"ingested"`
+	SkippedEmpty        int                    `json:"skippedEmpty"`
+	SkippedFiltered     int                    `json:"skippedFiltered"`
+	SkippedHeadingOnly  int                    `json:"skippedHeadingOnly"` // content was only a heading such as "Clinical Observation:"
+	SkippedTooShort     int                    `json:"skippedTooShort"`    // content was shorter than -min-content-chars
+	Duplicates          int                    `json:"duplicates"`
+	Unchanged           int                    `json:"unchanged"`
+	MissingResourceType int                    `json:"missingResourceType"`
+	DuplicateIDs        int                    `json:"duplicateIds"` // entries skipped for repeating a resourceType/id in their Bundle
+	Invalid             int                    `json:"invalid"`      // resources skipped by -validate
+	MalformedRecords    int                    `json:"malformedRecords"`
+	PipelineFailures    int                    `json:"pipelineFailures"`
+	EstimatedTokens     int                    `json:"estimatedTokens"` // of the content of ingested records, per estimateTokens
+	ByType              map[string]*TypeCounts `json:"byType"`
+
+	// FilesNotProcessed counts input files left out by -max-files. It is
+	// set for the run as a whole, not per file.
+	FilesNotProcessed int `json:"filesNotProcessed"`
+
+	// Outcomes lists what happened to each resource, in the order decided.
+	// processFile moves them out of the Summary it returns.
+	Outcomes []ResourceOutcome `json:"-"`
+}
 
-	fmt.Printf("Processing all JSON files in: %s\n", dataDir)
+// ResourceOutcome is what happened to one resource (or unreadable line):
+// Status is ingested, skipped, or failed. Reason says why a resource was
+// skipped: empty, filtered, not-clinical, duplicate, duplicate-id,
+// unchanged, missing-resourceType, invalid, heading-only, too-short, or
+// malformed. Error is set for failed, invalid, and malformed ones.
+type ResourceOutcome struct {
+	File         string `json:"file"`
+	ResourceType string `json:"resourceType,omitempty"`
+	ID           string `json:"id,omitempty"`
+	Status       string `json:"status"`
+	Reason       string `json:"reason,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
 
-	// Get all JSON files
-	files, err := filepath.Glob(filepath.Join(dataDir, "*.json"))
+// outcome records what happened to a resource in s.Outcomes. err may be nil.
+func (s *Summary) outcome(file, resourceType, id, status, reason string, err error) {
+	o := ResourceOutcome{File: file, ResourceType: resourceType, ID: id, Status: status, Reason: reason}
 	if err != nil {
-		log.Fatalf("Error reading directory: %v", err)
+		o.Error = err.Error()
 	}
+	s.Outcomes = append(s.Outcomes, o)
+}
 
-	if len(files) == 0 {
-		log.Printf("No JSON files found in %s", dataDir)
-		return
-	}
+func newSummary() Summary {
+	return Summary{ByType: make(map[string]*TypeCounts)}
+}
 
-	fmt.Printf("Found %d JSON files\n\n", len(files))
+// typeCounts returns the per-type counters for resourceType, creating them on
+// first use.
+func (s *Summary) typeCounts(resourceType string) *TypeCounts {
+	tc, ok := s.ByType[resourceType]
+	if !ok {
+		tc = &TypeCounts{}
+		s.ByType[resourceType] = tc
+	}
+	return tc
+}
 
-	// Process each file
-	for i, filePath := range files {
-		fmt.Printf("[%d/%d] Processing: %s\n", i+1, len(files), filepath.Base(filePath))
-		processFile(filePath)
-		fmt.Println() // Empty line between files
+// Add merges the counts from other into s.
+func (s *Summary) Add(other Summary) {
+	s.Ingested += other.Ingested
+	s.SkippedEmpty += other.SkippedEmpty
+	s.SkippedFiltered += other.SkippedFiltered
+	s.Duplicates += other.Duplicates
+	s.Unchanged += other.Unchanged
+	s.MissingResourceType += other.MissingResourceType
+	s.DuplicateIDs += other.DuplicateIDs
+	s.SkippedHeadingOnly += other.SkippedHeadingOnly
+	s.SkippedTooShort += other.SkippedTooShort
+	s.Invalid += other.Invalid
+	s.MalformedRecords += other.MalformedRecords
+	s.PipelineFailures += other.PipelineFailures
+	s.EstimatedTokens += other.EstimatedTokens
+	s.FilesNotProcessed += other.FilesNotProcessed
+	s.Outcomes = append(s.Outcomes, other.Outcomes...)
+	for resourceType, counts := range other.ByType {
+		tc := s.typeCounts(resourceType)
+		tc.Ingested += counts.Ingested
+		tc.SkippedEmpty += counts.SkippedEmpty
+		tc.SkippedFiltered += counts.SkippedFiltered
+		tc.SkippedHeadingOnly += counts.SkippedHeadingOnly
+		tc.SkippedTooShort += counts.SkippedTooShort
+		tc.Duplicates += counts.Duplicates
+		tc.Unchanged += counts.Unchanged
+		tc.Invalid += counts.Invalid
+		tc.PipelineFailures += counts.PipelineFailures
+		tc.EstimatedTokens += counts.EstimatedTokens
 	}
+}
 
-	fmt.Printf("\n✓ Completed processing %d files\n", len(files))
+// summaryTotals sums the Summaries of files processed concurrently. Each
+// file (and each sender within it) counts into a Summary of its own, which
+// is only added here once done, so the counters themselves are never shared.
+type summaryTotals struct {
+	mu      sync.Mutex
+	summary Summary
 }
 
-func processFile(filePath string) {
-	data, err := os.ReadFile(filePath)
-	if err != nil {
-		log.Printf("Error reading file %s: %v", filePath, err)
-		return
+func newSummaryTotals() *summaryTotals {
+	return &summaryTotals{summary: newSummary()}
+}
+
+// Add adds s, per resourceType breakdown included, to the totals.
+func (t *summaryTotals) Add(s Summary) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.summary.Add(s)
+}
+
+// Snapshot returns a copy of the totals so far that later Adds don't change.
+func (t *summaryTotals) Snapshot() Summary {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := newSummary()
+	s.Add(t.summary)
+	return s
+}
+
+// LogValue implements slog.LogValuer so the summary is emitted as structured
+// fields under -log-format json.
+func (s Summary) LogValue() slog.Value {
+	types := make([]slog.Attr, 0, len(s.ByType))
+	for resourceType, tc := range s.ByType {
+		types = append(types, slog.Group(resourceType,
+			"ingested", tc.Ingested,
+			"skippedEmpty", tc.SkippedEmpty,
+			"skippedFiltered", tc.SkippedFiltered,
+			"skippedHeadingOnly", tc.SkippedHeadingOnly,
+			"skippedTooShort", tc.SkippedTooShort,
+			"duplicates", tc.Duplicates,
+			"unchanged", tc.Unchanged,
+			"invalid", tc.Invalid,
+			"pipelineFailures", tc.PipelineFailures,
+			"estimatedTokens", tc.EstimatedTokens,
+		))
 	}
+	return slog.GroupValue(
+		slog.Int("ingested", s.Ingested),
+		slog.Int("skippedEmpty", s.SkippedEmpty),
+		slog.Int("skippedFiltered", s.SkippedFiltered),
+		slog.Int("skippedHeadingOnly", s.SkippedHeadingOnly),
+		slog.Int("skippedTooShort", s.SkippedTooShort),
+		slog.Int("duplicates", s.Duplicates),
+		slog.Int("unchanged", s.Unchanged),
+		slog.Int("missingResourceType", s.MissingResourceType),
+		slog.Int("duplicateIds", s.DuplicateIDs),
+		slog.Int("invalid", s.Invalid),
+		slog.Int("malformedRecords", s.MalformedRecords),
+		slog.Int("pipelineFailures", s.PipelineFailures),
+		slog.Int("estimatedTokens", s.EstimatedTokens),
+		slog.Int("filesNotProcessed", s.FilesNotProcessed),
+		slog.Attr{Key: "byType", Value: slog.GroupValue(types...)},
+	)
+}
 
-	var bundle Bundle
-	if err := json.Unmarshal(data, &bundle); err != nil {
-		log.Printf("Error parsing JSON in %s: %v", filePath, err)
-		return
+// Print writes the totals and a per-resourceType breakdown as a table.
+func (s *Summary) Print(w io.Writer) {
+	types := make([]string, 0, len(s.ByType))
+	for resourceType := range s.ByType {
+		types = append(types, resourceType)
 	}
+	sort.Strings(types)
 
-	if bundle.ResourceType != "Bundle" {
-		log.Printf("Warning: %s is not a Bundle resource", filePath)
-		return
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "Resource Type\tIngested\tSkipped (empty)\tSkipped (filtered)\tSkipped (heading only)\tSkipped (too short)\tDuplicates\tUnchanged\tInvalid\tPipeline failures\tEst. tokens")
+	for _, resourceType := range types {
+		tc := s.ByType[resourceType]
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\n", resourceType, tc.Ingested, tc.SkippedEmpty, tc.SkippedFiltered, tc.SkippedHeadingOnly, tc.SkippedTooShort, tc.Duplicates, tc.Unchanged, tc.Invalid, tc.PipelineFailures, tc.EstimatedTokens)
+	}
+	fmt.Fprintf(tw, "TOTAL\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\n", s.Ingested, s.SkippedEmpty, s.SkippedFiltered, s.SkippedHeadingOnly, s.SkippedTooShort, s.Duplicates, s.Unchanged, s.Invalid, s.PipelineFailures, s.EstimatedTokens)
+	tw.Flush()
+
+	fmt.Fprintf(w, "Entries missing resourceType: %d\n", s.MissingResourceType)
+	if s.DuplicateIDs > 0 {
+		fmt.Fprintf(w, "Entries with an id repeated in their Bundle: %d\n", s.DuplicateIDs)
+	}
+	if s.Invalid > 0 {
+		fmt.Fprintf(w, "Resources failing -validate: %d\n", s.Invalid)
 	}
+	if s.MalformedRecords > 0 {
+		fmt.Fprintf(w, "Malformed NDJSON lines: %d\n", s.MalformedRecords)
+	}
+	if s.FilesNotProcessed > 0 {
+		fmt.Fprintf(w, "Files not processed (-max-files): %d\n", s.FilesNotProcessed)
+	}
+}
 
-	fmt.Printf("  Found %d entries\n", len(bundle.Entry))
+// maxNDJSONLineBytes bounds a single NDJSON record.
+const maxNDJSONLineBytes = 64 * 1024 * 1024
 
-	// First, find the Patient resource to get patient ID
-	patientID := extractPatientID(bundle.Entry)
+// stringSet is a flag.Value holding a set of strings given as a
+// comma-separated list. Repeating the flag adds to the set.
+type stringSet map[string]bool
 
-	for i, entry := range bundle.Entry {
-		resourceType, ok := entry.Resource["resourceType"].(string)
-		if !ok {
-			log.Printf("  Entry %d: Missing resourceType", i)
-			continue
-		}
+func (s *stringSet) String() string {
+	items := make([]string, 0, len(*s))
+	for item := range *s {
+		items = append(items, item)
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
 
-		id, _ := entry.Resource["id"].(string)
-		if id == "" {
-			// Some resources might not have an id, use fullUrl as fallback
-			id = entry.FullURL
+func (s *stringSet) Set(value string) error {
+	if *s == nil {
+		*s = make(stringSet)
+	}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			(*s)[item] = true
 		}
+	}
+	return nil
+}
 
-		// Extract meaningful content from the resource
-		content := extractContent(entry.Resource, resourceType)
+// headerFlags is a flag.Value collecting repeated "Key=Value" request
+// headers.
+type headerFlags http.Header
 
-		// Skip if content is empty
-		if content == "" {
-			log.Printf("  Entry %d (%s): Skipping - no extractable content", i, resourceType)
-			continue
+func (h *headerFlags) String() string {
+	if *h == nil {
+		return ""
+	}
+	var pairs []string
+	for key, values := range *h {
+		for _, value := range values {
+			pairs = append(pairs, key+"="+value)
 		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
 
-		// Serialize the original resource JSON
-		resourceJSONBytes, err := json.Marshal(entry.Resource)
-		resourceJSON := ""
-		if err == nil {
-			resourceJSON = string(resourceJSONBytes)
-		} else {
-			log.Printf("  Entry %d (%s): Warning - could not serialize resource JSON: %v", i, resourceType, err)
-		}
+func (h *headerFlags) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	key = strings.TrimSpace(key)
+	if !ok || key == "" {
+		return fmt.Errorf("want key=value, got %q", value)
+	}
+	if *h == nil {
+		*h = make(headerFlags)
+	}
+	http.Header(*h).Add(key, strings.TrimSpace(val))
+	return nil
+}
 
-		flatData := map[string]string{
-			"id":           id,
-			"fullUrl":      entry.FullURL,
-			"resourceType": resourceType,
-			"content":      content,
-			"patientId":    patientID,    // Add patient ID to all resources
-			"resourceJson": resourceJSON, // Add original JSON for RecursiveJsonSplitter
-			"sourceFile":   filePath,     // Add source file path
-		}
+// routeFlags collects repeated -route resourceType=URL flags.
+type routeFlags map[string]string
 
-		sendToPipeline(flatData)
+func (r *routeFlags) String() string {
+	if *r == nil {
+		return ""
 	}
+	pairs := make([]string, 0, len(*r))
+	for resourceType, url := range *r {
+		pairs = append(pairs, resourceType+"="+url)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
 }
 
-func extractPatientID(entries []Entry) string {
-	// Find the Patient resource and extract its ID
-	for _, entry := range entries {
-		if resourceType, ok := entry.Resource["resourceType"].(string); ok && resourceType == "Patient" {
-			if id, ok := entry.Resource["id"].(string); ok && id != "" {
-				return id
-			}
-			// Fallback to fullUrl if no id
-			return entry.FullURL
-		}
+func (r *routeFlags) Set(value string) error {
+	resourceType, url, ok := strings.Cut(value, "=")
+	resourceType, url = strings.TrimSpace(resourceType), strings.TrimSpace(url)
+	if !ok || resourceType == "" || url == "" {
+		return fmt.Errorf("want resourceType=URL, got %q", value)
 	}
-	return "unknown"
+	if *r == nil {
+		*r = make(routeFlags)
+	}
+	(*r)[resourceType] = url
+	return nil
 }
 
-func extractContent(resource map[string]interface{}, resourceType string) string {
-	var parts []string
+// Exit codes. Flag syntax errors exit with 2 from the flag package.
+const (
+	exitOK             = 0   // every file processed and every record delivered
+	exitSetupError     = 1   // invalid options, unreadable input, or pipeline unreachable
+	exitPartialFailure = 3   // the run finished, but files, lines, or records failed
+	exitAborted        = 4   // stopped early by -fail-fast, -max-failures, or -timeout-total
+	exitInterrupted    = 130 // stopped early by SIGINT or SIGTERM
+)
 
-	// Try to get text.div first (if available)
-	if text, ok := resource["text"].(map[string]interface{}); ok {
-		if div, ok := text["div"].(string); ok && div != "" {
-			// Clean HTML tags for better text extraction
-			div = cleanHTML(div)
-			if div != "" {
-				return div
-			}
-		}
-	}
+// Config holds the command-line options for a run.
+type Config struct {
+	Concurrency    int
+	WorkersPerFile int
+	ReadAhead      int
+	QueueSize      int
+	Format         string // auto, bundle, ndjson, or xml
+	DuplicateIDs   string // first or last
+	Validate       bool
+	FHIRVersion    string // auto, stu3, or r4
+	DryRun         bool
+	Pretty         bool
+	OutputFile     string
+	OutputDir      string
+	LogFormat      string // text or json
+	Verbose        bool
+	Quiet          bool
 
-	// Build content based on resource type
-	switch resourceType {
-	case "Patient":
-		parts = append(parts, "Patient Information:")
-		if name, ok := resource["name"].([]interface{}); ok && len(name) > 0 {
-			if nameObj, ok := name[0].(map[string]interface{}); ok {
-				if family, ok := nameObj["family"].(string); ok {
-					parts = append(parts, fmt.Sprintf("Name: %s", family))
-				}
-				if given, ok := nameObj["given"].([]interface{}); ok && len(given) > 0 {
-					if givenStr, ok := given[0].(string); ok {
-						parts = append(parts, fmt.Sprintf("%s", givenStr))
-					}
-				}
-			}
-		}
-		if gender, ok := resource["gender"].(string); ok {
-			parts = append(parts, fmt.Sprintf("Gender: %s", gender))
-		}
-		if birthDate, ok := resource["birthDate"].(string); ok {
-			parts = append(parts, fmt.Sprintf("Date of Birth: %s", birthDate))
-		}
+	DeadLetterFile string
+	Replay         string
+	Stdin          bool
+	FollowNext     bool
+	FHIRServer     string
+	FHIRToken      string // never logged
+	MaxPages       int
+	Since          time.Time
+	DataDir        string
+	Recursive      bool
+	Glob           string
+	MaxFiles       int
 
-	case "Condition":
-		parts = append(parts, "Medical Condition:")
-		if code, ok := resource["code"].(map[string]interface{}); ok {
-			if text, ok := code["text"].(string); ok {
-				parts = append(parts, text)
-			} else if coding, ok := code["coding"].([]interface{}); ok && len(coding) > 0 {
-				if codingObj, ok := coding[0].(map[string]interface{}); ok {
-					if display, ok := codingObj["display"].(string); ok {
-						parts = append(parts, display)
-					}
-				}
+	ProgressInterval time.Duration
+	ProgressEvery    int
+	MetricsAddr      string
+	ReportFile       string
+
+	IncludeTypes stringSet
+	ExcludeTypes stringSet
+
+	EmbedPatientContext bool
+	FlattenBundle       bool
+	IncludeMeta         bool
+	IncludePII          bool
+	IncludeCodes        bool
+	MergeNarrative      bool
+	StripEmptySections  bool
+	ContentPointers     map[string]contentPointerRule // from -content-pointers
+	PrefixTemplates     map[string]*template.Template // from -prefix-template
+	Redact              bool
+	MaxContentChars     int
+	MinContentChars     int
+
+	Dedup         bool
+	DedupFile     string
+	DedupCapacity int
+
+	Incremental      bool
+	IncrementalCache string
+
+	Resume         bool
+	CheckpointFile string
+
+	OnParseError  string // log, quarantine, or fail
+	QuarantineDir string
+
+	Sink            string // http, kafka, or grpc
+	PipelineURL     string // base URL; requests go to PipelineURL + PipelinePath
+	PipelinePath    string
+	PipelineURLs    []string
+	Routes          routeFlags // resourceType -> base URL used instead of the above
+	KafkaBrokers    []string   // host:port
+	KafkaRESTURLs   []string
+	KafkaTopic      string
+	GRPCAddr        string
+	GRPCTLS         bool
+	RequestTimeout  time.Duration
+	RateLimit       float64
+	BatchSize       int
+	Compress        bool
+	MaxFailures     int
+	TimeoutTotal    time.Duration
+	FailFast        bool
+	HealthURL       string
+	SkipHealthcheck bool
+	AuthToken       string // never logged
+	Headers         headerFlags
+
+	EmbedEndpoint  string
+	EmbedModel     string
+	EmbedAPIKey    string // never logged
+	EmbedBatchSize int
+}
+
+func parseFlags() Config {
+	var cfg Config
+	var configFile string
+	flag.StringVar(&configFile, "config", "", "JSON file of option values keyed by flag name; flags given on the command line take precedence")
+	flag.IntVar(&cfg.Concurrency, "concurrency", 4, "number of files to process in parallel; each file is decoded and extracted by one goroutine, so this is also the extract parallelism")
+	flag.IntVar(&cfg.WorkersPerFile, "workers-per-file", 1, "number of records from each file to send in parallel")
+	flag.IntVar(&cfg.ReadAhead, "read-ahead", 4, "256 KiB chunks of each input file to read (and decompress) ahead of decoding, so disk reads overlap extraction (0 reads inline)")
+	flag.IntVar(&cfg.QueueSize, "queue-size", 0, "records extracted from each file ahead of its senders (default -workers-per-file)")
+	flag.StringVar(&cfg.Format, "format", "auto", "input format: auto (by file extension), bundle, ndjson, or xml (a FHIR XML Bundle)")
+	flag.StringVar(&cfg.FHIRVersion, "fhir-version", "auto", "FHIR release of the input, for elements renamed between releases: stu3, r4, or auto (try both)")
+	flag.BoolVar(&cfg.Validate, "validate", false, "check each resource's basic shape (string resourceType and id, lists where FHIR has lists) and skip those that fail")
+	flag.StringVar(&cfg.DuplicateIDs, "duplicate-ids", "last", "which entry to keep when a Bundle repeats a resourceType/id: first or last (standard input always keeps the first)")
+	flag.BoolVar(&cfg.DryRun, "dry-run", false, "print extracted records instead of sending them to the pipeline")
+	flag.Var(&cfg.IncludeTypes, "include-types", "comma-separated resourceTypes to ingest; all others are skipped (overrides -exclude-types)")
+	flag.Var(&cfg.ExcludeTypes, "exclude-types", "comma-separated resourceTypes to skip")
+	flag.BoolVar(&cfg.EmbedPatientContext, "embed-patient-context", false, "prefix each Bundle resource's content with the patient's age and gender")
+	flag.BoolVar(&cfg.IncludeMeta, "include-meta", false, "copy each resource's meta.lastUpdated, meta.versionId, and meta.profile into lastUpdated, versionId, and profile (comma-separated) record fields")
+	flag.BoolVar(&cfg.FlattenBundle, "flatten-bundle", false, "send one record per patient in each Bundle, its content every resource's content under a heading per resourceType, instead of one per resource (NDJSON files are unaffected)")
+	var contentPointersFile, prefixTemplateFile string
+	flag.StringVar(&prefixTemplateFile, "prefix-template", "", `JSON file mapping resourceTypes to text/template headings used instead of the built-in ones, e.g. {"Condition": "Diagnosis for patient {{.patientId}}:"}`)
+	flag.StringVar(&contentPointersFile, "content-pointers", "", `JSON file mapping resourceTypes to JSON pointers whose string values are added to content, e.g. {"Basic": {"pointers": ["/code/text"], "replace": true}}`)
+	flag.BoolVar(&cfg.StripEmptySections, "strip-empty-sections", true, "skip resources whose content would be only a heading such as \"Clinical Observation:\", with no values")
+	flag.BoolVar(&cfg.MergeNarrative, "merge-narrative", false, "combine a resource's narrative with its structured fields, leaving out narrative sentences the fields already say, instead of using the narrative alone")
+	flag.BoolVar(&cfg.IncludeCodes, "include-codes", false, "follow coded values with their SNOMED, LOINC, RxNorm, ICD, CVX, or CPT codes, e.g. \"Asthma (SNOMED 195967001)\"")
+	flag.BoolVar(&cfg.IncludePII, "include-pii", false, "add each Patient's address, phone and email, and marital status to its content")
+	flag.BoolVar(&cfg.Redact, "redact", false, "replace the patient's names and identifiers in content and resourceJson with "+redactPlaceholder)
+	flag.IntVar(&cfg.MinContentChars, "min-content-chars", 0, "skip resources whose extracted content is shorter than this many characters, such as \"Organization: ACME\" (0 keeps all)")
+	flag.IntVar(&cfg.MaxContentChars, "max-content-chars", 0, "truncate extracted content to at most this many characters, on a word boundary (0 means no limit)")
+	flag.BoolVar(&cfg.Dedup, "dedup", false, "skip resources already seen earlier in the run (same resourceType/id and content)")
+	flag.StringVar(&cfg.DedupFile, "dedup-file", "", "back the -dedup key set with this file instead of memory")
+	flag.IntVar(&cfg.DedupCapacity, "dedup-capacity", 1<<22, "maximum number of keys the -dedup-file can hold")
+	flag.BoolVar(&cfg.Incremental, "incremental", false, "skip resources whose content is unchanged since the pipeline last accepted them, per -incremental-cache")
+	flag.StringVar(&cfg.IncrementalCache, "incremental-cache", "ingest-cache.json", "file recording the content hash of each resource the pipeline accepted, for -incremental")
+	flag.StringVar(&cfg.OnParseError, "on-parse-error", "log", "what to do with an input file that cannot be parsed: log it, quarantine it (move it to -quarantine-dir), or fail the run")
+	flag.StringVar(&cfg.QuarantineDir, "quarantine-dir", "", "directory that -on-parse-error quarantine moves unparseable files to, keeping their paths under the data directory")
+	flag.BoolVar(&cfg.Resume, "resume", false, "skip input files listed in -checkpoint-file, and add each file to it once all its records are ingested")
+	flag.StringVar(&cfg.CheckpointFile, "checkpoint-file", "ingest-checkpoint.txt", "file listing the input files completed so far, one path per line, for -resume; delete it to start over")
+	flag.BoolVar(&cfg.Pretty, "pretty", false, "lay out extracted content over several lines for reading; only with -dry-run or -output-file")
+	flag.StringVar(&cfg.OutputFile, "output-file", "", "append extracted records as JSON lines to this file instead of sending them to the pipeline")
+	flag.StringVar(&cfg.OutputDir, "output-dir", "", "write each input file's records to <dir>/<path in the data directory>.extracted.jsonl instead of sending them to the pipeline")
+	flag.StringVar(&cfg.ReportFile, "report-file", "", "write the outcome of every resource, with the run summary and exit code, as JSON to this file")
+	flag.StringVar(&cfg.DeadLetterFile, "dead-letter-file", "", "append records the pipeline failed to ingest, with the error, as JSON lines to this file")
+	flag.StringVar(&cfg.Replay, "replay", "", "re-send the records in this dead-letter file instead of processing the data directory")
+	flag.BoolVar(&cfg.FollowNext, "follow-next", false, "after each JSON Bundle, fetch and process the pages its Bundle.link next points to on -fhir-server")
+	flag.StringVar(&cfg.FHIRServer, "fhir-server", "", "base URL of the FHIR server that -follow-next may fetch pages from")
+	flag.StringVar(&cfg.FHIRToken, "fhir-token", "", "bearer token sent with -follow-next page requests (default $FHIR_TOKEN)")
+	flag.IntVar(&cfg.MaxPages, "max-pages", 1000, "most pages -follow-next fetches after each input file")
+	flag.BoolVar(&cfg.Stdin, "stdin", false, "read a single Bundle (or NDJSON with -format ndjson) from standard input instead of the data directory")
+	flag.StringVar(&cfg.DataDir, "data-dir", "../data/fhir", "directory of input files; $VARIABLES and a leading ~ are expanded (e.g. $DATA_DIR/fhir)")
+	flag.BoolVar(&cfg.Recursive, "recursive", false, "also look for input files in subdirectories of the data directory")
+	flag.StringVar(&cfg.Glob, "glob", "", "file name pattern to match instead of *.json, *.ndjson and their .gz forms (e.g. 'Patient*.ndjson')")
+	flag.IntVar(&cfg.MaxFiles, "max-files", 0, "process only the first N input files, in path order (0 means no limit)")
+	flag.Func("since", "only process files modified after this RFC3339 time or date, or within this duration (e.g. 24h)", func(v string) error {
+		since, err := parseSince(v, time.Now())
+		cfg.Since = since
+		return err
+	})
+	flag.StringVar(&cfg.LogFormat, "log-format", "text", "log output format: text (human-readable) or json")
+	flag.BoolVar(&cfg.Verbose, "verbose", false, "include debug-level log messages")
+	flag.BoolVar(&cfg.Quiet, "quiet", false, "only log warnings and errors")
+	flag.DurationVar(&cfg.ProgressInterval, "progress-interval", 0, "print a progress line at this interval instead of per-file output (e.g. 10s)")
+	flag.IntVar(&cfg.ProgressEvery, "progress-every", 0, "print a progress line every N files instead of per-file output")
+	flag.StringVar(&cfg.MetricsAddr, "metrics-addr", "", "serve Prometheus metrics on this address (e.g. :9090) at /metrics while the run is in progress")
+	flag.StringVar(&cfg.PipelineURL, "pipeline-url", "http://localhost:8000/embeddings", "pipeline base URL, joined with -pipeline-path")
+	flag.StringVar(&cfg.PipelinePath, "pipeline-path", "/ingest", "ingest route under the pipeline base URL; batches go to <path>/batch")
+	flag.Func("pipeline-urls", "comma-separated pipeline base URLs to send requests to in turn, instead of -pipeline-url", func(v string) error {
+		for _, url := range strings.Split(v, ",") {
+			if url = strings.TrimSpace(url); url != "" {
+				cfg.PipelineURLs = append(cfg.PipelineURLs, url)
 			}
 		}
-		if status, ok := resource["clinicalStatus"].(string); ok {
-			parts = append(parts, fmt.Sprintf("Status: %s", status))
-		}
-		if onset, ok := resource["onsetDateTime"].(string); ok {
-			parts = append(parts, fmt.Sprintf("Onset: %s", onset))
-		}
-
-	case "Observation":
-		parts = append(parts, "Clinical Observation:")
-		if code, ok := resource["code"].(map[string]interface{}); ok {
-			if text, ok := code["text"].(string); ok {
-				parts = append(parts, text)
-			} else if coding, ok := code["coding"].([]interface{}); ok && len(coding) > 0 {
-				if codingObj, ok := coding[0].(map[string]interface{}); ok {
-					if display, ok := codingObj["display"].(string); ok {
-						parts = append(parts, display)
-					}
+		return nil
+	})
+	flag.Var(&cfg.Routes, "route", "send one resourceType to its own pipeline base URL, as `resourceType=URL` (e.g. DocumentReference=http://notes:8000/embeddings); may be repeated")
+	flag.StringVar(&cfg.Sink, "sink", "http", "where records are sent: http (the -pipeline-url ingest endpoint), kafka (-kafka-topic, via -kafka-brokers or -kafka-rest-urls), or grpc (the Ingest method at -grpc-addr)")
+	flag.Func("kafka-brokers", "comma-separated `host:port` addresses of the Kafka brokers to publish to with -sink kafka", func(v string) error {
+		for _, addr := range strings.Split(v, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				if _, _, err := net.SplitHostPort(addr); err != nil {
+					return fmt.Errorf("broker %q is not host:port", addr)
 				}
+				cfg.KafkaBrokers = append(cfg.KafkaBrokers, addr)
 			}
 		}
-		if valueQty, ok := resource["valueQuantity"].(map[string]interface{}); ok {
-			if value, ok := valueQty["value"].(float64); ok {
-				if unit, ok := valueQty["unit"].(string); ok {
-					parts = append(parts, fmt.Sprintf("Value: %.2f %s", value, unit))
-				} else {
-					parts = append(parts, fmt.Sprintf("Value: %.2f", value))
+		return nil
+	})
+	flag.Func("kafka-rest-urls", "comma-separated Kafka REST Proxy URLs to publish through with -sink kafka instead of -kafka-brokers, used in turn", func(v string) error {
+		for _, url := range strings.Split(v, ",") {
+			if url = strings.TrimSpace(url); url != "" {
+				if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+					return fmt.Errorf("REST Proxy URL %q must start with http:// or https://", url)
 				}
+				cfg.KafkaRESTURLs = append(cfg.KafkaRESTURLs, url)
 			}
 		}
-		if effective, ok := resource["effectiveDateTime"].(string); ok {
-			parts = append(parts, fmt.Sprintf("Date: %s", effective))
+		return nil
+	})
+	flag.StringVar(&cfg.GRPCAddr, "grpc-addr", "", "host:port of the pipeline's gRPC Ingest service (see ingest.proto) for -sink grpc")
+	flag.BoolVar(&cfg.GRPCTLS, "grpc-tls", false, "connect to -grpc-addr over TLS instead of plaintext")
+	flag.StringVar(&cfg.KafkaTopic, "kafka-topic", "", "Kafka topic to publish records to with -sink kafka, keyed by patientId")
+	flag.DurationVar(&cfg.RequestTimeout, "request-timeout", 30*time.Second, "timeout for each pipeline request")
+	flag.Float64Var(&cfg.RateLimit, "rate-limit", 0, "maximum pipeline requests per second across all workers (0 means no limit)")
+	flag.StringVar(&cfg.EmbedEndpoint, "embed-endpoint", "", "OpenAI-compatible embeddings endpoint (e.g. https://api.openai.com/v1/embeddings); when set, each record is sent with the vector of its content as \"embedding\"")
+	flag.StringVar(&cfg.EmbedModel, "embed-model", "", "model to request from -embed-endpoint (e.g. text-embedding-3-small)")
+	flag.StringVar(&cfg.EmbedAPIKey, "embed-api-key", "", "bearer token sent to -embed-endpoint (default $OPENAI_API_KEY)")
+	flag.IntVar(&cfg.EmbedBatchSize, "embed-batch-size", 64, "number of records' content per -embed-endpoint request")
+	flag.IntVar(&cfg.BatchSize, "batch-size", 1, "number of records per ingest request (1 sends each record individually)")
+	flag.BoolVar(&cfg.Compress, "compress-requests", false, "gzip ingest request bodies and send them with Content-Encoding: gzip (with -sink grpc, gzip-compress calls); the pipeline must accept it")
+	flag.StringVar(&cfg.HealthURL, "health-url", "http://localhost:8000/health", "pipeline health endpoint checked before processing starts")
+	flag.BoolVar(&cfg.SkipHealthcheck, "skip-healthcheck", false, "do not check -health-url before processing (always skipped with -dry-run, -output-file, or -sink kafka)")
+	flag.BoolVar(&cfg.FailFast, "fail-fast", false, "stop at the first file, line, or record that fails, with exit code 4")
+	flag.StringVar(&cfg.AuthToken, "auth-token", "", "bearer token sent with pipeline requests (default $INGEST_TOKEN)")
+	flag.Var(&cfg.Headers, "header", "extra `key=value` header for pipeline requests; may be repeated")
+	flag.DurationVar(&cfg.TimeoutTotal, "timeout-total", 0, "stop the run, with exit code 4, if it has not finished within this long (e.g. 30m; 0 means no limit)")
+	flag.IntVar(&cfg.MaxFailures, "max-failures", 0, "stop the run once more than this many records fail to ingest (0 means no limit)")
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintf(out, `
+Exit codes:
+  %d    success
+  %d    invalid options, unreadable input, or pipeline unreachable
+  %d    invalid flag syntax
+  %d    finished, but some files, lines, or records failed (or failed -validate)
+  %d    stopped early by -fail-fast, -max-failures, or -timeout-total
+  %d  interrupted
+`, exitOK, exitSetupError, 2, exitPartialFailure, exitAborted, exitInterrupted)
+	}
+	flag.Parse()
+	if configFile != "" {
+		if err := applyConfigFile(flag.CommandLine, configFile); err != nil {
+			log.Fatalf("Error reading -config %s: %v", configFile, err)
 		}
+	}
 
-	case "Encounter":
-		parts = append(parts, "Healthcare Encounter:")
-		if encType, ok := resource["type"].([]interface{}); ok && len(encType) > 0 {
-			if typeObj, ok := encType[0].(map[string]interface{}); ok {
-				if text, ok := typeObj["text"].(string); ok {
-					parts = append(parts, text)
-				} else if coding, ok := typeObj["coding"].([]interface{}); ok && len(coding) > 0 {
-					if codingObj, ok := coding[0].(map[string]interface{}); ok {
-						if display, ok := codingObj["display"].(string); ok {
-							parts = append(parts, display)
-						}
-					}
-				}
-			}
+	if cfg.Concurrency < 1 {
+		cfg.Concurrency = 1
+	}
+	if cfg.WorkersPerFile < 1 {
+		cfg.WorkersPerFile = 1
+	}
+	if cfg.ReadAhead < 0 {
+		log.Fatalf("-read-ahead must not be negative")
+	}
+	if cfg.QueueSize < 0 {
+		log.Fatalf("-queue-size must not be negative")
+	}
+	if cfg.QueueSize == 0 {
+		cfg.QueueSize = cfg.WorkersPerFile
+	}
+	switch cfg.Format {
+	case "auto", "bundle", "ndjson", "xml":
+	default:
+		log.Fatalf("Invalid -format %q: must be auto, bundle, ndjson, or xml", cfg.Format)
+	}
+	if cfg.DuplicateIDs != "first" && cfg.DuplicateIDs != "last" {
+		log.Fatalf("Invalid -duplicate-ids %q: must be first or last", cfg.DuplicateIDs)
+	}
+	switch cfg.FHIRVersion {
+	case "auto", "stu3", "r4":
+	default:
+		log.Fatalf("Invalid -fhir-version %q: must be auto, stu3, or r4", cfg.FHIRVersion)
+	}
+	if cfg.LogFormat != "text" && cfg.LogFormat != "json" {
+		log.Fatalf("Invalid -log-format %q: must be text or json", cfg.LogFormat)
+	}
+	if cfg.Verbose && cfg.Quiet {
+		log.Fatalf("-verbose and -quiet are mutually exclusive")
+	}
+	if cfg.RequestTimeout <= 0 {
+		log.Fatalf("-request-timeout must be positive")
+	}
+	if cfg.BatchSize < 1 {
+		cfg.BatchSize = 1
+	}
+	switch cfg.Sink {
+	case "http":
+	case "kafka":
+		if (len(cfg.KafkaBrokers) == 0) == (len(cfg.KafkaRESTURLs) == 0) || cfg.KafkaTopic == "" {
+			log.Fatalf("-sink kafka requires -kafka-topic and one of -kafka-brokers or -kafka-rest-urls")
 		}
-		if period, ok := resource["period"].(map[string]interface{}); ok {
-			if start, ok := period["start"].(string); ok {
-				parts = append(parts, fmt.Sprintf("Start: %s", start))
-			}
+	case "grpc":
+		if cfg.GRPCAddr == "" {
+			log.Fatalf("-sink grpc requires -grpc-addr")
 		}
-		if reason, ok := resource["reason"].(map[string]interface{}); ok {
-			if coding, ok := reason["coding"].([]interface{}); ok && len(coding) > 0 {
-				if codingObj, ok := coding[0].(map[string]interface{}); ok {
-					if display, ok := codingObj["display"].(string); ok {
-						parts = append(parts, fmt.Sprintf("Reason: %s", display))
-					}
-				}
-			}
+	default:
+		log.Fatalf("Invalid -sink %q: must be http, kafka, or grpc", cfg.Sink)
+	}
+	if cfg.Sink != "http" && (len(cfg.PipelineURLs) > 0 || len(cfg.Routes) > 0 || cfg.BatchSize > 1 || cfg.OutputFile != "" || cfg.OutputDir != "") {
+		log.Fatalf("-pipeline-urls, -route, -batch-size, -output-file, and -output-dir are only for -sink http")
+	}
+	if cfg.Sink != "kafka" && (len(cfg.KafkaBrokers) > 0 || len(cfg.KafkaRESTURLs) > 0 || cfg.KafkaTopic != "") {
+		log.Fatalf("-kafka-brokers, -kafka-rest-urls, and -kafka-topic are only for -sink kafka")
+	}
+	if cfg.Sink == "kafka" && cfg.Compress {
+		log.Fatalf("-compress-requests is only for -sink http and grpc")
+	}
+	if cfg.RateLimit < 0 {
+		log.Fatalf("-rate-limit must not be negative")
+	}
+	if cfg.AuthToken == "" {
+		cfg.AuthToken = os.Getenv("INGEST_TOKEN")
+	}
+	if cfg.FollowNext {
+		if cfg.FHIRServer == "" {
+			log.Fatalf("-follow-next requires -fhir-server")
 		}
-
-	case "MedicationRequest":
-		parts = append(parts, "Medication Prescription:")
-		if medRef, ok := resource["medicationReference"].(map[string]interface{}); ok {
-			if ref, ok := medRef["reference"].(string); ok {
-				parts = append(parts, fmt.Sprintf("Medication Reference: %s", ref))
-			}
+		if cfg.Stdin {
+			log.Fatalf("-follow-next cannot be used with -stdin")
 		}
-		if status, ok := resource["status"].(string); ok {
-			parts = append(parts, fmt.Sprintf("Status: %s", status))
+		if cfg.MaxPages < 1 {
+			log.Fatalf("-max-pages must be at least 1")
 		}
-		if authored, ok := resource["authoredOn"].(string); ok {
-			parts = append(parts, fmt.Sprintf("Prescribed: %s", authored))
+	}
+	if cfg.FHIRToken == "" {
+		cfg.FHIRToken = os.Getenv("FHIR_TOKEN")
+	}
+	if cfg.EmbedEndpoint != "" && cfg.EmbedModel == "" {
+		log.Fatalf("-embed-endpoint requires -embed-model")
+	}
+	if cfg.EmbedBatchSize < 1 {
+		log.Fatalf("-embed-batch-size must be at least 1")
+	}
+	if cfg.EmbedAPIKey == "" {
+		cfg.EmbedAPIKey = os.Getenv("OPENAI_API_KEY")
+	}
+	if cfg.TimeoutTotal < 0 {
+		log.Fatalf("-timeout-total must not be negative")
+	}
+	if cfg.MaxFailures < 0 {
+		log.Fatalf("-max-failures must not be negative")
+	}
+	if cfg.FailFast && cfg.MaxFailures > 0 {
+		log.Fatalf("-fail-fast and -max-failures are mutually exclusive")
+	}
+	if cfg.DedupFile != "" {
+		cfg.Dedup = true
+	}
+	if contentPointersFile != "" {
+		var err error
+		if cfg.ContentPointers, err = loadContentPointers(contentPointersFile); err != nil {
+			log.Fatalf("Error reading -content-pointers %s: %v", contentPointersFile, err)
 		}
-
-	case "Medication":
-		parts = append(parts, "Medication:")
-		if code, ok := resource["code"].(map[string]interface{}); ok {
-			if text, ok := code["text"].(string); ok {
-				parts = append(parts, text)
-			} else if coding, ok := code["coding"].([]interface{}); ok && len(coding) > 0 {
-				if codingObj, ok := coding[0].(map[string]interface{}); ok {
-					if display, ok := codingObj["display"].(string); ok {
-						parts = append(parts, display)
-					}
-				}
-			}
+	}
+	if prefixTemplateFile != "" {
+		var err error
+		if cfg.PrefixTemplates, err = loadPrefixTemplates(prefixTemplateFile); err != nil {
+			log.Fatalf("Error reading -prefix-template %s: %v", prefixTemplateFile, err)
 		}
-
-	case "Immunization":
-		parts = append(parts, "Immunization:")
-		if vaccineCode, ok := resource["vaccineCode"].(map[string]interface{}); ok {
-			if coding, ok := vaccineCode["coding"].([]interface{}); ok && len(coding) > 0 {
-				if codingObj, ok := coding[0].(map[string]interface{}); ok {
-					if display, ok := codingObj["display"].(string); ok {
-						parts = append(parts, display)
-					}
-				}
-			}
+	}
+	if cfg.MaxContentChars < 0 {
+		log.Fatalf("-max-content-chars must not be negative")
+	}
+	if cfg.MinContentChars < 0 {
+		log.Fatalf("-min-content-chars must not be negative")
+	}
+	if cfg.MaxContentChars > 0 && cfg.MinContentChars > cfg.MaxContentChars {
+		log.Fatalf("-min-content-chars must not exceed -max-content-chars")
+	}
+	if cfg.FlattenBundle && cfg.EmbedPatientContext {
+		log.Fatalf("-flatten-bundle and -embed-patient-context are mutually exclusive; a flattened record already has a Patient section")
+	}
+	if cfg.OutputFile != "" && cfg.OutputDir != "" {
+		log.Fatalf("-output-file and -output-dir are mutually exclusive")
+	}
+	if cfg.Pretty && !cfg.DryRun && cfg.OutputFile == "" && cfg.OutputDir == "" {
+		log.Fatalf("-pretty is only for reading records; use it with -dry-run, -output-file, or -output-dir")
+	}
+	if cfg.MaxFiles < 0 {
+		log.Fatalf("-max-files must not be negative")
+	}
+	dataDir, err := expandPath(cfg.DataDir)
+	if err != nil {
+		log.Fatalf("Invalid -data-dir %q: %v", cfg.DataDir, err)
+	}
+	if dataDir == "" {
+		log.Fatalf("-data-dir %q expands to an empty path", cfg.DataDir)
+	}
+	cfg.DataDir = dataDir
+	if cfg.DedupCapacity < 1 {
+		log.Fatalf("-dedup-capacity must be positive")
+	}
+	if _, err := filepath.Match(cfg.Glob, ""); err != nil {
+		log.Fatalf("Invalid -glob %q: %v", cfg.Glob, err)
+	}
+	if cfg.Stdin && cfg.Replay != "" {
+		log.Fatalf("-stdin and -replay are mutually exclusive")
+	}
+	if cfg.Resume && (cfg.Stdin || cfg.Replay != "" || cfg.DryRun) {
+		log.Fatalf("-resume cannot be used with -stdin, -replay, or -dry-run")
+	}
+	switch cfg.OnParseError {
+	case "log", "fail":
+	case "quarantine":
+		if cfg.QuarantineDir == "" {
+			log.Fatalf("-on-parse-error quarantine requires -quarantine-dir")
 		}
-		if date, ok := resource["date"].(string); ok {
-			parts = append(parts, fmt.Sprintf("Date: %s", date))
+		if cfg.Stdin || cfg.Replay != "" {
+			log.Fatalf("-on-parse-error quarantine cannot be used with -stdin or -replay")
 		}
+	default:
+		log.Fatalf("Invalid -on-parse-error %q: must be log, quarantine, or fail", cfg.OnParseError)
+	}
+	if cfg.Replay != "" && cfg.DeadLetterFile != "" && filepath.Clean(cfg.Replay) == filepath.Clean(cfg.DeadLetterFile) {
+		log.Fatalf("-replay and -dead-letter-file must be different files")
+	}
+	return cfg
+}
 
-	case "DiagnosticReport":
-		parts = append(parts, "Diagnostic Report:")
-		if code, ok := resource["code"].(map[string]interface{}); ok {
-			if coding, ok := code["coding"].([]interface{}); ok && len(coding) > 0 {
-				if codingObj, ok := coding[0].(map[string]interface{}); ok {
-					if display, ok := codingObj["display"].(string); ok {
-						parts = append(parts, display)
-					}
-				}
-			}
-		}
-		if effective, ok := resource["effectiveDateTime"].(string); ok {
-			parts = append(parts, fmt.Sprintf("Date: %s", effective))
+// expandPath expands $VAR and ${VAR} in path from the environment, then a
+// leading ~ to the user's home directory, so "$HOME/data" and "~/data" name
+// the same place.
+func expandPath(path string) (string, error) {
+	path = os.ExpandEnv(path)
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
 		}
+		path = filepath.Join(home, path[1:])
+	}
+	return path, nil
+}
 
-	case "Procedure":
-		parts = append(parts, "Medical Procedure:")
-		if code, ok := resource["code"].(map[string]interface{}); ok {
-			if coding, ok := code["coding"].([]interface{}); ok && len(coding) > 0 {
-				if codingObj, ok := coding[0].(map[string]interface{}); ok {
-					if display, ok := codingObj["display"].(string); ok {
-						parts = append(parts, display)
-					}
-				}
-			}
+// applyConfigFile sets the flags in fs from a JSON object keyed by flag name,
+// e.g. {"concurrency": 8, "include-types": ["Condition", "Observation"]}.
+// Flags already set on the command line are left alone. Arrays set a flag
+// once per element, like repeating it. Unknown keys are an error.
+func applyConfigFile(fs *flag.FlagSet, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var options map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&options); err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	onCommandLine := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { onCommandLine[f.Name] = true })
+
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if name == "config" || fs.Lookup(name) == nil {
+			return fmt.Errorf("unknown option %q", name)
 		}
-		if performed, ok := resource["performedDateTime"].(string); ok {
-			parts = append(parts, fmt.Sprintf("Performed: %s", performed))
+		if onCommandLine[name] {
+			continue
 		}
-
-	case "Organization":
-		parts = append(parts, "Organization:")
-		if name, ok := resource["name"].(string); ok {
-			parts = append(parts, name)
+		values, ok := options[name].([]interface{})
+		if !ok {
+			values = []interface{}{options[name]}
 		}
-
-	default:
-		// For unknown resource types, try to extract code/text fields
-		if code, ok := resource["code"].(map[string]interface{}); ok {
-			if text, ok := code["text"].(string); ok {
-				parts = append(parts, text)
-			} else if coding, ok := code["coding"].([]interface{}); ok && len(coding) > 0 {
-				if codingObj, ok := coding[0].(map[string]interface{}); ok {
-					if display, ok := codingObj["display"].(string); ok {
-						parts = append(parts, display)
-					}
-				}
+		for _, v := range values {
+			var value string
+			switch v := v.(type) {
+			case string:
+				value = v
+			case json.Number:
+				value = v.String()
+			case bool:
+				value = strconv.FormatBool(v)
+			default:
+				return fmt.Errorf("option %q: unsupported value %v", name, v)
+			}
+			if err := fs.Set(name, value); err != nil {
+				return fmt.Errorf("option %q: %w", name, err)
 			}
 		}
 	}
+	return nil
+}
 
-	if len(parts) == 0 {
-		return ""
+// runState is what the workers of one run share besides its Config. run
+// builds it once the flags are parsed, opens the stores the options ask for,
+// and passes it down to the senders and sinks.
+type runState struct {
+	// httpClient is shared by all workers so pipeline connections are
+	// pooled. Timeouts are applied per request through the request context.
+	httpClient *http.Client
+	// pacer is httpClient's transport. Kafka writes and gRPC calls wait on
+	// it too, so -rate-limit and Retry-After pauses hold them back as they
+	// do pipeline POSTs.
+	pacer *pacedTransport
+	// endpoints spreads requests across the -pipeline-urls endpoints, or the
+	// -kafka-rest-urls with -sink kafka. It is nil when only -pipeline-url
+	// is used.
+	endpoints *endpointPool
+	// metrics collects the counters served on -metrics-addr. It is nil, and
+	// its methods do nothing, when metrics are disabled.
+	metrics *runMetrics
+	// failures counts pipeline failures across all workers when
+	// -max-failures or -fail-fast is set, and is nil otherwise.
+	failures *failureLimit
+	// deadLetters receives records the pipeline failed to ingest when
+	// -dead-letter-file is set.
+	deadLetters *jsonlFile
+	// seenResources tracks resources already handled in this run when
+	// -dedup is set.
+	seenResources dedupStore
+	// ingestCache holds the content hashes of resources the pipeline has
+	// accepted, across runs, when -incremental is set. It is nil otherwise,
+	// and its methods do nothing.
+	ingestCache *changeCache
+	// estimateTokens is the tokenEstimator used for dry-run output and the
+	// run summary. Swap it for one matching the embedding model's tokenizer.
+	estimateTokens tokenEstimator
+}
+
+// newRunState returns the runState for a run with cfg, with none of the
+// stores opened yet. Its client's idle pool is sized for every sender
+// (cfg.Concurrency files with cfg.WorkersPerFile each) posting to the same
+// pipeline host, and requests are paced by -rate-limit and 429 responses.
+func newRunState(cfg *Config) *runState {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = 100
+	transport.MaxIdleConnsPerHost = cfg.Concurrency * cfg.WorkersPerFile
+	transport.IdleConnTimeout = 90 * time.Second
+	transport.ResponseHeaderTimeout = cfg.RequestTimeout
+	pacer := newPacedTransport(cfg, transport)
+	state := &runState{httpClient: &http.Client{Transport: pacer}, pacer: pacer, estimateTokens: heuristicTokens}
+	if len(cfg.PipelineURLs) > 0 {
+		state.endpoints = newEndpointPool(cfg.PipelineURLs)
+	} else if len(cfg.KafkaRESTURLs) > 0 {
+		state.endpoints = newEndpointPool(cfg.KafkaRESTURLs)
 	}
+	return state
+}
 
-	return strings.Join(parts, " ")
+// newPacedTransport returns base paced by -rate-limit, with a burst of one
+// so requests are evenly spaced across all workers.
+func newPacedTransport(cfg *Config, base http.RoundTripper) *pacedTransport {
+	limit := rate.Inf
+	if cfg.RateLimit > 0 {
+		limit = rate.Limit(cfg.RateLimit)
+	}
+	return &pacedTransport{base: base, limiter: rate.NewLimiter(limit, 1), retryPause: &retryPause{}}
 }
 
-func cleanHTML(html string) string {
-	// Simple HTML tag removal
-	html = strings.ReplaceAll(html, "<div>", "")
-	html = strings.ReplaceAll(html, "</div>", "")
-	html = strings.ReplaceAll(html, "<a", "")
-	html = strings.ReplaceAll(html, "</a>", "")
-	html = strings.ReplaceAll(html, ">", " ")
-	html = strings.ReplaceAll(html, "<", "")
-	html = strings.TrimSpace(html)
-	return html
+// retryPause holds back every request until a Retry-After delay has
+// passed. It is separate from the -rate-limit limiter, which only spaces
+// requests out.
+type retryPause struct {
+	mu    sync.Mutex
+	until time.Time
 }
 
-func sendToPipeline(data map[string]string) {
-	jsonData, err := json.Marshal(data)
-	if err != nil {
-		log.Printf("Error marshaling data: %v", err)
-		return
+// wait blocks until any pause is over, or until ctx is done.
+func (p *retryPause) wait(ctx context.Context) error {
+	p.mu.Lock()
+	delay := time.Until(p.until)
+	p.mu.Unlock()
+	if delay <= 0 {
+		return nil
 	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
-	resp, err := http.Post("http://localhost:8000/embeddings/ingest", "application/json", bytes.NewBuffer(jsonData))
-	if err != nil {
-		log.Printf("Error sending to pipeline: %v", err)
-		return
+// extend holds back all requests for d, unless a longer pause is already
+// in effect.
+func (p *retryPause) extend(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if until := time.Now().Add(d); until.After(p.until) {
+		p.until = until
 	}
-	defer resp.Body.Close()
+}
 
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("Pipeline returned status %d for ID: %s", resp.StatusCode, data["id"])
-		return
+// maxRateLimitRetries bounds how often one request is retried after 429
+// responses, and maxRetryAfter how long a single Retry-After may pause
+// sending.
+const (
+	maxRateLimitRetries = 3
+	maxRetryAfter       = time.Minute
+)
+
+// pacedTransport waits out any Retry-After pause and then the -rate-limit
+// limiter before each request. On a 429
+// response with a Retry-After header it pauses every worker's requests for
+// that long and retries, unless the wait would outlast the request's
+// deadline, in which case the 429 is returned.
+type pacedTransport struct {
+	base       http.RoundTripper
+	limiter    *rate.Limiter
+	retryPause *retryPause
+}
+
+// wait blocks until a request may be sent, or until ctx is done.
+func (t *pacedTransport) wait(ctx context.Context) error {
+	if err := t.retryPause.wait(ctx); err != nil {
+		return err
 	}
+	return t.limiter.Wait(ctx)
+}
+
+func (t *pacedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if err := t.wait(req.Context()); err != nil {
+			return nil, err
+		}
+		resp, err := t.base.RoundTrip(req)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+			return resp, err
+		}
+		delay, ok := retryAfter(resp.Header.Get("Retry-After"), time.Now())
+		if !ok {
+			return resp, nil
+		}
+		t.retryPause.extend(delay)
+		if attempt >= maxRateLimitRetries || (req.Body != nil && req.GetBody == nil) {
+			return resp, nil
+		}
+		if deadline, ok := req.Context().Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			return resp, nil
+		}
+		logger.Warn(fmt.Sprintf("Pipeline is rate limiting; pausing requests for %s", delay),
+			"pipelineURL", req.URL.String(), "retryAfter", delay.String())
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		req = req.Clone(req.Context())
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// retryAfter parses a Retry-After header, given in seconds or as an HTTP
+// date, capped at maxRetryAfter.
+func retryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	var d time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		d = time.Duration(seconds) * time.Second
+	} else if when, err := http.ParseTime(value); err == nil {
+		d = when.Sub(now)
+	} else {
+		return 0, false
+	}
+	return min(max(d, 0), maxRetryAfter), true
+}
+
+// logger is the structured logger used for all progress and diagnostic
+// output. It defaults to human-readable text at info level and is replaced by
+// setupLogging once flags are parsed.
+var logger = slog.New(newHumanHandler(os.Stdout, os.Stderr, slog.LevelInfo))
+
+// setupLogging configures logger from the -log-format, -verbose, and -quiet
+// flags.
+func setupLogging(cfg *Config) {
+	level := slog.LevelInfo
+	if cfg.Verbose {
+		level = slog.LevelDebug
+	} else if cfg.Quiet || progressEnabled(cfg) {
+		// Periodic progress lines replace per-file output
+		level = slog.LevelWarn
+	}
+
+	logger = slog.New(newLogHandler(cfg, level))
+	progressLogger = slog.New(newLogHandler(cfg, slog.LevelInfo))
+}
+
+// progressLogger emits periodic progress lines. It stays at info level so
+// progress is still reported under -quiet.
+var progressLogger = logger
+
+func progressEnabled(cfg *Config) bool {
+	return cfg.ProgressInterval > 0 || cfg.ProgressEvery > 0
+}
+
+func newLogHandler(cfg *Config, level slog.Level) slog.Handler {
+	if cfg.LogFormat == "json" {
+		return slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
+			Level: level,
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				// Messages carry leading indentation and blank lines for the
+				// text format; strip them from structured output.
+				if len(groups) == 0 && a.Key == slog.MessageKey {
+					a.Value = slog.StringValue(strings.TrimSpace(a.Value.String()))
+				}
+				return a
+			},
+		})
+	}
+	return newHumanHandler(os.Stdout, os.Stderr, level)
+}
+
+// progressTracker reports run-level throughput for -progress-interval and
+// -progress-every.
+type progressTracker struct {
+	start      time.Time
+	totalFiles int
+	lastDone   int // files done at the last -progress-every report
+}
+
+// report logs files done, entries ingested, failures, entry rate, and an
+// estimate of the time remaining.
+func (p *progressTracker) report(done, failed int, summary *Summary) {
+	elapsed := time.Since(p.start)
+	rate := float64(summary.Ingested) / elapsed.Seconds()
+
+	eta := "unknown"
+	if done > 0 {
+		remaining := time.Duration(float64(elapsed) / float64(done) * float64(p.totalFiles-done))
+		eta = remaining.Round(time.Second).String()
+	}
+
+	progressLogger.Info(
+		fmt.Sprintf("Progress: %d/%d files (%.1f%%), %d entries ingested, %d failed files, %d pipeline failures, %.1f entries/s, ETA %s",
+			done, p.totalFiles, 100*float64(done)/float64(p.totalFiles), summary.Ingested, failed, summary.PipelineFailures, rate, eta),
+		"filesDone", done, "filesTotal", p.totalFiles, "ingested", summary.Ingested, "failedFiles", failed,
+		"pipelineFailures", summary.PipelineFailures, "entriesPerSecond", rate, "elapsed", elapsed.Round(time.Millisecond).String())
+}
+
+// humanHandler is a slog.Handler that preserves the tool's original console
+// output: info and debug messages are printed bare to stdout, while warnings
+// and errors go to stderr with a log-style timestamp. Attributes are only
+// emitted by the JSON format.
+type humanHandler struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	errOut io.Writer
+	level  slog.Level
+}
+
+func newHumanHandler(out, errOut io.Writer, level slog.Level) *humanHandler {
+	return &humanHandler{mu: &sync.Mutex{}, out: out, errOut: errOut, level: level}
+}
+
+func (h *humanHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *humanHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if r.Level >= slog.LevelWarn {
+		_, err := fmt.Fprintf(h.errOut, "%s %s\n", r.Time.Format("2006/01/02 15:04:05"), r.Message)
+		return err
+	}
+	_, err := fmt.Fprintln(h.out, r.Message)
+	return err
+}
+
+func (h *humanHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+
+func (h *humanHandler) WithGroup(string) slog.Handler { return h }
+
+func main() {
+	os.Exit(run())
+}
+
+// run processes the input files and returns the process exit code.
+func run() int {
+	cfg := parseFlags()
+	setupLogging(&cfg)
+	state := newRunState(&cfg)
+
+	// The first SIGINT/SIGTERM stops dispatching new work; requests already in
+	// flight are allowed to finish. Restoring default handling after the first
+	// signal lets a second Ctrl-C force an immediate exit. The signals are
+	// read from a channel rather than through signal.NotifyContext, whose
+	// context is also cancelled when run returns normally.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	signalCtx, interrupt := context.WithCancel(context.Background())
+	defer interrupt()
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case sig := <-signals:
+			signal.Stop(signals)
+			logger.Warn("Interrupt received: finishing in-flight requests (press Ctrl-C again to force quit)", "signal", sig.String())
+			interrupt()
+		case <-finished:
+		}
+	}()
+
+	// -max-failures and -fail-fast stop the run the same way, with
+	// errTooManyFailures or errFailFast as the cause
+	ctx, abort := context.WithCancelCause(signalCtx)
+	defer abort(nil)
+	switch {
+	case cfg.FailFast:
+		state.failures = &failureLimit{max: 0, abort: abort, cause: errFailFast}
+	case cfg.MaxFailures > 0:
+		state.failures = &failureLimit{max: int64(cfg.MaxFailures), abort: abort, cause: errTooManyFailures}
+	}
+	// -timeout-total stops dispatching the same way; requests in flight
+	// still get their own -request-timeout
+	if cfg.TimeoutTotal > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, cfg.TimeoutTotal, errTimeoutTotal)
+		defer cancel()
+	}
+
+	// Process all input files in a folder
+	dataDir := cfg.DataDir
+
+	var files []string
+	var notProcessed int
+	var checkpoint *checkpointFile // with -resume
+	var err error
+	switch {
+	case cfg.Replay != "":
+		// The dead-letter file is processed as the only input
+		logger.Info(fmt.Sprintf("Replaying dead-letter records from: %s", cfg.Replay), "replay", cfg.Replay)
+		files = []string{cfg.Replay}
+	case cfg.Stdin:
+		logger.Info("Reading from standard input")
+		files = []string{stdinName}
+	default:
+		logger.Info(fmt.Sprintf("Processing all input files in: %s", dataDir), "dataDir", dataDir)
+
+		files, err = findInputFiles(&cfg, dataDir)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Error reading directory: %v", err), "dataDir", dataDir, "error", err)
+			return exitSetupError
+		}
+
+		if len(files) == 0 {
+			logger.Warn(fmt.Sprintf("No input files found in %s", dataDir), "dataDir", dataDir)
+			return exitOK
+		}
+
+		if !cfg.Since.IsZero() {
+			var skipped int
+			files, skipped, err = filterModifiedSince(files, cfg.Since)
+			if err != nil {
+				logger.Error(fmt.Sprintf("Error reading file times: %v", err), "dataDir", dataDir, "error", err)
+				return exitSetupError
+			}
+			since := cfg.Since.Format(time.RFC3339)
+			logger.Info(fmt.Sprintf("Skipping %d files not modified since %s", skipped, since), "skippedFiles", skipped, "since", since)
+			if len(files) == 0 {
+				logger.Warn(fmt.Sprintf("No files in %s modified since %s", dataDir, since), "dataDir", dataDir, "since", since)
+				return exitOK
+			}
+		}
+
+		if cfg.Resume {
+			checkpoint, err = openCheckpoint(cfg.CheckpointFile)
+			if err != nil {
+				logger.Error(fmt.Sprintf("Error opening checkpoint file: %v", err), "checkpointFile", cfg.CheckpointFile, "error", err)
+				return exitSetupError
+			}
+			defer func() {
+				if err := checkpoint.Close(); err != nil {
+					logger.Error(fmt.Sprintf("Error closing checkpoint file: %v", err), "checkpointFile", cfg.CheckpointFile, "error", err)
+				}
+			}()
+			var skipped int
+			files, skipped = checkpoint.filter(files)
+			logger.Info(fmt.Sprintf("Skipping %d files already completed (-resume)", skipped), "skippedFiles", skipped, "checkpointFile", cfg.CheckpointFile)
+			if len(files) == 0 {
+				logger.Warn(fmt.Sprintf("Every file in %s is already in %s", dataDir, cfg.CheckpointFile), "dataDir", dataDir, "checkpointFile", cfg.CheckpointFile)
+				return exitOK
+			}
+		}
+
+		if cfg.MaxFiles > 0 && len(files) > cfg.MaxFiles {
+			notProcessed = len(files) - cfg.MaxFiles
+			logger.Info(fmt.Sprintf("Processing only the first %d of %d files (-max-files)", cfg.MaxFiles, len(files)),
+				"maxFiles", cfg.MaxFiles, "files", len(files))
+			files = files[:cfg.MaxFiles]
+		}
+	}
+
+	logger.Info(fmt.Sprintf("Found %d input files (concurrency: %d)", len(files), cfg.Concurrency),
+		"files", len(files), "concurrency", cfg.Concurrency)
+	if !cfg.DryRun && cfg.OutputFile == "" && cfg.OutputDir == "" && cfg.Sink == "http" && !cfg.SkipHealthcheck {
+		if err := checkPipelineHealth(ctx, &cfg, state.httpClient); err != nil {
+			logger.Error(fmt.Sprintf("Pipeline is not reachable: %v (start it or pass -skip-healthcheck)", err),
+				"healthURL", cfg.HealthURL, "error", err)
+			return exitSetupError
+		}
+	}
+
+	output := cfg.OutputFile
+	if cfg.OutputDir != "" {
+		output = cfg.OutputDir
+	}
+	sink, err := openSink(&cfg, state, dataDir)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Error opening output file: %v", err), "outputFile", output, "error", err)
+		return exitSetupError
+	}
+	defer func() {
+		if err := sink.Close(); err != nil {
+			logger.Error(fmt.Sprintf("Error closing output file: %v", err), "outputFile", output, "error", err)
+		}
+	}()
+	if cfg.DryRun {
+		logger.Info("Dry run: records will be printed, not sent to the pipeline")
+	} else if cfg.OutputFile != "" {
+		logger.Info(fmt.Sprintf("Writing records to %s instead of the pipeline", cfg.OutputFile), "outputFile", cfg.OutputFile)
+	} else if cfg.OutputDir != "" {
+		logger.Info(fmt.Sprintf("Writing records under %s instead of the pipeline", cfg.OutputDir), "outputDir", cfg.OutputDir)
+	} else if cfg.DeadLetterFile != "" {
+		state.deadLetters, err = openJSONLFile(cfg.DeadLetterFile)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Error opening dead-letter file: %v", err), "deadLetterFile", cfg.DeadLetterFile, "error", err)
+			return exitSetupError
+		}
+		defer func() {
+			if err := state.deadLetters.Close(); err != nil {
+				logger.Error(fmt.Sprintf("Error closing dead-letter file: %v", err), "deadLetterFile", cfg.DeadLetterFile, "error", err)
+			}
+		}()
+	}
+
+	if cfg.Dedup {
+		state.seenResources, err = openDedupStore(&cfg)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Error opening dedup store: %v", err), "dedupFile", cfg.DedupFile, "error", err)
+			return exitSetupError
+		}
+		defer state.seenResources.Close()
+	}
+
+	if cfg.Incremental {
+		state.ingestCache, err = loadChangeCache(cfg.IncrementalCache)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Error loading incremental cache: %v", err), "incrementalCache", cfg.IncrementalCache, "error", err)
+			return exitSetupError
+		}
+		// Saved however the run ends, since only accepted records are in it
+		defer func() {
+			if err := state.ingestCache.save(); err != nil {
+				logger.Error(fmt.Sprintf("Error saving incremental cache: %v", err), "incrementalCache", cfg.IncrementalCache, "error", err)
+			}
+		}()
+	}
+
+	if cfg.MetricsAddr != "" {
+		state.metrics = newRunMetrics()
+		server := &http.Server{Addr: cfg.MetricsAddr, Handler: state.metrics}
+		go func() {
+			if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Error(fmt.Sprintf("Metrics server failed: %v", err), "metricsAddr", cfg.MetricsAddr, "error", err)
+			}
+		}()
+		defer server.Close()
+		logger.Info(fmt.Sprintf("Serving metrics on %s/metrics", cfg.MetricsAddr), "metricsAddr", cfg.MetricsAddr)
+	}
+
+	// Process files through a bounded worker pool; the semaphore caps the
+	// number of files in flight at cfg.Concurrency.
+	var (
+		wg          sync.WaitGroup
+		mu          sync.Mutex
+		completed   int
+		failed      int
+		interrupted int
+		dispatched  int
+		totals      = newSummaryTotals()
+		outcomes    []ResourceOutcome // for -report-file
+	)
+	sem := make(chan struct{}, cfg.Concurrency)
+
+	progress := &progressTracker{start: time.Now(), totalFiles: len(files)}
+	if cfg.ProgressInterval > 0 {
+		ticker := time.NewTicker(cfg.ProgressInterval)
+		defer ticker.Stop()
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			for {
+				select {
+				case <-ticker.C:
+					mu.Lock()
+					summary := totals.Snapshot()
+					progress.report(completed+failed+interrupted, failed, &summary)
+					mu.Unlock()
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+dispatch:
+	for i, filePath := range files {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			break dispatch
+		}
+		if ctx.Err() != nil {
+			<-sem
+			break
+		}
+		dispatched++
+		wg.Add(1)
+		go func(i int, filePath string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			logger.Info(fmt.Sprintf("[%d/%d] Processing: %s", i+1, len(files), filepath.Base(filePath)), "file", filePath)
+			fileSummary, fileOutcomes, err := processFile(ctx, &cfg, state, sink, filePath)
+
+			mu.Lock()
+			defer mu.Unlock()
+			// Added under mu so progress lines agree with the file counts
+			totals.Add(fileSummary)
+			if cfg.ReportFile != "" {
+				outcomes = append(outcomes, fileOutcomes...)
+			}
+			if cfg.ProgressEvery > 0 {
+				defer func() {
+					if done := completed + failed + interrupted; done%cfg.ProgressEvery == 0 {
+						summary := totals.Snapshot()
+						progress.report(done, failed, &summary)
+						progress.lastDone = done
+					}
+				}()
+			}
+			if errors.Is(err, context.Canceled) || errors.Is(err, errTooManyFailures) || errors.Is(err, errFailFast) || errors.Is(err, errTimeoutTotal) || errors.Is(err, errParseFailure) {
+				logger.Warn(fmt.Sprintf("[%d/%d] Interrupted: %v", i+1, len(files), err), "file", filePath)
+				interrupted++
+				state.metrics.addFile("interrupted", fileSummary)
+				return
+			}
+			if err != nil {
+				logger.Error(fmt.Sprintf("[%d/%d] Failed: %v", i+1, len(files), err), "file", filePath, "error", err)
+				failed++
+				state.metrics.addFile("failed", fileSummary)
+				// Only the file itself, not a -follow-next page
+				var parseErr *ParseError
+				if errors.As(err, &parseErr) && parseErr.File == filePath {
+					switch cfg.OnParseError {
+					case "quarantine":
+						dest, err := quarantineFile(cfg.QuarantineDir, dataDir, filePath)
+						if err != nil {
+							logger.Error(fmt.Sprintf("[%d/%d] Error quarantining %s: %v", i+1, len(files), filePath, err), "file", filePath, "error", err)
+						} else {
+							logger.Warn(fmt.Sprintf("[%d/%d] Quarantined %s as %s", i+1, len(files), filePath, dest), "file", filePath, "quarantinedAs", dest)
+						}
+					case "fail":
+						abort(errParseFailure)
+					}
+				}
+				if cfg.FailFast {
+					abort(errFailFast)
+				}
+				return
+			}
+			completed++
+			state.metrics.addFile("completed", fileSummary)
+			// A file with failed records is left out so a resumed run retries it
+			if fileSummary.PipelineFailures == 0 {
+				if err := checkpoint.add(filePath); err != nil {
+					logger.Error(fmt.Sprintf("Error updating checkpoint file: %v", err), "checkpointFile", cfg.CheckpointFile, "error", err)
+				}
+			}
+			if cfg.FailFast && fileSummary.MalformedRecords > 0 {
+				abort(errFailFast)
+			}
+		}(i, filePath)
+	}
+	wg.Wait()
+	summary := totals.Snapshot()
+
+	if done := completed + failed + interrupted; progressEnabled(&cfg) && (cfg.ProgressEvery == 0 || done != progress.lastDone) {
+		progress.report(done, failed, &summary)
+	}
+
+	logger.Info(fmt.Sprintf("✓ Completed processing %d files", completed), "completed", completed)
+	if failed > 0 {
+		logger.Warn(fmt.Sprintf("✗ Failed to process %d files", failed), "failed", failed)
+	}
+	if errors.Is(context.Cause(ctx), errTooManyFailures) {
+		logger.Error(fmt.Sprintf("✗ Stopped after more than %d pipeline failures (-max-failures)", cfg.MaxFailures),
+			"maxFailures", cfg.MaxFailures)
+	}
+	if errors.Is(context.Cause(ctx), errFailFast) {
+		logger.Error("✗ Stopped at the first error (-fail-fast)")
+	}
+	if errors.Is(context.Cause(ctx), errTimeoutTotal) {
+		logger.Error(fmt.Sprintf("✗ Stopped after %s (-timeout-total)", cfg.TimeoutTotal),
+			"timeoutTotal", cfg.TimeoutTotal.String())
+	}
+	if errors.Is(context.Cause(ctx), errParseFailure) {
+		logger.Error("✗ Stopped at a file that could not be parsed (-on-parse-error fail)")
+	}
+	if ctx.Err() != nil {
+		logger.Warn(fmt.Sprintf("⚠ Run interrupted: %d files stopped early, %d files not started", interrupted, len(files)-dispatched),
+			"interrupted", interrupted, "notStarted", len(files)-dispatched)
+	}
+
+	summary.FilesNotProcessed = notProcessed
+
+	if cfg.LogFormat == "json" {
+		logger.Info("Summary", "summary", summary)
+	} else {
+		fmt.Println()
+		summary.Print(os.Stdout)
+	}
+
+	code := exitOK
+	switch cause := context.Cause(ctx); {
+	case errors.Is(cause, errTooManyFailures) || errors.Is(cause, errFailFast) || errors.Is(cause, errTimeoutTotal) || errors.Is(cause, errParseFailure):
+		code = exitAborted
+	case cause != nil:
+		code = exitInterrupted
+	case failed > 0 || summary.PipelineFailures > 0 || summary.MalformedRecords > 0 || summary.Invalid > 0:
+		code = exitPartialFailure
+	}
+
+	if cfg.ReportFile != "" {
+		if err := writeReport(cfg.ReportFile, outcomes, summary, code); err != nil {
+			logger.Error(fmt.Sprintf("Error writing report: %v", err), "reportFile", cfg.ReportFile, "error", err)
+		}
+	}
+	return code
+}
+
+// Report is the JSON document written by -report-file.
+type Report struct {
+	Resources []ResourceOutcome `json:"resources"`
+	Summary   Summary           `json:"summary"`
+	ExitCode  int               `json:"exitCode"`
+}
+
+// writeReport writes the -report-file to a temporary file and renames it over
+// path, so readers never see a partial report.
+func writeReport(path string, outcomes []ResourceOutcome, summary Summary, code int) error {
+	if outcomes == nil {
+		outcomes = []ResourceOutcome{}
+	}
+	data, err := json.MarshalIndent(Report{Resources: outcomes, Summary: summary, ExitCode: code}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// inputPatterns match the Bundle (*.json, *.xml) and bulk-export (*.ndjson)
+// files read by default, plain or gzipped.
+var inputPatterns = []string{"*.json", "*.ndjson", "*.xml", "*.json.gz", "*.ndjson.gz", "*.xml.gz"}
+
+// findInputFiles returns the input files in dataDir, sorted by path. Names
+// are matched against -glob if set, otherwise inputPatterns. With -recursive
+// subdirectories are searched too.
+func findInputFiles(cfg *Config, dataDir string) ([]string, error) {
+	patterns := inputPatterns
+	if cfg.Glob != "" {
+		patterns = []string{cfg.Glob}
+	}
+
+	var files []string
+	if cfg.Recursive {
+		var err error
+		files, err = walkInputFiles(dataDir, patterns)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		for _, pattern := range patterns {
+			matches, err := filepath.Glob(filepath.Join(dataDir, pattern))
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, matches...)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// walkInputFiles returns the files under root whose names match any of
+// patterns. Symlinked directories are followed, but each real directory is
+// visited at most once so symlink loops terminate.
+func walkInputFiles(root string, patterns []string) ([]string, error) {
+	var files []string
+	visited := make(map[string]bool)
+
+	// WalkDir does not follow symlinks, even as its root, unless the root
+	// has a trailing separator; symlinked directories start a new walk
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		return filepath.WalkDir(dir+string(filepath.Separator), func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.Type()&fs.ModeSymlink != 0 {
+				info, err := os.Stat(path)
+				if err != nil {
+					logger.Warn(fmt.Sprintf("Skipping broken symlink %s: %v", path, err), "path", path, "error", err)
+					return nil
+				}
+				if info.IsDir() {
+					return walk(path)
+				}
+			}
+			if d.IsDir() {
+				real, err := filepath.EvalSymlinks(path)
+				if err != nil {
+					return err
+				}
+				if visited[real] {
+					return filepath.SkipDir
+				}
+				visited[real] = true
+				return nil
+			}
+			for _, pattern := range patterns {
+				if ok, _ := filepath.Match(pattern, d.Name()); ok {
+					files = append(files, path)
+					break
+				}
+			}
+			return nil
+		})
+	}
+	return files, walk(root)
+}
+
+// parseSince parses a -since value: an RFC3339 timestamp, a plain date
+// (midnight local time), or a duration counted back from now.
+func parseSince(v string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", v, time.Local); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(v); err == nil && d > 0 {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("want an RFC3339 time, a date, or a positive duration, got %q", v)
+}
+
+// quarantineFile moves path into dir for -on-parse-error quarantine, at its
+// path relative to dataDir (or by its name alone if outside it), replacing
+// any file already there. Across file systems it is copied and then
+// removed. It returns where the file now is.
+func quarantineFile(dir, dataDir, path string) (string, error) {
+	rel, err := filepath.Rel(dataDir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		rel = filepath.Base(path)
+	}
+	dest := filepath.Join(dir, rel)
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return "", err
+	}
+	if err := os.Rename(path, dest); err == nil {
+		return dest, nil
+	}
+	if err := copyFile(path, dest); err != nil {
+		return "", err
+	}
+	return dest, os.Remove(path)
+}
+
+// copyFile copies the contents of src to a new or truncated dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// filterModifiedSince returns the files whose modification time is after
+// since, and how many were left out.
+func filterModifiedSince(files []string, since time.Time) ([]string, int, error) {
+	var kept []string
+	for _, path := range files {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, 0, err
+		}
+		if info.ModTime().After(since) {
+			kept = append(kept, path)
+		}
+	}
+	return kept, len(files) - len(kept), nil
+}
+
+// checkpointFile lists the input files completed by -resume runs, one path
+// per line. Each path is synced to disk as it is added, so an interrupted
+// run leaves every file it finished in the list. add and Close do nothing
+// on a nil *checkpointFile.
+type checkpointFile struct {
+	mu   sync.Mutex
+	f    *os.File
+	done map[string]bool
+}
+
+// openCheckpoint reads the checkpoint at path, creating it if missing, and
+// opens it for adding to. A last line without a newline, as left by a
+// crash mid-write, is ignored.
+func openCheckpoint(path string) (*checkpointFile, error) {
+	c := &checkpointFile{done: make(map[string]bool)}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	lines := strings.Split(string(data), "\n")
+	for _, line := range lines[:len(lines)-1] {
+		if line != "" {
+			c.done[line] = true
+		}
+	}
+	c.f, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if n := len(data); n > 0 && data[n-1] != '\n' {
+		// Start a fresh line after the partial one
+		if _, err := c.f.WriteString("\n"); err != nil {
+			c.f.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// filter returns the files not yet completed, and how many were left out.
+func (c *checkpointFile) filter(files []string) ([]string, int) {
+	var kept []string
+	for _, path := range files {
+		if !c.done[path] {
+			kept = append(kept, path)
+		}
+	}
+	return kept, len(files) - len(kept)
+}
+
+// add records path as completed.
+func (c *checkpointFile) add(path string) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.f.WriteString(path + "\n"); err != nil {
+		return err
+	}
+	c.done[path] = true
+	return c.f.Sync()
+}
+
+func (c *checkpointFile) Close() error {
+	if c == nil {
+		return nil
+	}
+	return c.f.Close()
+}
+
+// processFile ingests every resource in filePath and returns the per-entry
+// outcome counts and the outcome of each resource. Records are sent as they
+// are read, so memory use does not grow with the size of the file. It
+// returns an error only when the file as a whole cannot be processed;
+// per-entry problems are logged, counted, and skipped. Records read before
+// such an error are still sent.
+func processFile(ctx context.Context, cfg *Config, state *runState, sink Sink, filePath string) (Summary, []ResourceOutcome, error) {
+	summary, err := processInput(ctx, cfg, state, sink, filePath)
+	outcomes := summary.Outcomes
+	summary.Outcomes = nil
+	return summary, outcomes, err
+}
+
+// processInput is processFile with the outcomes left in the Summary.
+func processInput(ctx context.Context, cfg *Config, state *runState, sink Sink, filePath string) (Summary, error) {
+	if cfg.Replay != "" {
+		return replayDeadLetters(ctx, cfg, state, sink, filePath)
+	}
+
+	// Each file goes through three stages connected by bounded channels: a
+	// goroutine reading -read-ahead chunks ahead, this one decoding and
+	// extracting records, and -workers-per-file senders taking up to
+	// -queue-size records ahead. A slow disk or pipeline then stalls only
+	// its own stage until the channel between them fills. Extraction is
+	// never split within a file; it runs in parallel only across the
+	// -concurrency files in flight. See PIPELINE_STAGES.md.
+	r, err := openFileInput(cfg, filePath)
+	if err != nil {
+		return newSummary(), err
+	}
+	if cfg.ReadAhead > 0 && !cfg.Stdin {
+		r = newReadAhead(r, cfg.ReadAhead)
+	}
+	defer r.Close()
+
+	// Records are extracted in order and handed to -workers-per-file
+	// senders, each counting into its own Summary until they are merged
+	summary := newSummary()
+	records := make(chan map[string]string, cfg.QueueSize)
+	senderSummaries := make([]Summary, max(cfg.WorkersPerFile, 1))
+	var senders sync.WaitGroup
+	for i := range senderSummaries {
+		senderSummaries[i] = newSummary()
+		out := newRecordSender(ctx, cfg, state, sink, &senderSummaries[i])
+		senders.Add(1)
+		go func() {
+			defer senders.Done()
+			for record := range records {
+				// Queued records are dropped once the run is stopping, as
+				// they would have been if emit had checked a moment later
+				if ctx.Err() != nil {
+					continue
+				}
+				out.send(record)
+			}
+			out.flush()
+		}()
+	}
+
+	sent := 0
+	emit := func(record map[string]string) error {
+		if ctx.Err() != nil {
+			return fmt.Errorf("%s: stopped after %d records: %w", filePath, sent, context.Cause(ctx))
+		}
+		sent++
+		if state.seenResources != nil && isDuplicate(state.seenResources, &summary, record) {
+			return nil
+		}
+		if state.ingestCache != nil && isUnchanged(state.ingestCache, &summary, record) {
+			return nil
+		}
+		records <- record
+		return nil
+	}
+
+	if isNDJSON(cfg, filePath) {
+		err = streamNDJSON(cfg, r, filePath, &summary, emit)
+	} else {
+		// With -flatten-bundle the resources' records are held back and
+		// sent as one per patient once the Bundle is read
+		var held []map[string]string
+		emitEntry := emit
+		if cfg.FlattenBundle {
+			emitEntry = func(record map[string]string) error {
+				held = append(held, record)
+				return nil
+			}
+		}
+		// Standard input can't be read twice
+		var reopen func() (io.ReadCloser, error)
+		if !cfg.Stdin {
+			reopen = func() (io.ReadCloser, error) {
+				r, err := openInput(filePath)
+				if err != nil || cfg.ReadAhead == 0 {
+					return r, err
+				}
+				return newReadAhead(r, cfg.ReadAhead), nil
+			}
+		}
+		decode := decodeBundleEntries
+		if isXML(cfg, filePath) {
+			decode = decodeXMLBundleEntries
+		}
+		err = streamEntries(cfg, decode, r, reopen, filePath, &summary, emitEntry)
+		if err == nil && cfg.FollowNext && !isXML(cfg, filePath) {
+			err = followNextPages(ctx, cfg, state.httpClient, filePath, &summary, emitEntry)
+		}
+		for _, record := range flattenRecords(cfg, held, filePath) {
+			if emitErr := emit(record); emitErr != nil {
+				if err == nil {
+					err = emitErr
+				}
+				break
+			}
+		}
+	}
+	close(records)
+	senders.Wait()
+	for _, s := range senderSummaries {
+		summary.Add(s)
+	}
+	if flushErr := sink.Flush(); flushErr != nil {
+		logger.Error(fmt.Sprintf("Error flushing records from %s: %v", filePath, flushErr), "file", filePath, "error", flushErr)
+	}
+	if finisher, ok := sink.(fileFinisher); ok {
+		if finishErr := finisher.finishFile(filePath); finishErr != nil {
+			logger.Error(fmt.Sprintf("Error closing records from %s: %v", filePath, finishErr), "file", filePath, "error", finishErr)
+		}
+	}
+	return summary, err
+}
+
+// flattenRecords combines the records of a Bundle's resources into one
+// record per patient for -flatten-bundle. Its content lists each resource's
+// content on its own line under a "## resourceType" heading, in the order
+// each type first appears. With -max-content-chars the content is split
+// between lines into several records, each repeating the heading it starts
+// under, with ids suffixed -1, -2, and so on.
+func flattenRecords(cfg *Config, records []map[string]string, filePath string) []map[string]string {
+	type section struct {
+		resourceType string
+		contents     []string
+	}
+	var patients []string
+	sections := make(map[string][]*section)
+	for _, record := range records {
+		patientID := record["patientId"]
+		if _, ok := sections[patientID]; !ok {
+			patients = append(patients, patientID)
+		}
+		var sec *section
+		for _, s := range sections[patientID] {
+			if s.resourceType == record["resourceType"] {
+				sec = s
+			}
+		}
+		if sec == nil {
+			sec = &section{resourceType: record["resourceType"]}
+			sections[patientID] = append(sections[patientID], sec)
+		}
+		sec.contents = append(sec.contents, record["content"])
+	}
+
+	var flattened []map[string]string
+	for _, patientID := range patients {
+		var chunks [][]string
+		var lines []string
+		size := 0 // of lines joined by newlines
+		add := func(line string) {
+			if len(lines) > 0 {
+				size++
+			}
+			lines = append(lines, line)
+			size += utf8.RuneCountInString(line)
+		}
+		for _, sec := range sections[patientID] {
+			heading := "## " + sec.resourceType
+			headed := false
+			for _, content := range sec.contents {
+				need := utf8.RuneCountInString(content) + 1
+				if !headed {
+					need += utf8.RuneCountInString(heading) + 1
+				}
+				if cfg.MaxContentChars > 0 && len(lines) > 0 && size+need > cfg.MaxContentChars {
+					chunks = append(chunks, lines)
+					lines, size, headed = nil, 0, false
+				}
+				if !headed {
+					add(heading)
+					headed = true
+				}
+				add(content)
+			}
+		}
+		chunks = append(chunks, lines)
+
+		id := patientID
+		if id == "" || id == "unknown" {
+			id = strings.TrimSuffix(filepath.Base(filePath), filepath.Ext(filePath))
+		}
+		for i, chunk := range chunks {
+			content := strings.Join(chunk, "\n")
+			if cfg.MaxContentChars > 0 {
+				// A single resource's line can still be too long with its heading
+				content, _ = truncateContent(content, cfg.MaxContentChars)
+			}
+			record := map[string]string{
+				"id":           id,
+				"resourceType": "Bundle",
+				"content":      content,
+				"patientId":    patientID,
+				"sourceFile":   filePath,
+			}
+			if len(chunks) > 1 {
+				record["id"] = fmt.Sprintf("%s-%d", id, i+1)
+			}
+			flattened = append(flattened, record)
+		}
+	}
+	return flattened
+}
+
+// stdinName stands in for the file name of standard input with -stdin; it is
+// recorded as the sourceFile of every record read from it.
+const stdinName = "stdin"
+
+// openFileInput opens filePath for processFile, or returns standard input
+// when -stdin is set.
+func openFileInput(cfg *Config, filePath string) (io.ReadCloser, error) {
+	if cfg.Stdin {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return openInput(filePath)
+}
+
+// bundleTypes are the valid values of Bundle.type in FHIR R4.
+var bundleTypes = map[string]bool{
+	"document": true, "message": true, "transaction": true, "transaction-response": true,
+	"batch": true, "batch-response": true, "history": true, "searchset": true, "collection": true,
+}
+
+// nonClinicalTypes are resource types that can appear as Bundle entries but
+// carry no clinical content: OperationOutcome reports server issues in
+// searchset and response Bundles. Bundles nested in a Bundle are descended
+// into by streamEntries; elsewhere, such as in NDJSON, they are skipped.
+var nonClinicalTypes = map[string]bool{
+	"OperationOutcome": true,
+	"Bundle":           true,
+}
+
+// followNextPages processes the pages of a search that filePath, a JSON
+// searchset Bundle, is the first page of: it fetches the page its
+// Bundle.link next points to, streams its entries as if they were in
+// filePath, and repeats with that page's next link. It stops after
+// -max-pages pages or at a page already fetched. Only pages on -fhir-server
+// are fetched, so the -fhir-token is not sent elsewhere.
+func followNextPages(ctx context.Context, cfg *Config, client *http.Client, filePath string, summary *Summary, emit func(map[string]string) error) error {
+	r, err := openInput(filePath)
+	if err != nil {
+		return err
+	}
+	next, err := bundleNextLink(r)
+	r.Close()
+	if err != nil {
+		return &ParseError{File: filePath, Format: "JSON", Err: err}
+	}
+
+	fetched := make(map[string]bool)
+	for pages := 0; next != ""; pages++ {
+		if pages >= cfg.MaxPages {
+			logger.Warn(fmt.Sprintf("  Stopped following next links after %d pages (-max-pages)", pages),
+				"file", filePath, "pages", pages)
+			return nil
+		}
+		pageURL, err := resolvePageURL(cfg.FHIRServer, next)
+		if err != nil {
+			return fmt.Errorf("%s: %w", filePath, err)
+		}
+		if fetched[pageURL] {
+			logger.Warn(fmt.Sprintf("  Stopped following next links: %s was already fetched", pageURL),
+				"file", filePath, "pageURL", pageURL)
+			return nil
+		}
+		fetched[pageURL] = true
+		if ctx.Err() != nil {
+			return fmt.Errorf("%s: stopped before page %d: %w", filePath, pages+2, context.Cause(ctx))
+		}
+
+		logger.Info(fmt.Sprintf("  Following next link to page %d: %s", pages+2, pageURL), "file", filePath, "pageURL", pageURL)
+		page, err := fetchPage(ctx, cfg, client, pageURL)
+		if err != nil {
+			return fmt.Errorf("%s: fetching %s: %w", filePath, pageURL, err)
+		}
+		reopen := func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(page)), nil }
+		if err := streamEntries(cfg, decodeBundleEntries, bytes.NewReader(page), reopen, filePath, summary, emit); err != nil {
+			return err
+		}
+		if next, err = bundleNextLink(bytes.NewReader(page)); err != nil {
+			return &ParseError{File: pageURL, Format: "JSON", Err: err}
+		}
+	}
+	return nil
+}
+
+// bundleNextLink returns the url of the Bundle.link with relation "next" in
+// the JSON Bundle read from r, or "" if there is none. Other elements are
+// skipped token by token, so a large Bundle is not held in memory.
+func bundleNextLink(r io.Reader) (string, error) {
+	dec := json.NewDecoder(r)
+	if tok, err := dec.Token(); err != nil {
+		return "", err
+	} else if tok != json.Delim('{') {
+		return "", errors.New("not a JSON object")
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return "", err
+		}
+		if tok != "link" {
+			if err := skipJSONValue(dec); err != nil {
+				return "", err
+			}
+			continue
+		}
+		var links []struct {
+			Relation string `json:"relation"`
+			URL      string `json:"url"`
+		}
+		if err := dec.Decode(&links); err != nil {
+			return "", err
+		}
+		for _, link := range links {
+			if link.Relation == "next" {
+				return link.URL, nil
+			}
+		}
+		return "", nil
+	}
+	return "", nil
+}
+
+// skipJSONValue reads past the next value from dec, however deeply nested.
+func skipJSONValue(dec *json.Decoder) error {
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+// resolvePageURL resolves a next link against the -fhir-server base URL
+// and returns an error unless the result is on that server, under its path.
+func resolvePageURL(server, link string) (string, error) {
+	base, err := url.Parse(strings.TrimSuffix(server, "/") + "/")
+	if err != nil {
+		return "", fmt.Errorf("invalid -fhir-server: %w", err)
+	}
+	ref, err := url.Parse(link)
+	if err != nil {
+		return "", fmt.Errorf("invalid next link %q: %w", link, err)
+	}
+	resolved := base.ResolveReference(ref)
+	if resolved.Scheme != base.Scheme || resolved.Host != base.Host || !strings.HasPrefix(resolved.Path+"/", base.Path) {
+		return "", fmt.Errorf("next link %q is not on -fhir-server %s", link, server)
+	}
+	return resolved.String(), nil
+}
+
+// fetchPage GETs one page of search results from the FHIR server, with
+// the -fhir-token if set. The request is bounded by cfg.RequestTimeout.
+func fetchPage(ctx context.Context, cfg *Config, client *http.Client, pageURL string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.RequestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/fhir+json")
+	if cfg.FHIRToken != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.FHIRToken)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return nil, fmt.Errorf("server returned status %d", resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// streamBundle decodes a FHIR JSON Bundle from r one entry at a time and
+// passes each record with extractable content to emit; an error from emit
+// stops the stream and is returned. Skipped entries are counted in summary.
+// sourceFile is recorded on each record and used in messages.
+//
+// References between entries are resolved through a resourceIndex of compact
+// copies. When reopen is non-nil the Bundle is read twice, first to build the
+// index and then to emit records, so references to later entries resolve;
+// otherwise (standard input) both happen in one pass and only references to
+// earlier entries do.
+func streamBundle(cfg *Config, r io.Reader, reopen func() (io.ReadCloser, error), sourceFile string, summary *Summary, emit func(map[string]string) error) error {
+	return streamEntries(cfg, decodeBundleEntries, r, reopen, sourceFile, summary, emit)
+}
+
+// bundleDecoder reads a Bundle from r, calling fn for each entry in order,
+// and returns Bundle.type and the number of entries.
+type bundleDecoder func(r io.Reader, sourceFile string, fn func(Entry) error) (string, int, error)
+
+// streamEntries is streamBundle for a Bundle in any format decode reads.
+func streamEntries(cfg *Config, decode bundleDecoder, r io.Reader, reopen func() (io.ReadCloser, error), sourceFile string, summary *Summary, emit func(map[string]string) error) error {
+	refs := make(resourceIndex)
+	// Entries without a Patient reference are attributed to the first
+	// Patient in the Bundle
+	fallback := patientContext{ID: "unknown"}
+	foundPatient := false
+	// A resourceType/id repeated in the Bundle is only emitted once, from
+	// the first or last entry per -duplicate-ids. Read in a single pass, as
+	// standard input is, the last is not known in time, so the first is kept.
+	keepFirst := cfg.DuplicateIDs == "first" || reopen == nil
+	idCounts := make(map[string]int) // entries per key, final after the first pass
+	idSeen := make(map[string]int)   // entries per key handled so far
+	var index func(entry Entry, depth int)
+	index = func(entry Entry, depth int) {
+		if key := entryKey(entry); key != "" {
+			idCounts[key]++
+			if idCounts[key] == 1 || !keepFirst {
+				refs.add(entry)
+			}
+		} else {
+			refs.add(entry)
+		}
+		resourceType, _ := entry.Resource["resourceType"].(string)
+		if resourceType == "Patient" && !foundPatient {
+			fallback = newPatientContext(entry.Resource, entry.FullURL)
+			foundPatient = true
+		}
+		if resourceType == "Bundle" && depth < maxBundleDepth {
+			for _, nested := range nestedEntries(entry.Resource) {
+				index(nested, depth+1)
+			}
+		}
+	}
+
+	// handle emits the record for entry or, for a nested Bundle, for each of
+	// its entries. Those fall back to the nested Bundle's own Patient, if it
+	// has one, rather than the outer Bundle's.
+	var handle func(entry Entry, label string, depth int, fallback patientContext) error
+	handle = func(entry Entry, label string, depth int, fallback patientContext) error {
+		key := entryKey(entry)
+		if key != "" {
+			idSeen[key]++
+		}
+		if resourceType, _ := entry.Resource["resourceType"].(string); resourceType == "Bundle" {
+			if depth >= maxBundleDepth {
+				logger.Warn(fmt.Sprintf("  %s: Skipping Bundle nested more than %d levels deep", label, maxBundleDepth),
+					"file", sourceFile, "entry", label)
+				summary.SkippedFiltered++
+				summary.typeCounts(resourceType).SkippedFiltered++
+				id, _ := entry.Resource["id"].(string)
+				summary.outcome(sourceFile, resourceType, id, "skipped", "filtered", nil)
+				return nil
+			}
+			entries := nestedEntries(entry.Resource)
+			for _, nested := range entries {
+				if nestedType, _ := nested.Resource["resourceType"].(string); nestedType == "Patient" {
+					fallback = newPatientContext(nested.Resource, nested.FullURL)
+					break
+				}
+			}
+			for j, nested := range entries {
+				if err := handle(nested, fmt.Sprintf("%s.%d", label, j), depth+1, fallback); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if key != "" && idCounts[key] > 1 {
+			kept, keep := "last", idSeen[key] == idCounts[key]
+			if keepFirst {
+				kept, keep = "first", idSeen[key] == 1
+			}
+			if !keep {
+				logger.Warn(fmt.Sprintf("  %s (%s): Skipping - id repeated in the Bundle (keeping the %s)", label, key, kept),
+					"file", sourceFile, "entry", label, "resource", key)
+				summary.DuplicateIDs++
+				resourceType, id, _ := strings.Cut(key, "/")
+				summary.outcome(sourceFile, resourceType, id, "skipped", "duplicate-id", nil)
+				return nil
+			}
+		}
+		patient := entryPatient(entry, refs, fallback)
+		if record, ok := buildRecord(cfg, summary, entry.Resource, entry.FullURL, patient, refs, sourceFile, label); ok {
+			// The entry's index, with those of any enclosing Bundles: "3.1"
+			record["sourceEntry"] = strings.TrimPrefix(label, "Entry ")
+			return emit(record)
+		}
+		return nil
+	}
+	logEntries := func(bundleType string, entries int) {
+		if !bundleTypes[bundleType] {
+			logger.Warn(fmt.Sprintf("  Unrecognized Bundle.type %q in %s", bundleType, sourceFile), "file", sourceFile, "bundleType", bundleType)
+		}
+		logger.Info(fmt.Sprintf("  Found %d entries (Bundle.type: %s)", entries, bundleType),
+			"file", sourceFile, "entries", entries, "bundleType", bundleType)
+	}
+
+	if reopen != nil {
+		bundleType, entries, err := decode(r, sourceFile, func(entry Entry) error {
+			index(entry, 0)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		logEntries(bundleType, entries)
+
+		rc, err := reopen()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		r = rc
+	}
+
+	i := 0
+	bundleType, entries, err := decode(r, sourceFile, func(entry Entry) error {
+		if reopen == nil {
+			index(entry, 0)
+		}
+		label := fmt.Sprintf("Entry %d", i)
+		i++
+		return handle(entry, label, 0, fallback)
+	})
+	if err != nil {
+		return err
+	}
+	if reopen == nil {
+		logEntries(bundleType, entries)
+	}
+	return nil
+}
+
+// entryKey returns the resourceType/id of entry's resource, or "" if either
+// is missing.
+func entryKey(entry Entry) string {
+	resourceType, _ := entry.Resource["resourceType"].(string)
+	id, _ := entry.Resource["id"].(string)
+	if resourceType == "" || id == "" {
+		return ""
+	}
+	return resourceType + "/" + id
+}
+
+// maxBundleDepth bounds how many levels of Bundles nested in Bundle entries
+// (as $everything results in a searchset can be) are descended into.
+const maxBundleDepth = 3
+
+// nestedEntries returns the entries of a Bundle resource held in an entry.
+func nestedEntries(bundle map[string]interface{}) []Entry {
+	list, _ := bundle["entry"].([]interface{})
+	entries := make([]Entry, 0, len(list))
+	for _, e := range list {
+		obj, ok := e.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		var entry Entry
+		entry.FullURL, _ = obj["fullUrl"].(string)
+		entry.Resource, _ = obj["resource"].(map[string]interface{})
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// decodeBundleEntries reads a Bundle from r as a token stream, calling fn for
+// each entry as soon as it is decoded, so only one entry is in memory at a
+// time. It returns Bundle.type and the number of entries. Errors from fn are
+// returned as is; read failures are reported with readError and anything
+// else as a parse error.
+func decodeBundleEntries(r io.Reader, sourceFile string, fn func(Entry) error) (string, int, error) {
+	tr := &trackingReader{r: r}
+	dec := json.NewDecoder(tr)
+	parseError := func(err error) error {
+		if tr.err != nil && tr.err != io.EOF {
+			return readError(sourceFile, tr.err)
+		}
+		return &ParseError{File: sourceFile, Format: "JSON", Err: err}
+	}
+	notBundle := fmt.Errorf("%s: %w", sourceFile, ErrNotBundle)
+
+	tok, err := dec.Token()
+	if err != nil {
+		return "", 0, parseError(err)
+	}
+	if tok != json.Delim('{') {
+		return "", 0, notBundle
+	}
+
+	var resourceType, bundleType string
+	entries := 0
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return "", entries, parseError(err)
+		}
+		switch tok {
+		case "resourceType":
+			if err := dec.Decode(&resourceType); err != nil {
+				return "", entries, parseError(err)
+			}
+			if resourceType != "Bundle" {
+				return "", entries, notBundle
+			}
+		case "type":
+			if err := dec.Decode(&bundleType); err != nil {
+				return "", entries, parseError(err)
+			}
+		case "entry":
+			tok, err := dec.Token()
+			if err != nil {
+				return "", entries, parseError(err)
+			}
+			if tok == nil {
+				continue // "entry": null
+			}
+			if tok != json.Delim('[') {
+				return "", entries, parseError(fmt.Errorf("entry is not an array"))
+			}
+			for dec.More() {
+				var entry Entry
+				if err := dec.Decode(&entry); err != nil {
+					return "", entries, parseError(err)
+				}
+				entries++
+				if err := fn(entry); err != nil {
+					return "", entries, err
+				}
+			}
+			if _, err := dec.Token(); err != nil {
+				return "", entries, parseError(err)
+			}
+		default:
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return "", entries, parseError(err)
+			}
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return "", entries, parseError(err)
+	}
+	// Read to the end so trailing data and decompression errors (a gzip
+	// checksum comes after the content) are still reported
+	if _, err := dec.Token(); err != io.EOF {
+		if err == nil {
+			err = errors.New("unexpected data after Bundle")
+		}
+		return "", entries, parseError(err)
+	}
+	// resourceType normally comes first, but JSON doesn't require it
+	if resourceType != "Bundle" {
+		return "", entries, notBundle
+	}
+	return bundleType, entries, nil
+}
+
+// decodeXMLBundleEntries is decodeBundleEntries for a FHIR XML Bundle. Each
+// entry is decoded on its own and converted with xmlResource, so only one
+// entry is in memory at a time.
+func decodeXMLBundleEntries(r io.Reader, sourceFile string, fn func(Entry) error) (string, int, error) {
+	tr := &trackingReader{r: r}
+	dec := xml.NewDecoder(tr)
+	parseError := func(err error) error {
+		if tr.err != nil && tr.err != io.EOF {
+			return readError(sourceFile, tr.err)
+		}
+		return &ParseError{File: sourceFile, Format: "XML", Err: err}
+	}
+
+	var root xml.StartElement
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return "", 0, parseError(err)
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			root = start
+			break
+		}
+	}
+	if root.Name.Local != "Bundle" {
+		return "", 0, fmt.Errorf("%s: %w", sourceFile, ErrNotBundle)
+	}
+
+	var bundleType string
+	entries := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return "", entries, parseError(err)
+		}
+		if _, ok := tok.(xml.EndElement); ok {
+			break // </Bundle>
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "type":
+			bundleType = xmlAttr(start.Attr, "value")
+			if err := dec.Skip(); err != nil {
+				return "", entries, parseError(err)
+			}
+		case "entry":
+			var node xmlNode
+			if err := dec.DecodeElement(&node, &start); err != nil {
+				return "", entries, parseError(err)
+			}
+			var entry Entry
+			for _, child := range node.Nodes {
+				switch child.XMLName.Local {
+				case "fullUrl":
+					entry.FullURL = xmlAttr(child.Attrs, "value")
+				case "resource":
+					if len(child.Nodes) > 0 {
+						entry.Resource = xmlResource(child.Nodes[0])
+					}
+				}
+			}
+			entries++
+			if err := fn(entry); err != nil {
+				return "", entries, err
+			}
+		default:
+			if err := dec.Skip(); err != nil {
+				return "", entries, parseError(err)
+			}
+		}
+	}
+	// Read to the end so decompression errors are still reported
+	for {
+		if _, err := dec.Token(); err == io.EOF {
+			break
+		} else if err != nil {
+			return "", entries, parseError(err)
+		}
+	}
+	return bundleType, entries, nil
+}
+
+// xmlNode is a generic FHIR XML element. Inner keeps the raw content, which
+// is only used for XHTML narrative.
+type xmlNode struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Nodes   []xmlNode  `xml:",any"`
+	Inner   []byte     `xml:",innerxml"`
+}
+
+// xmlRepeating are the elements that are arrays in FHIR JSON, by name or by
+// path where the same name is a single value elsewhere. XML has no array
+// marker, so without these an element that happens to occur once would not
+// become a one-element array. Elements that occur more than once always do.
+var xmlRepeating = map[string]bool{
+	"category": true, "coding": true, "component": true,
+	"conclusionCode": true, "contained": true, "content": true, "diagnosis": true,
+	"dosage": true, "dosageInstruction": true, "extension": true, "given": true,
+	"identifier": true, "interpretation": true, "item": true, "line": true,
+	"manifestation": true, "modifierExtension": true, "note": true,
+	"participant": true, "payor": true, "performer": true, "prefix": true,
+	"reaction": true, "reasonCode": true, "reasonReference": true, "referenceRange": true,
+	"result": true, "suffix": true, "target": true, "telecom": true,
+	// Single in some resources: Organization.name is a string,
+	// Location.address one Address, and Provenance.activity one concept
+	"Patient.name": true, "Practitioner.name": true, "RelatedPerson.name": true, "Person.name": true,
+	"Patient.address": true, "Practitioner.address": true, "RelatedPerson.address": true,
+	"Person.address": true, "Organization.address": true,
+	"CarePlan.activity": true, "Encounter.type": true,
+}
+
+// xmlResource converts a FHIR XML resource element, such as the <Patient>
+// inside an entry's <resource>, to the map shape FHIR JSON decodes to.
+func xmlResource(n xmlNode) map[string]interface{} {
+	resource := xmlObject(n, n.XMLName.Local)
+	resource["resourceType"] = n.XMLName.Local
+	return resource
+}
+
+// xmlObject converts the children of a complex element at path (such as
+// "Observation.valueQuantity") to a JSON object. Primitives are read from
+// their value attribute and other attributes, such as an extension's url,
+// become string properties.
+func xmlObject(n xmlNode, path string) map[string]interface{} {
+	obj := make(map[string]interface{})
+	for _, attr := range n.Attrs {
+		if attr.Name.Local == "value" || attr.Name.Local == "xmlns" || attr.Name.Space == "xmlns" {
+			continue
+		}
+		obj[attr.Name.Local] = attr.Value
+	}
+	for _, child := range n.Nodes {
+		name := child.XMLName.Local
+		value := xmlValue(child, path+"."+name)
+		switch existing := obj[name].(type) {
+		case []interface{}:
+			obj[name] = append(existing, value)
+		case nil:
+			if xmlRepeating[name] || xmlRepeating[path+"."+name] {
+				obj[name] = []interface{}{value}
+			} else {
+				obj[name] = value
+			}
+		default:
+			obj[name] = []interface{}{existing, value}
+		}
+	}
+	return obj
+}
+
+// xmlValue converts one element at path: a nested resource, XHTML narrative,
+// a primitive, or a complex element.
+func xmlValue(n xmlNode, path string) interface{} {
+	name := n.XMLName.Local
+	switch {
+	case (name == "resource" || name == "contained") && len(n.Nodes) == 1:
+		return xmlResource(n.Nodes[0])
+	case name == "div":
+		return "<div>" + string(n.Inner) + "</div>"
+	}
+	for _, attr := range n.Attrs {
+		if attr.Name.Local == "value" {
+			// Extensions on a primitive (its child elements) are dropped
+			return xmlPrimitive(name, attr.Value)
+		}
+	}
+	return xmlObject(n, path)
+}
+
+// xmlPrimitive types an XML value attribute the way FHIR JSON would. The
+// schema isn't available, so numbers are recognised by element name
+// (Quantity.value, sequence, and the [x] Integer and Decimal variants) and
+// booleans by the Boolean suffix and active.
+func xmlPrimitive(name, value string) interface{} {
+	switch {
+	case name == "value" || name == "sequence" || strings.HasSuffix(name, "Integer") || strings.HasSuffix(name, "Decimal"):
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f
+		}
+	case name == "active" || strings.HasSuffix(name, "Boolean"):
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	}
+	return value
+}
+
+// xmlAttr returns the value of the attribute named local, or "".
+func xmlAttr(attrs []xml.Attr, local string) string {
+	for _, attr := range attrs {
+		if attr.Name.Local == local {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// trackingReader remembers the last error from r, so a decoder failure can be
+// told apart from the read failure that caused it.
+type trackingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (t *trackingReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if err != nil {
+		t.err = err
+	}
+	return n, err
+}
+
+// isNDJSON reports whether filePath should be read as newline-delimited FHIR
+// rather than as a Bundle.
+func isNDJSON(cfg *Config, filePath string) bool {
+	switch cfg.Format {
+	case "ndjson":
+		return true
+	case "bundle", "xml":
+		return false
+	}
+	return strings.HasSuffix(strings.TrimSuffix(filePath, ".gz"), ".ndjson")
+}
+
+// isXML reports whether filePath should be read as a FHIR XML Bundle.
+func isXML(cfg *Config, filePath string) bool {
+	switch cfg.Format {
+	case "xml":
+		return true
+	case "bundle", "ndjson":
+		return false
+	}
+	return strings.HasSuffix(strings.TrimSuffix(filePath, ".gz"), ".xml")
+}
+
+// ErrNotBundle is returned, wrapped with the file name, when Bundle input
+// holds some other resource.
+var ErrNotBundle = errors.New("not a Bundle resource")
+
+// ParseError reports input that could not be decoded. Line is set for
+// NDJSON input.
+type ParseError struct {
+	File   string
+	Format string // JSON or XML
+	Line   int
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("error parsing %s in %s line %d: %v", e.Format, e.File, e.Line, e.Err)
+	}
+	return fmt.Sprintf("error parsing %s in %s: %v", e.Format, e.File, e.Err)
+}
+
+func (e *ParseError) Unwrap() error { return e.Err }
+
+// errDecompress marks read failures caused by a corrupt gzip stream, as
+// opposed to I/O errors or malformed JSON.
+var errDecompress = errors.New("gzip decompression failed")
+
+// openInput opens filePath for reading, transparently decompressing it when
+// the name ends in .gz.
+func openInput(filePath string) (io.ReadCloser, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading file %s: %w", filePath, err)
+	}
+	if !strings.HasSuffix(filePath, ".gz") {
+		return f, nil
+	}
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error decompressing %s: %w: %v", filePath, errDecompress, err)
+	}
+	return &gzipFile{zr: zr, f: f}, nil
+}
+
+// readAheadChunk is the size of the chunks a readAhead reads at a time.
+const readAheadChunk = 256 << 10
+
+// readAhead reads its source in a goroutine of its own, up to a fixed number
+// of chunks ahead of its caller, so that waiting on the disk (or gunzipping)
+// overlaps with decoding what was already read. Standard input is not read
+// this way, since a read blocked on it could keep Close waiting forever.
+type readAhead struct {
+	src    io.ReadCloser
+	chunks chan readAheadResult
+	done   chan struct{} // closed by Close to stop reading
+	cur    []byte
+	err    error
+}
+
+// readAheadResult is a chunk of data or the error that ended the source.
+type readAheadResult struct {
+	data []byte
+	err  error
+}
+
+func newReadAhead(src io.ReadCloser, chunks int) *readAhead {
+	r := &readAhead{src: src, chunks: make(chan readAheadResult, chunks), done: make(chan struct{})}
+	go r.fill()
+	return r
+}
+
+func (r *readAhead) fill() {
+	defer close(r.chunks)
+	for {
+		buf := make([]byte, readAheadChunk)
+		n, err := io.ReadFull(r.src, buf)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		result := readAheadResult{data: buf[:n], err: err}
+		select {
+		case r.chunks <- result:
+		case <-r.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (r *readAhead) Read(p []byte) (int, error) {
+	for len(r.cur) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		result, ok := <-r.chunks
+		if !ok {
+			return 0, io.EOF
+		}
+		r.cur, r.err = result.data, result.err
+	}
+	n := copy(p, r.cur)
+	r.cur = r.cur[n:]
+	return n, nil
+}
+
+// Close stops reading ahead and closes the source once the reading
+// goroutine has finished with it.
+func (r *readAhead) Close() error {
+	close(r.done)
+	for range r.chunks {
+	}
+	return r.src.Close()
+}
+
+// gzipFile reads a decompressed stream and closes both it and the underlying
+// file. Read errors other than EOF are tagged with errDecompress.
+type gzipFile struct {
+	zr *gzip.Reader
+	f  *os.File
+}
+
+func (g *gzipFile) Read(p []byte) (int, error) {
+	n, err := g.zr.Read(p)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("%w: %v", errDecompress, err)
+	}
+	return n, err
+}
+
+func (g *gzipFile) Close() error {
+	zerr := g.zr.Close()
+	if err := g.f.Close(); err != nil {
+		return err
+	}
+	return zerr
+}
+
+// readError describes a failure reading filePath, distinguishing corrupt
+// compressed input from other I/O errors.
+func readError(filePath string, err error) error {
+	if errors.Is(err, errDecompress) {
+		return fmt.Errorf("error decompressing %s: %w", filePath, err)
+	}
+	return fmt.Errorf("error reading file %s: %w", filePath, err)
+}
+
+// streamNDJSON reads bulk-export style input with one resource per line and
+// passes each record with extractable content to emit as it is read; an
+// error from emit stops the stream and is returned. There is no enclosing
+// Bundle, so each resource's patient is derived from its own subject/patient
+// reference.
+func streamNDJSON(cfg *Config, r io.Reader, sourceFile string, summary *Summary, emit func(map[string]string) error) error {
+	scanner := bufio.NewScanner(r)
+	// Single resources (especially with narrative) can exceed the default 64KB line limit
+	scanner.Buffer(make([]byte, 0, 1024*1024), maxNDJSONLineBytes)
+
+	lines := 0
+	for scanner.Scan() {
+		lines++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var resource map[string]interface{}
+		if err := json.Unmarshal(line, &resource); err != nil {
+			parseErr := &ParseError{File: sourceFile, Format: "JSON", Line: lines, Err: err}
+			logger.Warn(fmt.Sprintf("  Line %d: Error parsing JSON: %v", lines, err), "file", sourceFile, "line", lines,
+				"error", parseErr)
+			summary.MalformedRecords++
+			summary.outcome(sourceFile, "", "", "skipped", "malformed", parseErr)
+			continue
+		}
+
+		if record, ok := buildRecord(cfg, summary, resource, "", patientContext{ID: resourcePatientID(resource)}, nil, sourceFile, fmt.Sprintf("Line %d", lines)); ok {
+			record["sourceLine"] = strconv.Itoa(lines)
+			if err := emit(record); err != nil {
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("line %d: %w", lines+1, readError(sourceFile, err))
+	}
+
+	logger.Info(fmt.Sprintf("  Read %d lines", lines), "file", sourceFile, "lines", lines)
+	return nil
+}
+
+// resourcePatientID derives the patient ID for a standalone resource: a
+// Patient's own id, otherwise the target of its subject or patient reference.
+func resourcePatientID(resource map[string]interface{}) string {
+	if resourceType, _ := resource["resourceType"].(string); resourceType == "Patient" {
+		if id, ok := resource["id"].(string); ok && id != "" {
+			return id
+		}
+	}
+	for _, field := range []string{"subject", "patient"} {
+		if ref, ok := resource[field].(map[string]interface{}); ok {
+			if reference, ok := ref["reference"].(string); ok && reference != "" {
+				return strings.TrimPrefix(reference, "Patient/")
+			}
+		}
+	}
+	return "unknown"
+}
+
+// typeAllowed applies the resourceType filters. A non-empty include list wins;
+// otherwise the exclude list is applied.
+func typeAllowed(cfg *Config, resourceType string) bool {
+	if len(cfg.IncludeTypes) > 0 {
+		return cfg.IncludeTypes[resourceType]
+	}
+	return !cfg.ExcludeTypes[resourceType]
+}
+
+// listElements are the elements that are lists wherever FHIR defines them,
+// in STU3 and R4 alike, so -validate can reject a single object or value in
+// their place.
+var listElements = []string{"identifier", "extension", "modifierExtension", "contained", "note", "telecom"}
+
+// validateResource checks the basic shape of a resource for -validate and
+// returns a description of each problem found: resourceType and id must be
+// non-empty strings, meta, text, and code objects, coding a list wherever
+// it appears in code, and listElements lists. It is not a full FHIR
+// validation; it catches exports whose values are the wrong JSON type.
+func validateResource(resource map[string]interface{}) []string {
+	var problems []string
+	for _, field := range []string{"resourceType", "id"} {
+		switch v, ok := resource[field]; {
+		case !ok:
+			problems = append(problems, field+" is missing")
+		case v == "":
+			problems = append(problems, field+" is empty")
+		default:
+			if _, ok := v.(string); !ok {
+				problems = append(problems, fmt.Sprintf("%s is %s, want string", field, jsonTypeName(v)))
+			}
+		}
+	}
+	for _, field := range []string{"meta", "text", "code"} {
+		if v, ok := resource[field]; ok {
+			if _, ok := v.(map[string]interface{}); !ok {
+				problems = append(problems, fmt.Sprintf("%s is %s, want object", field, jsonTypeName(v)))
+			}
+		}
+	}
+	if code, ok := resource["code"].(map[string]interface{}); ok {
+		if v, ok := code["coding"]; ok {
+			if _, ok := v.([]interface{}); !ok {
+				problems = append(problems, fmt.Sprintf("code.coding is %s, want array", jsonTypeName(v)))
+			}
+		}
+	}
+	for _, field := range listElements {
+		if v, ok := resource[field]; ok {
+			if _, ok := v.([]interface{}); !ok {
+				problems = append(problems, fmt.Sprintf("%s is %s, want array", field, jsonTypeName(v)))
+			}
+		}
+	}
+	return problems
+}
+
+// jsonTypeName names the JSON type of a decoded value, for messages.
+func jsonTypeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case float64, json.Number:
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// buildRecord extracts content from a single resource into a flat record for
+// the pipeline. It returns false, after counting the reason in summary, when
+// the resource has no resourceType, is filtered out by -include-types or
+// -exclude-types, fails -validate, or has no extractable content (or only a
+// heading, with -strip-empty-sections). refs resolves references to
+// other resources in the same Bundle and may be nil. label identifies the
+// resource's position in the source file for log messages.
+func buildRecord(cfg *Config, summary *Summary, resource map[string]interface{}, fullURL string, patient patientContext, refs resourceIndex, filePath, label string) (map[string]string, bool) {
+	resourceType, ok := resource["resourceType"].(string)
+	if !ok {
+		logger.Warn(fmt.Sprintf("  %s: Missing resourceType", label), "file", filePath, "entry", label)
+		summary.MissingResourceType++
+		id, _ := resource["id"].(string)
+		summary.outcome(filePath, "", id, "skipped", "missing-resourceType", nil)
+		return nil, false
+	}
+
+	id, _ := resource["id"].(string)
+	if id == "" {
+		// Some resources might not have an id, use fullUrl as fallback
+		id = fullURL
+	}
+
+	if nonClinicalTypes[resourceType] {
+		logger.Info(fmt.Sprintf("  %s (%s): Skipping - not a clinical resource", label, resourceType),
+			"file", filePath, "entry", label, "resourceType", resourceType)
+		summary.SkippedFiltered++
+		summary.typeCounts(resourceType).SkippedFiltered++
+		summary.outcome(filePath, resourceType, id, "skipped", "not-clinical", nil)
+		return nil, false
+	}
+
+	if !typeAllowed(cfg, resourceType) {
+		logger.Debug(fmt.Sprintf("  %s (%s): Skipping - filtered by resource type", label, resourceType),
+			"file", filePath, "entry", label, "resourceType", resourceType)
+		summary.SkippedFiltered++
+		summary.typeCounts(resourceType).SkippedFiltered++
+		summary.outcome(filePath, resourceType, id, "skipped", "filtered", nil)
+		return nil, false
+	}
+
+	if cfg.Validate {
+		if problems := validateResource(resource); len(problems) > 0 {
+			err := errors.New(strings.Join(problems, "; "))
+			logger.Warn(fmt.Sprintf("  %s (%s): Skipping - invalid: %v", label, resourceType, err),
+				"file", filePath, "entry", label, "resourceType", resourceType, "error", err)
+			summary.Invalid++
+			summary.typeCounts(resourceType).Invalid++
+			summary.outcome(filePath, resourceType, id, "skipped", "invalid", err)
+			return nil, false
+		}
+	}
+
+	// Extract meaningful content from the resource
+	parts := contentParts(cfg, resource, resourceType, refs)
+	if cfg.StripEmptySections && headingOnly(parts) {
+		logger.Warn(fmt.Sprintf("  %s (%s): Skipping - nothing extracted but the heading %q", label, resourceType, parts[0]),
+			"file", filePath, "entry", label, "resourceType", resourceType)
+		summary.SkippedHeadingOnly++
+		summary.typeCounts(resourceType).SkippedHeadingOnly++
+		summary.outcome(filePath, resourceType, id, "skipped", "heading-only", nil)
+		return nil, false
+	}
+	if tmpl, ok := cfg.PrefixTemplates[resourceType]; ok && len(parts) > 0 {
+		data := map[string]interface{}{
+			"resourceType": resourceType,
+			"id":           id,
+			"fullUrl":      fullURL,
+			"patientId":    patient.ID,
+			"sourceFile":   filePath,
+			"resource":     resource,
+		}
+		if prefixed, err := applyPrefixTemplate(tmpl, parts, data); err != nil {
+			logger.Warn(fmt.Sprintf("  %s (%s): Keeping the built-in heading - -prefix-template failed: %v", label, resourceType, err),
+				"file", filePath, "entry", label, "resourceType", resourceType, "error", err)
+		} else {
+			parts = prefixed
+		}
+	}
+	content := strings.Join(parts, " ")
+	separator := " "
+	if cfg.Pretty {
+		content = prettyContent(parts)
+		separator = "\n"
+	}
+	var redactions *regexp.Regexp
+	if cfg.Redact {
+		redactions = redactionPattern(resource, resourceType, patient)
+		content = redact(content, redactions)
+	}
+
+	// Skip if content is empty
+	if content == "" {
+		logger.Warn(fmt.Sprintf("  %s (%s): Skipping - no extractable content", label, resourceType),
+			"file", filePath, "entry", label, "resourceType", resourceType)
+		summary.SkippedEmpty++
+		summary.typeCounts(resourceType).SkippedEmpty++
+		summary.outcome(filePath, resourceType, id, "skipped", "empty", nil)
+		return nil, false
+	}
+	// Measured before patient context is added, which every record shares
+	if chars := len([]rune(content)); chars < cfg.MinContentChars {
+		logger.Info(fmt.Sprintf("  %s (%s): Skipping - %d chars of content is under -min-content-chars", label, resourceType, chars),
+			"file", filePath, "entry", label, "resourceType", resourceType, "contentChars", chars, "minContentChars", cfg.MinContentChars)
+		summary.SkippedTooShort++
+		summary.typeCounts(resourceType).SkippedTooShort++
+		summary.outcome(filePath, resourceType, id, "skipped", "too-short", nil)
+		return nil, false
+	}
+
+	if cfg.EmbedPatientContext && resourceType != "Patient" {
+		if demographics := patient.describe(resourceDate(resource)); demographics != "" {
+			content = demographics + separator + content
+		}
+	}
+
+	if cfg.MaxContentChars > 0 {
+		if truncated, ok := truncateContent(content, cfg.MaxContentChars); ok {
+			logger.Info(fmt.Sprintf("  %s (%s): Truncated content from %d to %d chars", label, resourceType, len([]rune(content)), len([]rune(truncated))),
+				"file", filePath, "entry", label, "resourceType", resourceType, "contentChars", len([]rune(content)), "maxContentChars", cfg.MaxContentChars)
+			content = truncated
+		}
+	}
+
+	// Serialize the original resource JSON
+	resourceJSONBytes, err := json.Marshal(redactValue(resource, redactions))
+	resourceJSON := ""
+	if err == nil {
+		resourceJSON = string(resourceJSONBytes)
+	} else {
+		logger.Warn(fmt.Sprintf("  %s (%s): Warning - could not serialize resource JSON: %v", label, resourceType, err),
+			"file", filePath, "entry", label, "resourceType", resourceType, "error", err)
+	}
+
+	logger.Debug(fmt.Sprintf("  %s (%s): Extracted %d chars of content", label, resourceType, len(content)),
+		"file", filePath, "entry", label, "resourceType", resourceType, "contentChars", len(content))
+
+	flatData := map[string]string{
+		"id":           id,
+		"fullUrl":      fullURL,
+		"resourceType": resourceType,
+		"content":      content,
+		"patientId":    patient.ID,   // Add patient ID to all resources
+		"resourceJson": resourceJSON, // Add original JSON for RecursiveJsonSplitter
+		"sourceFile":   filePath,     // Add source file path
+	}
+	if cfg.IncludeMeta {
+		addMetaFields(flatData, resource["meta"])
+	}
+
+	return flatData, true
+}
+
+// addMetaFields copies a resource's meta.lastUpdated, meta.versionId, and
+// meta.profile list (joined with commas) into record, for -include-meta.
+// Fields missing from meta are left out of record.
+func addMetaFields(record map[string]string, v interface{}) {
+	meta, ok := v.(map[string]interface{})
+	if !ok {
+		return
+	}
+	if lastUpdated, ok := meta["lastUpdated"].(string); ok && lastUpdated != "" {
+		record["lastUpdated"] = lastUpdated
+	}
+	if versionID, ok := meta["versionId"].(string); ok && versionID != "" {
+		record["versionId"] = versionID
+	}
+	var profiles []string
+	list, _ := meta["profile"].([]interface{})
+	for _, p := range list {
+		if profile, ok := p.(string); ok && profile != "" {
+			profiles = append(profiles, profile)
+		}
+	}
+	if len(profiles) > 0 {
+		record["profile"] = strings.Join(profiles, ",")
+	}
+}
+
+// redactPlaceholder stands in for each name and identifier removed by -redact.
+const redactPlaceholder = "[REDACTED]"
+
+// redactionPattern matches what -redact removes from a record: the names and
+// identifier values of its patient and, for a Patient or a resource with its
+// own identifiers, of the resource itself. Names match as whole words in any
+// case, longest first so a full name is replaced as one. It returns nil when
+// there is nothing to remove.
+func redactionPattern(resource map[string]interface{}, resourceType string, patient patientContext) *regexp.Regexp {
+	terms := append(append([]string{}, patient.Names...), patient.Identifiers...)
+	if resourceType == "Patient" {
+		terms = append(terms, nameTerms(resource["name"])...)
+	}
+	terms = append(terms, identifierValues(resource["identifier"])...)
+	if len(terms) == 0 {
+		return nil
+	}
+	sort.Slice(terms, func(i, j int) bool { return len(terms[i]) > len(terms[j]) })
+
+	alternatives := make([]string, 0, len(terms))
+	for _, term := range terms {
+		pattern := regexp.QuoteMeta(term)
+		if isWordByte(term[0]) {
+			pattern = `\b` + pattern
+		}
+		if isWordByte(term[len(term)-1]) {
+			pattern += `\b`
+		}
+		alternatives = append(alternatives, pattern)
+	}
+	return regexp.MustCompile("(?i)" + strings.Join(alternatives, "|"))
+}
+
+func isWordByte(b byte) bool {
+	return b == '_' || b >= '0' && b <= '9' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z'
+}
+
+// redact replaces every match of pattern in text with redactPlaceholder. A
+// nil pattern leaves text as it is.
+func redact(text string, pattern *regexp.Regexp) string {
+	if pattern == nil {
+		return text
+	}
+	return pattern.ReplaceAllLiteralString(text, redactPlaceholder)
+}
+
+// redactValue returns a copy of a decoded JSON value with redact applied to
+// every string in it, or v itself when pattern is nil.
+func redactValue(v interface{}, pattern *regexp.Regexp) interface{} {
+	if pattern == nil {
+		return v
+	}
+	switch v := v.(type) {
+	case string:
+		return redact(v, pattern)
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			redacted[key] = redactValue(value, pattern)
+		}
+		return redacted
+	case []interface{}:
+		redacted := make([]interface{}, len(v))
+		for i, value := range v {
+			redacted[i] = redactValue(value, pattern)
+		}
+		return redacted
+	}
+	return v
+}
+
+// nameTerms lists the names in a HumanName list for -redact: each name's
+// text, its full form with and without middle names, and its given and
+// family parts of two or more letters.
+func nameTerms(v interface{}) []string {
+	list, _ := v.([]interface{})
+	var terms []string
+	add := func(term string) {
+		if term = strings.TrimSpace(term); len([]rune(term)) >= 2 {
+			terms = append(terms, term)
+		}
+	}
+	for _, n := range list {
+		name, ok := n.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		text, _ := name["text"].(string)
+		add(text)
+		add(humanName([]interface{}{map[string]interface{}{"given": name["given"], "family": name["family"]}}))
+		family, _ := name["family"].(string)
+		add(family)
+		if given, ok := name["given"].([]interface{}); ok {
+			for i, g := range given {
+				part, _ := g.(string)
+				add(part)
+				if i == 0 && len(given) > 1 && family != "" {
+					add(part + " " + family)
+				}
+			}
+		}
+	}
+	return terms
+}
+
+// identifierValues lists the values of an identifier[] list.
+func identifierValues(v interface{}) []string {
+	list, _ := v.([]interface{})
+	var values []string
+	for _, i := range list {
+		identifier, ok := i.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if value, ok := identifier["value"].(string); ok && strings.TrimSpace(value) != "" {
+			values = append(values, strings.TrimSpace(value))
+		}
+	}
+	return values
+}
+
+// tokenEstimator estimates the number of tokens an embedding model counts in
+// content, for budgeting.
+type tokenEstimator func(content string) int
+
+// heuristicTokens estimates one token per four characters, and no fewer than
+// one per word, which is the usual rule of thumb for English text.
+func heuristicTokens(content string) int {
+	return max(len(strings.Fields(content)), (utf8.RuneCountInString(content)+3)/4)
+}
+
+// truncateContent shortens content to at most max characters, cutting at the
+// last word boundary that fits (or mid-word if the first word alone is too
+// long). It reports whether anything was cut.
+func truncateContent(content string, max int) (string, bool) {
+	runes := []rune(content)
+	if len(runes) <= max {
+		return content, false
+	}
+	cut := runes[:max]
+	// If the cut falls inside a word, back up to the previous space
+	if runes[max] != ' ' {
+		if i := strings.LastIndexByte(string(cut), ' '); i > 0 {
+			return strings.TrimRight(string(cut)[:i], " "), true
+		}
+	}
+	return strings.TrimRight(string(cut), " "), true
+}
+
+// recordSender delivers the records extracted from one input file to its
+// Sink and counts the outcomes. With -batch-size above 1 records are buffered
+// and sent to the batch endpoint; callers must flush once the file is done.
+//
+// Requests are sent detached from ctx's cancellation so that a shutdown
+// signal lets in-flight requests and the final flush complete (each is still
+// bounded by -request-timeout).
+type recordSender struct {
+	ctx     context.Context
+	cfg     *Config
+	state   *runState
+	summary *Summary
+	sink    Sink
+	pending map[string][]map[string]string // by -route base URL, "" for the default
+	toEmbed []map[string]string            // waiting for -embed-endpoint
+
+	// attempts holds the prior delivery attempts of replayed records, keyed
+	// by deadLetterKey, so dead-letter entries keep an accurate count.
+	attempts map[string]int
+}
+
+func newRecordSender(ctx context.Context, cfg *Config, state *runState, sink Sink, summary *Summary) *recordSender {
+	return &recordSender{ctx: context.WithoutCancel(ctx), cfg: cfg, state: state, summary: summary, sink: sink}
+}
+
+// send hands a single record to the sink, or buffers it for the batch
+// endpoint. With -embed-endpoint, records are first buffered until there
+// are enough to embed together.
+func (r *recordSender) send(record map[string]string) {
+	// Replayed records may have been embedded already; -dry-run makes no
+	// requests at all
+	if r.cfg.EmbedEndpoint != "" && !r.cfg.DryRun && record["embedding"] == "" {
+		r.toEmbed = append(r.toEmbed, record)
+		if len(r.toEmbed) >= r.cfg.EmbedBatchSize {
+			r.embed()
+		}
+		return
+	}
+	r.deliver(record)
+}
+
+// deliver is send once any embedding is done.
+func (r *recordSender) deliver(record map[string]string) {
+	_, batching := r.sink.(httpSink)
+	if !batching || r.cfg.BatchSize <= 1 {
+		attrs := append(sourceAttrs(record), "resourceType", record["resourceType"], "id", record["id"])
+		if err := r.sink.Send(r.ctx, record); err != nil {
+			var ingestErr *IngestError
+			if errors.As(err, &ingestErr) && ingestErr.StatusCode != 0 {
+				attrs = append(attrs, "status", ingestErr.StatusCode)
+			}
+			logger.Error(fmt.Sprintf("  ✗ Failed to ingest %s (%s)%s: %v", record["id"], record["resourceType"], sourcePosition(record), err),
+				append(attrs, "error", err)...)
+			r.recordFailure(record, err)
+			return
+		}
+		if !isLocalSink(r.sink) {
+			logger.Info(fmt.Sprintf("  ✓ Ingested: %s (%s)", record["id"], record["resourceType"]), attrs...)
+			r.recordIngested(record)
+			return
+		}
+		r.recordOutcome(record, nil)
+		return
+	}
+
+	// A batch goes to a single endpoint, so records routed elsewhere are
+	// batched separately
+	route := r.cfg.Routes[record["resourceType"]]
+	if r.pending == nil {
+		r.pending = make(map[string][]map[string]string)
+	}
+	r.pending[route] = append(r.pending[route], record)
+	if len(r.pending[route]) >= r.cfg.BatchSize {
+		r.sendBatch(route)
+	}
+}
+
+// sourceAttrs returns the log attributes locating record in its source: the
+// file and, when known, the NDJSON line or Bundle entry.
+func sourceAttrs(record map[string]string) []any {
+	attrs := []any{"file", record["sourceFile"]}
+	if line := record["sourceLine"]; line != "" {
+		attrs = append(attrs, "line", line)
+	}
+	if entry := record["sourceEntry"]; entry != "" {
+		attrs = append(attrs, "entry", entry)
+	}
+	return attrs
+}
+
+// sourcePosition is sourceAttrs for a log message: " at line 48213",
+// " at entry 3", or "" when neither is known.
+func sourcePosition(record map[string]string) string {
+	if line := record["sourceLine"]; line != "" {
+		return " at line " + line
+	}
+	if entry := record["sourceEntry"]; entry != "" {
+		return " at entry " + entry
+	}
+	return ""
+}
+
+// embed requests embeddings for the records waiting in toEmbed and delivers
+// each with its vector, as a JSON array, under "embedding". When the
+// request fails, every record in it fails.
+func (r *recordSender) embed() {
+	if len(r.toEmbed) == 0 {
+		return
+	}
+	batch := r.toEmbed
+	r.toEmbed = nil
+
+	inputs := make([]string, len(batch))
+	for i, record := range batch {
+		inputs[i] = record["content"]
+	}
+	vectors, err := requestEmbeddings(r.ctx, r.cfg, r.state.httpClient, inputs)
+	if err != nil {
+		logger.Error(fmt.Sprintf("  ✗ Embedding %d records failed: %v", len(batch), err),
+			"file", batch[0]["sourceFile"], "records", len(batch), "error", err)
+		for _, record := range batch {
+			r.recordFailure(record, err)
+		}
+		return
+	}
+	for i, record := range batch {
+		vector, err := json.Marshal(vectors[i])
+		if err != nil {
+			r.recordFailure(record, fmt.Errorf("error marshaling embedding: %w", err))
+			continue
+		}
+		record["embedding"] = string(vector)
+		r.deliver(record)
+	}
+}
+
+// flush embeds and sends any buffered records.
+func (r *recordSender) flush() {
+	r.embed()
+	r.flushBatch()
+}
+
+// flushBatch sends any records buffered for the batch endpoint, one request
+// per route.
+func (r *recordSender) flushBatch() {
+	routes := make([]string, 0, len(r.pending))
+	for route := range r.pending {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	for _, route := range routes {
+		r.sendBatch(route)
+	}
+}
+
+// sendBatch sends the records buffered for route as a single request.
+func (r *recordSender) sendBatch(route string) {
+	batch := r.pending[route]
+	delete(r.pending, route)
+	if len(batch) == 0 {
+		return
+	}
+
+	failed, err := sendBatchToPipeline(r.ctx, r.cfg, r.state, batch)
+	if err != nil {
+		logger.Error(fmt.Sprintf("  ✗ Batch of %d records failed: %v", len(batch), err),
+			"file", batch[0]["sourceFile"], "records", len(batch), "error", err)
+		for _, record := range batch {
+			r.recordFailure(record, err)
+		}
+		return
+	}
+
+	for _, record := range batch {
+		reason, isFailed := failed[record["id"]]
+		if isFailed {
+			logger.Error(fmt.Sprintf("  ✗ Batch rejected: %s (%s)%s: %s", record["id"], record["resourceType"], sourcePosition(record), reason),
+				append(sourceAttrs(record), "resourceType", record["resourceType"], "id", record["id"], "error", reason)...)
+			r.recordFailure(record, &IngestError{Err: errors.New(reason)})
+			continue
+		}
+		r.recordIngested(record)
+	}
+	if len(failed) > 0 {
+		logger.Warn(fmt.Sprintf("  Batch partially failed: %d of %d records rejected", len(failed), len(batch)),
+			"file", batch[0]["sourceFile"], "records", len(batch), "rejected", len(failed))
+	} else {
+		logger.Info(fmt.Sprintf("  ✓ Ingested batch of %d records", len(batch)),
+			"file", batch[0]["sourceFile"], "records", len(batch))
+	}
+}
+
+// recordOutcome counts a record as ingested or, with a non-nil err, as a
+// pipeline failure.
+func (r *recordSender) recordOutcome(record map[string]string, err error) {
+	resourceType := record["resourceType"]
+	if err == nil {
+		r.summary.outcome(record["sourceFile"], resourceType, record["id"], "ingested", "", nil)
+		tokens := r.state.estimateTokens(record["content"])
+		r.summary.Ingested++
+		r.summary.EstimatedTokens += tokens
+		tc := r.summary.typeCounts(resourceType)
+		tc.Ingested++
+		tc.EstimatedTokens += tokens
+		return
+	}
+	r.summary.PipelineFailures++
+	r.summary.typeCounts(resourceType).PipelineFailures++
+	r.summary.outcome(record["sourceFile"], resourceType, record["id"], "failed", "", err)
+	if r.state.failures != nil {
+		r.state.failures.add()
+	}
+}
+
+// recordIngested counts a record the pipeline accepted and, with
+// -incremental, remembers its content.
+func (r *recordSender) recordIngested(record map[string]string) {
+	r.recordOutcome(record, nil)
+	r.state.ingestCache.update(record)
+}
+
+// recordFailure counts a record the pipeline did not accept and, with
+// -dead-letter-file, saves it for a later -replay.
+func (r *recordSender) recordFailure(record map[string]string, err error) {
+	r.recordOutcome(record, err)
+	if r.state.deadLetters == nil {
+		return
+	}
+
+	entry := deadLetterEntry{
+		Record:   record,
+		Error:    err.Error(),
+		Attempts: r.attempts[deadLetterKey(record)] + 1,
+		FailedAt: time.Now().UTC(),
+	}
+	var ingestErr *IngestError
+	if errors.As(err, &ingestErr) {
+		entry.StatusCode = ingestErr.StatusCode
+	}
+	if err := r.state.deadLetters.Write(entry); err != nil {
+		logger.Error(fmt.Sprintf("Error writing dead-letter record %s: %v", record["id"], err),
+			"file", record["sourceFile"], "resourceType", record["resourceType"], "id", record["id"], "error", err)
+	}
+}
+
+// patientContext is the patient a record belongs to. Gender, BirthDate,
+// Names, and Identifiers are only known when the Patient resource is in the
+// same Bundle.
+type patientContext struct {
+	ID          string
+	Gender      string
+	BirthDate   string
+	Names       []string // for -redact: each name whole and its parts
+	Identifiers []string // identifier[].value, for -redact
+}
+
+// newPatientContext describes a Patient resource, identified by its id or,
+// failing that, by ref (its fullUrl or the reference used to reach it).
+func newPatientContext(patient map[string]interface{}, ref string) patientContext {
+	p := patientContext{ID: ref}
+	if id, ok := patient["id"].(string); ok && id != "" {
+		p.ID = id
+	}
+	p.Gender, _ = patient["gender"].(string)
+	p.BirthDate, _ = patient["birthDate"].(string)
+	p.Names = nameTerms(patient["name"])
+	p.Identifiers = identifierValues(patient["identifier"])
+	return p
+}
+
+// entryPatient returns the patient a Bundle entry belongs to: the entry
+// itself if it is a Patient, otherwise the Patient its subject or patient
+// reference points to, resolved through refs when the Patient is in the
+// Bundle. Entries without a Patient reference get fallback.
+func entryPatient(entry Entry, refs resourceIndex, fallback patientContext) patientContext {
+	resource := entry.Resource
+	if resourceType, _ := resource["resourceType"].(string); resourceType == "Patient" {
+		return newPatientContext(resource, entry.FullURL)
+	}
+	for _, field := range []string{"subject", "patient"} {
+		refObj, ok := resource[field].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		reference, _ := refObj["reference"].(string)
+		if reference == "" {
+			continue
+		}
+		if target := refs.resolve(refObj); target != nil {
+			if targetType, _ := target["resourceType"].(string); targetType == "Patient" {
+				return newPatientContext(target, reference)
+			}
+			continue
+		}
+		if id, ok := strings.CutPrefix(reference, "Patient/"); ok {
+			if id == fallback.ID {
+				return fallback
+			}
+			return patientContext{ID: id}
+		}
+	}
+	return fallback
+}
+
+// describe returns a short demographic line such as "Patient: 43-year-old
+// female." for -embed-patient-context. The age is taken at asOf, the date of
+// the resource being described; without one, the birth date is given
+// instead. It returns "" when no demographics are known.
+func (p patientContext) describe(asOf string) string {
+	var desc string
+	if age := ageText(p.BirthDate, asOf); age != "" {
+		desc = strings.TrimSpace(age + " " + p.Gender)
+	} else {
+		var words []string
+		if p.Gender != "" {
+			words = append(words, p.Gender)
+		}
+		if p.BirthDate != "" {
+			words = append(words, "born "+normalizeDate(p.BirthDate))
+		}
+		desc = strings.Join(words, ", ")
+	}
+	if desc == "" {
+		return ""
+	}
+	return fmt.Sprintf("Patient: %s.", desc)
+}
+
+// ageText formats the age at asOf of someone born on birthDate, e.g.
+// "43-year-old", or "8-month-old" under two years. It returns "" if either
+// date is missing or unparseable, or asOf is before birthDate.
+func ageText(birthDate, asOf string) string {
+	born, ok := parseFHIRDate(birthDate)
+	if !ok {
+		return ""
+	}
+	at, ok := parseFHIRDate(asOf)
+	if !ok || at.Before(born) {
+		return ""
+	}
+	months := (at.Year()-born.Year())*12 + int(at.Month()-born.Month())
+	if at.Day() < born.Day() {
+		months--
+	}
+	if months < 24 {
+		return fmt.Sprintf("%d-month-old", months)
+	}
+	return fmt.Sprintf("%d-year-old", months/12)
+}
+
+// resourceDate returns the date a resource refers to clinically, taken from
+// the first of its common date elements that is set, or "" if none is.
+func resourceDate(resource map[string]interface{}) string {
+	for _, field := range []string{
+		"effectiveDateTime", "onsetDateTime", "performedDateTime", "occurrenceDateTime",
+		"authoredOn", "recordedDate", "issued", "date",
+	} {
+		if date, ok := resource[field].(string); ok && date != "" {
+			return date
+		}
+	}
+	for _, field := range []string{"effectivePeriod", "performedPeriod", "period"} {
+		if period, ok := resource[field].(map[string]interface{}); ok {
+			if start, ok := period["start"].(string); ok && start != "" {
+				return start
+			}
+		}
+	}
+	return ""
+}
+
+// resourceIndex maps the references a Bundle's entries can be reached by,
+// both "Type/id" and fullUrl, to compact copies of the resources holding
+// only indexedFields.
+type resourceIndex map[string]map[string]interface{}
+
+// indexedFields are the elements kept in a resourceIndex: enough to name a
+// referenced resource, describe (or -redact) a referenced Patient, and summarize an
+// Observation listed in a DiagnosticReport's results.
+var indexedFields = []string{
+	"resourceType", "id", "code", "name", "identifier", "gender", "birthDate",
+	"valueQuantity", "valueCodeableConcept", "valueString", "valueBoolean", "interpretation",
+}
+
+// add indexes a compact copy of entry's resource.
+func (idx resourceIndex) add(entry Entry) {
+	if entry.Resource == nil {
+		return
+	}
+	compact := make(map[string]interface{}, len(indexedFields))
+	for _, field := range indexedFields {
+		if v, ok := entry.Resource[field]; ok {
+			compact[field] = v
+		}
+	}
+	if entry.FullURL != "" {
+		idx[entry.FullURL] = compact
+	}
+	resourceType, _ := compact["resourceType"].(string)
+	id, _ := compact["id"].(string)
+	if resourceType != "" && id != "" {
+		idx[resourceType+"/"+id] = compact
+	}
+}
+
+// resolve returns the resource a FHIR Reference points to, or nil if the
+// target is not in the index.
+func (idx resourceIndex) resolve(ref interface{}) map[string]interface{} {
+	refObj, ok := ref.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	reference, _ := refObj["reference"].(string)
+	if reference == "" {
+		return nil
+	}
+	return idx[reference]
+}
+
+// referenceText describes the target of a FHIR Reference: the code (or
+// name) of the resolved resource, falling back to the reference's display.
+func (idx resourceIndex) referenceText(cfg *Config, ref interface{}) string {
+	if target := idx.resolve(ref); target != nil {
+		if text := codeableConceptText(cfg, target["code"]); text != "" {
+			return text
+		}
+		if name, ok := target["name"].(string); ok && name != "" {
+			return name
+		}
+	}
+	if refObj, ok := ref.(map[string]interface{}); ok {
+		if display, ok := refObj["display"].(string); ok {
+			return display
+		}
+	}
+	return ""
+}
+
+// contentPointerRule lists where in a resource to find extra content: its
+// Pointers' string values are added after the built-in content, or replace
+// it (narrative included) when Replace is set.
+type contentPointerRule struct {
+	Pointers []jsonPointer `json:"pointers"`
+	Replace  bool          `json:"replace"`
+}
+
+// values returns the non-empty string values the rule's pointers reach in
+// resource, in order. Pointers that reach nothing, or a non-string, are
+// ignored.
+func (r contentPointerRule) values(resource map[string]interface{}) []string {
+	var values []string
+	for _, pointer := range r.Pointers {
+		if value, ok := pointer.lookup(resource).(string); ok && strings.TrimSpace(value) != "" {
+			values = append(values, strings.TrimSpace(value))
+		}
+	}
+	return values
+}
+
+// loadContentPointers reads a -content-pointers file, rejecting pointers
+// that are not valid RFC 6901 syntax.
+func loadContentPointers(path string) (map[string]contentPointerRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules map[string]contentPointerRule
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&rules); err != nil {
+		return nil, err
+	}
+	for resourceType, rule := range rules {
+		if len(rule.Pointers) == 0 {
+			return nil, fmt.Errorf("%s: no pointers", resourceType)
+		}
+	}
+	return rules, nil
+}
+
+// jsonPointer is a parsed RFC 6901 JSON pointer such as "/note/0/text": the
+// reference tokens, unescaped.
+type jsonPointer []string
+
+func parseJSONPointer(s string) (jsonPointer, error) {
+	if s == "" {
+		return jsonPointer{}, nil
+	}
+	if !strings.HasPrefix(s, "/") {
+		return nil, fmt.Errorf("JSON pointer %q must start with /", s)
+	}
+	tokens := strings.Split(s[1:], "/")
+	for i, token := range tokens {
+		for j := 0; j < len(token); j++ {
+			if token[j] == '~' && (j+1 == len(token) || token[j+1] != '0' && token[j+1] != '1') {
+				return nil, fmt.Errorf("JSON pointer %q: ~ must be followed by 0 or 1", s)
+			}
+		}
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+	}
+	return tokens, nil
+}
+
+func (p *jsonPointer) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := parseJSONPointer(s)
+	if err != nil {
+		return err
+	}
+	*p = parsed
+	return nil
+}
+
+// lookup returns the value p refers to in v, or nil if there is none.
+// Array indexes must be decimal with no leading zeros.
+func (p jsonPointer) lookup(v interface{}) interface{} {
+	for _, token := range p {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			v = node[token]
+		case []interface{}:
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i >= len(node) || strconv.Itoa(i) != token {
+				return nil
+			}
+			v = node[i]
+		default:
+			return nil
+		}
+	}
+	return v
+}
+
+// personName names the Practitioner (or other person) ref points to: the
+// HumanName of the resource it resolves to, else the reference's display.
+func (idx resourceIndex) personName(ref interface{}) string {
+	if target := idx.resolve(ref); target != nil {
+		if names, ok := target["name"].([]interface{}); ok {
+			if name := humanName(names); name != "" {
+				return name
+			}
+		}
+	}
+	if refObj, ok := ref.(map[string]interface{}); ok {
+		if display, ok := refObj["display"].(string); ok {
+			return display
+		}
+	}
+	return ""
+}
+
+// participantTexts names the clinicians in an Encounter's participant list,
+// each followed by their role when given: "Dr. Ann Lee (primary performer)".
+func participantTexts(cfg *Config, v interface{}, refs resourceIndex) []string {
+	list, _ := v.([]interface{})
+	var texts []string
+	for _, p := range list {
+		participant, ok := p.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name := refs.personName(participant["individual"])
+		if name == "" {
+			continue
+		}
+		if roles := conceptListText(cfg, participant["type"]); len(roles) > 0 {
+			name = fmt.Sprintf("%s (%s)", name, strings.Join(roles, ", "))
+		}
+		texts = append(texts, name)
+	}
+	return texts
+}
+
+// provenanceAgentTexts names who took part in a Provenance, people by name
+// and organizations and devices as referenceText describes them, each
+// followed by their type when given: "Dr. Ann Lee (author)".
+func provenanceAgentTexts(cfg *Config, v interface{}, refs resourceIndex) []string {
+	list, _ := v.([]interface{})
+	var texts []string
+	for _, a := range list {
+		agent, ok := a.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name := refs.personName(agent["who"])
+		if name == "" {
+			name = refs.referenceText(cfg, agent["who"])
+		}
+		if name == "" {
+			continue
+		}
+		if role := codeableConceptText(cfg, agent["type"]); role != "" {
+			name = fmt.Sprintf("%s (%s)", name, role)
+		}
+		texts = append(texts, name)
+	}
+	return texts
+}
+
+// provenanceTargetTexts describes the resources a Provenance covers as
+// "Asthma (Condition)", or by the bare reference when the target is not in
+// the Bundle and has no display.
+func provenanceTargetTexts(cfg *Config, v interface{}, refs resourceIndex) []string {
+	list, _ := v.([]interface{})
+	var texts []string
+	for _, t := range list {
+		ref, ok := t.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		reference, _ := ref["reference"].(string)
+		resourceType, _ := ref["type"].(string)
+		if target := refs.resolve(ref); target != nil {
+			resourceType, _ = target["resourceType"].(string)
+		} else if before, _, found := strings.Cut(reference, "/"); found && resourceType == "" && !strings.Contains(before, ":") {
+			resourceType = before
+		}
+		switch text := refs.referenceText(cfg, ref); {
+		case text != "" && resourceType != "":
+			texts = append(texts, fmt.Sprintf("%s (%s)", text, resourceType))
+		case text != "":
+			texts = append(texts, text)
+		case reference != "":
+			texts = append(texts, reference)
+		}
+	}
+	return texts
+}
+
+// questionnaireItemParts appends a "Question: ... Answer: ..." part for each
+// answered QuestionnaireResponse item to parts, walking nested items in
+// order. A group item (one with items of its own) adds a "Section:" part
+// before them. Items are named by their text, or their linkId without one.
+func questionnaireItemParts(cfg *Config, parts []string, v interface{}, refs resourceIndex) []string {
+	items, _ := v.([]interface{})
+	for _, i := range items {
+		item, ok := i.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		text, _ := item["text"].(string)
+		if text == "" {
+			text, _ = item["linkId"].(string)
+		}
+		var answers []string
+		list, _ := item["answer"].([]interface{})
+		for _, a := range list {
+			if answer, ok := a.(map[string]interface{}); ok {
+				if value := answerValue(cfg, answer, refs); value != "" {
+					answers = append(answers, value)
+				}
+			}
+		}
+		if len(answers) > 0 {
+			parts = append(parts, fmt.Sprintf("Question: %s Answer: %s", text, strings.Join(answers, ", ")))
+		}
+		if children, ok := item["item"].([]interface{}); ok && len(children) > 0 {
+			if text != "" {
+				parts = append(parts, fmt.Sprintf("Section: %s", text))
+			}
+			parts = questionnaireItemParts(cfg, parts, children, refs)
+		}
+		// Follow-up questions can hang off an answer, as for "If yes, ..."
+		for _, a := range list {
+			if answer, ok := a.(map[string]interface{}); ok {
+				parts = questionnaireItemParts(cfg, parts, answer["item"], refs)
+			}
+		}
+	}
+	return parts
+}
+
+// answerValue renders a QuestionnaireResponse answer's value[x]: a Coding
+// by its display (or code), a Reference by what it points to, and the other
+// types as in Observation values.
+func answerValue(cfg *Config, answer map[string]interface{}, refs resourceIndex) string {
+	if coding, ok := answer["valueCoding"].(map[string]interface{}); ok {
+		if display, _ := coding["display"].(string); display != "" {
+			return display
+		}
+		code, _ := coding["code"].(string)
+		return code
+	}
+	if value, ok := answer["valueDecimal"].(float64); ok {
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	if value, ok := answer["valueDate"].(string); ok {
+		return normalizeDate(value)
+	}
+	if _, ok := answer["valueReference"]; ok {
+		return refs.referenceText(cfg, answer["valueReference"])
+	}
+	return observationValue(cfg, answer)
+}
+
+// extractContent renders a resource as plain text for embedding: its
+// narrative when present, otherwise a type-specific summary of its key
+// elements (with -merge-narrative, the summary followed by the narrative).
+// refs resolves references within the resource's Bundle; it may be nil, in
+// which case references contribute only their display text. cfg supplies the
+// extraction settings, such as -include-pii.
+func extractContent(cfg *Config, resource map[string]interface{}, resourceType string, refs resourceIndex) string {
+	return strings.Join(contentParts(cfg, resource, resourceType, refs), " ")
+}
+
+// contentParts is extractContent before the parts are joined: a heading such
+// as "Clinical Observation:", unlabeled values such as the code, and
+// "Label: value" fields. Narrative is returned as a single part. Values read
+// through -content-pointers follow the built-in parts, or replace them.
+func contentParts(cfg *Config, resource map[string]interface{}, resourceType string, refs resourceIndex) []string {
+	rule, ok := cfg.ContentPointers[resourceType]
+	if !ok {
+		return builtinContentParts(cfg, resource, resourceType, refs)
+	}
+	parts := rule.values(resource)
+	if rule.Replace {
+		return parts
+	}
+	return append(builtinContentParts(cfg, resource, resourceType, refs), parts...)
+}
+
+// builtinContentParts is contentParts without -content-pointers.
+func builtinContentParts(cfg *Config, resource map[string]interface{}, resourceType string, refs resourceIndex) []string {
+	// Try to get text.div first (if available)
+	var narrative string
+	if text, ok := resource["text"].(map[string]interface{}); ok {
+		if div, ok := text["div"].(string); ok && div != "" {
+			// Clean HTML tags for better text extraction
+			narrative = cleanHTML(div)
+		}
+	}
+	if narrative == "" {
+		return structuredContentParts(cfg, resource, resourceType, refs)
+	}
+	if !cfg.MergeNarrative {
+		return []string{narrative}
+	}
+	return mergeNarrativeParts(structuredContentParts(cfg, resource, resourceType, refs), narrative)
+}
+
+// structuredContentParts summarizes the key elements of a resource by type,
+// ignoring its narrative.
+func structuredContentParts(cfg *Config, resource map[string]interface{}, resourceType string, refs resourceIndex) []string {
+	var parts []string
+
+	// Build content based on resource type
+	switch resourceType {
+	case "Patient":
+		parts = append(parts, "Patient Information:")
+		if names, ok := resource["name"].([]interface{}); ok {
+			if fullName := humanName(names); fullName != "" {
+				parts = append(parts, fmt.Sprintf("Name: %s", fullName))
+			}
+		}
+		if gender, ok := resource["gender"].(string); ok {
+			parts = append(parts, fmt.Sprintf("Gender: %s", gender))
+		}
+		if birthDate, ok := resource["birthDate"].(string); ok {
+			parts = append(parts, fmt.Sprintf("Date of Birth: %s", normalizeDate(birthDate)))
+		}
+		if race := usCoreCategoryText(resource, usCoreRaceURL); race != "" {
+			parts = append(parts, fmt.Sprintf("Race: %s", race))
+		}
+		if ethnicity := usCoreCategoryText(resource, usCoreEthnicityURL); ethnicity != "" {
+			parts = append(parts, fmt.Sprintf("Ethnicity: %s", ethnicity))
+		}
+		if cfg.IncludePII {
+			if address := addressText(resource["address"]); address != "" {
+				parts = append(parts, fmt.Sprintf("Address: %s", address))
+			}
+			parts = append(parts, telecomTexts(resource["telecom"])...)
+			if marital := maritalStatusText(cfg, resource["maritalStatus"]); marital != "" {
+				parts = append(parts, fmt.Sprintf("Marital status: %s", marital))
+			}
+		}
+
+	case "Condition":
+		parts = append(parts, "Medical Condition:")
+		if code := codeableConceptText(cfg, resource["code"]); code != "" {
+			parts = append(parts, code)
+		}
+		if categories := categoryTexts(cfg, resource["category"]); len(categories) > 0 {
+			parts = append(parts, fmt.Sprintf("Category: %s", strings.Join(categories, ", ")))
+		}
+		if status := extractStatus(resource["clinicalStatus"]); status != "" {
+			parts = append(parts, fmt.Sprintf("Status: %s", status))
+		}
+		if verification := extractStatus(resource["verificationStatus"]); verification != "" {
+			parts = append(parts, fmt.Sprintf("Verification: %s", verification))
+		}
+		if severity := codeableConceptText(cfg, resource["severity"]); severity != "" {
+			parts = append(parts, fmt.Sprintf("Severity: %s", severity))
+		}
+		if sites := conceptListText(cfg, resource["bodySite"]); len(sites) > 0 {
+			parts = append(parts, fmt.Sprintf("Body site: %s", strings.Join(sites, ", ")))
+		}
+		if onset := choiceTimeText(resource, "onset"); onset != "" {
+			parts = append(parts, fmt.Sprintf("Onset: %s", onset))
+		}
+		if abated, ok := resource["abatementBoolean"].(bool); ok {
+			if abated {
+				parts = append(parts, "Abated: yes")
+			}
+		} else if abatement := choiceTimeText(resource, "abatement"); abatement != "" {
+			parts = append(parts, fmt.Sprintf("Abated: %s", abatement))
+		}
+
+	case "Observation":
+		parts = append(parts, "Clinical Observation:")
+		if code := codeableConceptText(cfg, resource["code"]); code != "" {
+			parts = append(parts, code)
+		}
+		if categories := categoryTexts(cfg, resource["category"]); len(categories) > 0 {
+			parts = append(parts, fmt.Sprintf("Category: %s", strings.Join(categories, ", ")))
+		}
+		if value := observationValue(cfg, resource); value != "" {
+			parts = append(parts, fmt.Sprintf("Value: %s", value))
+		} else if reason := dataAbsentText(cfg, resource["dataAbsentReason"]); reason != "" {
+			parts = append(parts, fmt.Sprintf("Value not available: %s", reason))
+		}
+		// Panels such as blood pressure carry their values in components
+		if components, ok := resource["component"].([]interface{}); ok {
+			for _, c := range components {
+				component, ok := c.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				value := observationValue(cfg, component)
+				if value == "" {
+					reason := dataAbsentText(cfg, component["dataAbsentReason"])
+					if reason == "" {
+						continue
+					}
+					value = fmt.Sprintf("not available (%s)", reason)
+				}
+				label := codeableConceptText(cfg, component["code"])
+				if label == "" {
+					label = "Component"
+				}
+				parts = append(parts, fmt.Sprintf("%s: %s", label, value))
+			}
+		}
+		if ranges, ok := resource["referenceRange"].([]interface{}); ok {
+			for _, r := range ranges {
+				if text := referenceRangeText(r); text != "" {
+					parts = append(parts, fmt.Sprintf("Reference range: %s", text))
+				}
+			}
+		}
+		if interpretation := interpretationText(cfg, resource["interpretation"]); interpretation != "" {
+			parts = append(parts, fmt.Sprintf("Interpretation: %s", interpretation))
+		}
+		if effective := effectiveDate(resource); effective != "" {
+			parts = append(parts, fmt.Sprintf("Date: %s", effective))
+		}
+
+	case "Encounter":
+		parts = append(parts, "Healthcare Encounter:")
+		if encType, ok := resource["type"].([]interface{}); ok && len(encType) > 0 {
+			if text := codeableConceptText(cfg, encType[0]); text != "" {
+				parts = append(parts, text)
+			}
+		}
+		if period, ok := resource["period"].(map[string]interface{}); ok {
+			if start, ok := period["start"].(string); ok {
+				parts = append(parts, fmt.Sprintf("Start: %s", normalizeDate(start)))
+			}
+			if end, ok := period["end"].(string); ok {
+				parts = append(parts, fmt.Sprintf("End: %s", normalizeDate(end)))
+			}
+		}
+		if reasons := reasonTexts(cfg, resource, refs); len(reasons) > 0 {
+			parts = append(parts, fmt.Sprintf("Reason: %s", strings.Join(reasons, ", ")))
+		}
+		if participants := participantTexts(cfg, resource["participant"], refs); len(participants) > 0 {
+			parts = append(parts, fmt.Sprintf("Participants: %s", strings.Join(participants, ", ")))
+		}
+
+	case "MedicationRequest":
+		parts = append(parts, "Medication Prescription:")
+		if medication := medicationText(cfg, resource, refs); medication != "" {
+			parts = append(parts, medication)
+		} else if medRef, ok := resource["medicationReference"].(map[string]interface{}); ok {
+			if ref, ok := medRef["reference"].(string); ok {
+				parts = append(parts, fmt.Sprintf("Medication Reference: %s", ref))
+			}
+		}
+		if status := extractStatus(resource["status"]); status != "" {
+			parts = append(parts, fmt.Sprintf("Status: %s", status))
+		}
+		if authored, ok := resource["authoredOn"].(string); ok {
+			parts = append(parts, fmt.Sprintf("Prescribed: %s", normalizeDate(authored)))
+		}
+
+	case "MedicationStatement":
+		parts = append(parts, "Medication Statement:")
+		if medication := medicationText(cfg, resource, refs); medication != "" {
+			parts = append(parts, medication)
+		}
+		if status := extractStatus(resource["status"]); status != "" {
+			parts = append(parts, fmt.Sprintf("Status: %s", status))
+		}
+		if dosage := dosageText(resource["dosage"]); dosage != "" {
+			parts = append(parts, fmt.Sprintf("Dosage: %s", dosage))
+		}
+		if effective := choiceTimeText(resource, "effective"); effective != "" {
+			parts = append(parts, fmt.Sprintf("Effective: %s", effective))
+		}
+		if asserted, ok := resource["dateAsserted"].(string); ok {
+			parts = append(parts, fmt.Sprintf("Asserted: %s", normalizeDate(asserted)))
+		}
+
+	case "MedicationDispense":
+		parts = append(parts, "Medication Dispense:")
+		if medication := medicationText(cfg, resource, refs); medication != "" {
+			parts = append(parts, medication)
+		}
+		if status := extractStatus(resource["status"]); status != "" {
+			parts = append(parts, fmt.Sprintf("Status: %s", status))
+		}
+		if quantity := quantityText(resource["quantity"]); quantity != "" {
+			parts = append(parts, fmt.Sprintf("Quantity: %s", quantity))
+		}
+		if supply := quantityText(resource["daysSupply"]); supply != "" {
+			parts = append(parts, fmt.Sprintf("Days Supply: %s", supply))
+		}
+		if dosage := dosageText(resource["dosageInstruction"]); dosage != "" {
+			parts = append(parts, fmt.Sprintf("Dosage: %s", dosage))
+		}
+		if handedOver, ok := resource["whenHandedOver"].(string); ok {
+			parts = append(parts, fmt.Sprintf("Handed Over: %s", normalizeDate(handedOver)))
+		} else if prepared, ok := resource["whenPrepared"].(string); ok {
+			parts = append(parts, fmt.Sprintf("Prepared: %s", normalizeDate(prepared)))
+		}
+
+	case "ServiceRequest":
+		parts = append(parts, "Service Request:")
+		if code := codeableConceptText(cfg, resource["code"]); code != "" {
+			parts = append(parts, code)
+		}
+		if status := extractStatus(resource["status"]); status != "" {
+			parts = append(parts, fmt.Sprintf("Status: %s", status))
+		}
+		if intent, ok := resource["intent"].(string); ok && intent != "" {
+			parts = append(parts, fmt.Sprintf("Intent: %s", intent))
+		}
+		if occurrence := choiceTimeText(resource, "occurrence"); occurrence != "" {
+			parts = append(parts, fmt.Sprintf("Scheduled: %s", occurrence))
+		} else if authored, ok := resource["authoredOn"].(string); ok {
+			parts = append(parts, fmt.Sprintf("Ordered: %s", normalizeDate(authored)))
+		}
+		if reasons := reasonTexts(cfg, resource, refs); len(reasons) > 0 {
+			parts = append(parts, fmt.Sprintf("Reason: %s", strings.Join(reasons, ", ")))
+		}
+
+	case "Medication":
+		parts = append(parts, "Medication:")
+		if code := codeableConceptText(cfg, resource["code"]); code != "" {
+			parts = append(parts, code)
+		}
+
+	case "Immunization":
+		parts = append(parts, "Immunization:")
+		if vaccine := codeableConceptText(cfg, resource["vaccineCode"]); vaccine != "" {
+			parts = append(parts, vaccine)
+		}
+		if status := extractStatus(resource["status"]); status != "" {
+			parts = append(parts, fmt.Sprintf("Status: %s", status))
+		}
+		// R4 renamed the STU3 date element to occurrence[x]
+		occurrence := ""
+		if readsVersion(cfg, "r4") {
+			occurrence = choiceTimeText(resource, "occurrence")
+		}
+		if date, ok := resource["date"].(string); ok && occurrence == "" && readsVersion(cfg, "stu3") {
+			occurrence = normalizeDate(date)
+		}
+		if occurrence != "" {
+			parts = append(parts, fmt.Sprintf("Date: %s", occurrence))
+		}
+
+	case "DiagnosticReport":
+		parts = append(parts, "Diagnostic Report:")
+		if code := codeableConceptText(cfg, resource["code"]); code != "" {
+			parts = append(parts, code)
+		}
+		if effective := effectiveDate(resource); effective != "" {
+			parts = append(parts, fmt.Sprintf("Date: %s", effective))
+		}
+		var results []string
+		if list, ok := resource["result"].([]interface{}); ok {
+			for _, ref := range list {
+				if text := resultText(cfg, resource, ref, refs); text != "" {
+					results = append(results, text)
+				}
+			}
+		}
+		if len(results) > 0 {
+			parts = append(parts, fmt.Sprintf("Results: %s", strings.Join(results, "; ")))
+		}
+		var conclusions []string
+		if conclusion, ok := resource["conclusion"].(string); ok && conclusion != "" {
+			conclusions = append(conclusions, conclusion)
+		}
+		conclusions = append(conclusions, conceptListText(cfg, resource["conclusionCode"])...)
+		if len(conclusions) > 0 {
+			parts = append(parts, fmt.Sprintf("Conclusion: %s", strings.Join(conclusions, "; ")))
+		}
+
+	case "Procedure":
+		parts = append(parts, "Medical Procedure:")
+		if code := codeableConceptText(cfg, resource["code"]); code != "" {
+			parts = append(parts, code)
+		}
+		if status := extractStatus(resource["status"]); status != "" {
+			parts = append(parts, fmt.Sprintf("Status: %s", status))
+		}
+		if sites := conceptListText(cfg, resource["bodySite"]); len(sites) > 0 {
+			parts = append(parts, fmt.Sprintf("Body site: %s", strings.Join(sites, ", ")))
+		}
+		if performed := choiceTimeText(resource, "performed"); performed != "" {
+			parts = append(parts, fmt.Sprintf("Performed: %s", performed))
+		}
+		if reasons := reasonTexts(cfg, resource, refs); len(reasons) > 0 {
+			parts = append(parts, fmt.Sprintf("Reason: %s", strings.Join(reasons, ", ")))
+		}
+
+	case "AllergyIntolerance":
+		parts = append(parts, "Allergy/Intolerance:")
+		if code := codeableConceptText(cfg, resource["code"]); code != "" {
+			parts = append(parts, code)
+		}
+		if status := extractStatus(resource["clinicalStatus"]); status != "" {
+			parts = append(parts, fmt.Sprintf("Status: %s", status))
+		}
+		if criticality, ok := resource["criticality"].(string); ok {
+			parts = append(parts, fmt.Sprintf("Criticality: %s", criticality))
+		}
+		var manifestations []string
+		if reactions, ok := resource["reaction"].([]interface{}); ok {
+			for _, r := range reactions {
+				reaction, ok := r.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				if manifestation, ok := reaction["manifestation"].([]interface{}); ok {
+					for _, m := range manifestation {
+						if text := codeableConceptText(cfg, m); text != "" {
+							manifestations = append(manifestations, text)
+						}
+					}
+				}
+			}
+		}
+		if len(manifestations) > 0 {
+			parts = append(parts, fmt.Sprintf("Reactions: %s", strings.Join(manifestations, ", ")))
+		}
+
+	case "FamilyMemberHistory":
+		parts = append(parts, "Family History:")
+		if relationship := codeableConceptText(cfg, resource["relationship"]); relationship != "" {
+			parts = append(parts, relationship)
+		}
+		var conditions []string
+		if list, ok := resource["condition"].([]interface{}); ok {
+			for _, c := range list {
+				condition, ok := c.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				text := codeableConceptText(cfg, condition["code"])
+				if text == "" {
+					continue
+				}
+				if onset := choiceTimeText(condition, "onset"); onset != "" {
+					text = fmt.Sprintf("%s, onset %s", text, onset)
+				}
+				for _, note := range noteTexts(condition["note"]) {
+					text = fmt.Sprintf("%s, note: %s", text, note)
+				}
+				conditions = append(conditions, text)
+			}
+		}
+		if len(conditions) > 0 {
+			parts = append(parts, fmt.Sprintf("Conditions: %s", strings.Join(conditions, "; ")))
+		}
+		for _, note := range noteTexts(resource["note"]) {
+			parts = append(parts, fmt.Sprintf("Note: %s", note))
+		}
+
+	case "CarePlan":
+		parts = append(parts, "Care Plan:")
+		if title, ok := resource["title"].(string); ok && title != "" {
+			parts = append(parts, title)
+		}
+		if categories := categoryTexts(cfg, resource["category"]); len(categories) > 0 {
+			parts = append(parts, fmt.Sprintf("Category: %s", strings.Join(categories, ", ")))
+		}
+		if status := extractStatus(resource["status"]); status != "" {
+			parts = append(parts, fmt.Sprintf("Status: %s", status))
+		}
+		if description, ok := resource["description"].(string); ok && description != "" {
+			parts = append(parts, description)
+		}
+		var activities []string
+		if list, ok := resource["activity"].([]interface{}); ok {
+			for _, a := range list {
+				activity, ok := a.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				detail, ok := activity["detail"].(map[string]interface{})
+				if !ok {
+					continue
+				}
+				text := codeableConceptText(cfg, detail["code"])
+				if text == "" {
+					text, _ = detail["description"].(string)
+				}
+				if text == "" {
+					continue
+				}
+				if status, ok := detail["status"].(string); ok && status != "" {
+					text = fmt.Sprintf("%s (%s)", text, status)
+				}
+				activities = append(activities, text)
+			}
+		}
+		if len(activities) > 0 {
+			parts = append(parts, fmt.Sprintf("Activities: %s", strings.Join(activities, "; ")))
+		}
+
+	case "Goal":
+		parts = append(parts, "Goal:")
+		if description := codeableConceptText(cfg, resource["description"]); description != "" {
+			parts = append(parts, description)
+		}
+		if status := extractStatus(resource["lifecycleStatus"]); status != "" {
+			parts = append(parts, fmt.Sprintf("Status: %s", status))
+		}
+		if achievement := codeableConceptText(cfg, resource["achievementStatus"]); achievement != "" {
+			parts = append(parts, fmt.Sprintf("Achievement: %s", achievement))
+		}
+		if targets, ok := resource["target"].([]interface{}); ok {
+			for _, t := range targets {
+				if target, ok := t.(map[string]interface{}); ok {
+					if text := goalTargetText(cfg, target); text != "" {
+						parts = append(parts, fmt.Sprintf("Target: %s", text))
+					}
+				}
+			}
+		}
+
+	case "DocumentReference":
+		parts = append(parts, "Clinical Document:")
+		if docType := codeableConceptText(cfg, resource["type"]); docType != "" {
+			parts = append(parts, docType)
+		}
+		// STU3 has a single class where R4 has category[]
+		if categories := categoryTexts(cfg, versionedField(cfg, resource, "category", "class")); len(categories) > 0 {
+			parts = append(parts, fmt.Sprintf("Category: %s", strings.Join(categories, ", ")))
+		}
+		if description, ok := resource["description"].(string); ok && description != "" {
+			parts = append(parts, description)
+		}
+		if date, ok := resource["date"].(string); ok {
+			parts = append(parts, fmt.Sprintf("Date: %s", normalizeDate(date)))
+		}
+		if contents, ok := resource["content"].([]interface{}); ok {
+			for _, c := range contents {
+				content, ok := c.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				if attachment, ok := content["attachment"].(map[string]interface{}); ok {
+					if text := attachmentText(attachment); text != "" {
+						parts = append(parts, text)
+					}
+				}
+			}
+		}
+
+	case "Coverage":
+		parts = append(parts, "Insurance Coverage:")
+		if coverageType := codeableConceptText(cfg, resource["type"]); coverageType != "" {
+			parts = append(parts, coverageType)
+		}
+		if status := extractStatus(resource["status"]); status != "" {
+			parts = append(parts, fmt.Sprintf("Status: %s", status))
+		}
+		var payors []string
+		if list, ok := resource["payor"].([]interface{}); ok {
+			for _, ref := range list {
+				if text := refs.referenceText(cfg, ref); text != "" {
+					payors = append(payors, text)
+				}
+			}
+		}
+		if len(payors) > 0 {
+			parts = append(parts, fmt.Sprintf("Payor: %s", strings.Join(payors, ", ")))
+		}
+		// The subscriber is identified by relationship only; their name is
+		// PII. Like Claim.type, relationship is usually a bare code, so it's
+		// read the way statuses are.
+		if relationship := extractStatus(resource["relationship"]); relationship != "" {
+			parts = append(parts, fmt.Sprintf("Subscriber: %s", relationship))
+		}
+		if period := periodText(resource["period"]); period != "" {
+			parts = append(parts, fmt.Sprintf("Period: %s", period))
+		}
+
+	case "Claim":
+		parts = append(parts, "Claim:")
+		if claimType := extractStatus(resource["type"]); claimType != "" {
+			parts = append(parts, claimType)
+		}
+		if status := extractStatus(resource["status"]); status != "" {
+			parts = append(parts, fmt.Sprintf("Status: %s", status))
+		}
+		if period := periodText(resource["billablePeriod"]); period != "" {
+			parts = append(parts, fmt.Sprintf("Billable period: %s", period))
+		}
+		var diagnoses []string
+		if list, ok := resource["diagnosis"].([]interface{}); ok {
+			for _, d := range list {
+				diagnosis, ok := d.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				text := codeableConceptText(cfg, diagnosis["diagnosisCodeableConcept"])
+				if text == "" {
+					text = refs.referenceText(cfg, diagnosis["diagnosisReference"])
+				}
+				if text != "" {
+					diagnoses = append(diagnoses, text)
+				}
+			}
+		}
+		if len(diagnoses) > 0 {
+			parts = append(parts, fmt.Sprintf("Diagnosis: %s", strings.Join(diagnoses, ", ")))
+		}
+		var items []string
+		if list, ok := resource["item"].([]interface{}); ok {
+			for _, i := range list {
+				item, ok := i.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				// STU3 names the billed code service; R4 productOrService
+				if text := codeableConceptText(cfg, versionedField(cfg, item, "productOrService", "service")); text != "" {
+					items = append(items, text)
+				}
+			}
+		}
+		if len(items) > 0 {
+			parts = append(parts, fmt.Sprintf("Items: %s", strings.Join(items, ", ")))
+		}
+
+	case "Organization":
+		parts = append(parts, "Organization:")
+		if name, ok := resource["name"].(string); ok {
+			parts = append(parts, name)
+		}
+
+	case "Provenance":
+		parts = append(parts, "Provenance:")
+		if activity := codeableConceptText(cfg, resource["activity"]); activity != "" {
+			parts = append(parts, fmt.Sprintf("Activity: %s", activity))
+		}
+		if recorded, ok := resource["recorded"].(string); ok && recorded != "" {
+			parts = append(parts, fmt.Sprintf("Recorded: %s", normalizeDate(recorded)))
+		}
+		if agents := provenanceAgentTexts(cfg, resource["agent"], refs); len(agents) > 0 {
+			parts = append(parts, fmt.Sprintf("Agents: %s", strings.Join(agents, ", ")))
+		}
+		if targets := provenanceTargetTexts(cfg, resource["target"], refs); len(targets) > 0 {
+			parts = append(parts, fmt.Sprintf("Targets: %s", strings.Join(targets, ", ")))
+		}
+
+	case "Location":
+		parts = append(parts, "Location:")
+		if name, ok := resource["name"].(string); ok && name != "" {
+			parts = append(parts, name)
+		}
+		// type is a list in R4 and a single CodeableConcept in STU3
+		if types := categoryTexts(cfg, resource["type"]); len(types) > 0 {
+			parts = append(parts, fmt.Sprintf("Type: %s", strings.Join(types, ", ")))
+		}
+		// A facility's address is not PII, so unlike a Patient's it is
+		// always included
+		if address := addressText(resource["address"]); address != "" {
+			parts = append(parts, fmt.Sprintf("Address: %s", address))
+		}
+		if organization := refs.referenceText(cfg, resource["managingOrganization"]); organization != "" {
+			parts = append(parts, fmt.Sprintf("Managed by: %s", organization))
+		}
+
+	case "HealthcareService":
+		parts = append(parts, "Healthcare Service:")
+		if name, ok := resource["name"].(string); ok && name != "" {
+			parts = append(parts, name)
+		}
+		// category is a list in R4 and a single CodeableConcept in STU3
+		if categories := categoryTexts(cfg, resource["category"]); len(categories) > 0 {
+			parts = append(parts, fmt.Sprintf("Category: %s", strings.Join(categories, ", ")))
+		}
+		if types := conceptListText(cfg, resource["type"]); len(types) > 0 {
+			parts = append(parts, fmt.Sprintf("Type: %s", strings.Join(types, ", ")))
+		}
+		if specialties := conceptListText(cfg, resource["specialty"]); len(specialties) > 0 {
+			parts = append(parts, fmt.Sprintf("Specialty: %s", strings.Join(specialties, ", ")))
+		}
+		if organization := refs.referenceText(cfg, resource["providedBy"]); organization != "" {
+			parts = append(parts, fmt.Sprintf("Provided by: %s", organization))
+		}
+
+	case "QuestionnaireResponse":
+		parts = append(parts, "Questionnaire Response:")
+		if status := extractStatus(resource["status"]); status != "" {
+			parts = append(parts, fmt.Sprintf("Status: %s", status))
+		}
+		if authored, ok := resource["authored"].(string); ok && authored != "" {
+			parts = append(parts, fmt.Sprintf("Authored: %s", normalizeDate(authored)))
+		}
+		parts = questionnaireItemParts(cfg, parts, resource["item"], refs)
+
+	default:
+		// For unknown resource types, try to extract code/text fields
+		if code := codeableConceptText(cfg, resource["code"]); code != "" {
+			parts = append(parts, code)
+		}
+	}
+
+	return parts
+}
+
+// headingOnly reports whether content parts are just the heading that
+// opens each resource type's content, such as "Clinical Observation:", with
+// no values after it.
+func headingOnly(parts []string) bool {
+	return len(parts) == 1 && isHeading(parts[0])
+}
+
+// isHeading reports whether a content part is a heading rather than a value
+// or "Label: value" field.
+func isHeading(part string) bool {
+	return strings.HasSuffix(part, ":")
+}
+
+// loadPrefixTemplates reads a -prefix-template file: a JSON object mapping
+// resourceTypes to text/template headings.
+func loadPrefixTemplates(path string) (map[string]*template.Template, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var texts map[string]string
+	if err := json.Unmarshal(data, &texts); err != nil {
+		return nil, err
+	}
+	templates := make(map[string]*template.Template, len(texts))
+	for resourceType, text := range texts {
+		tmpl, err := template.New(resourceType).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, err
+		}
+		templates[resourceType] = tmpl
+	}
+	return templates, nil
+}
+
+// applyPrefixTemplate renders tmpl with data (the record's id,
+// resourceType, fullUrl, patientId, and sourceFile, and the resource itself
+// as "resource") and puts the result in place of the built-in heading. Where
+// there is none, as for narrative, it is added before the content. An
+// empty result leaves the content without a heading.
+func applyPrefixTemplate(tmpl *template.Template, parts []string, data map[string]interface{}) ([]string, error) {
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return nil, err
+	}
+	prefix := strings.TrimSpace(b.String())
+	rest := parts
+	if isHeading(parts[0]) {
+		rest = parts[1:]
+	}
+	if prefix == "" {
+		return rest, nil
+	}
+	return append([]string{prefix}, rest...), nil
+}
+
+// prettyContent joins content parts for reading rather than embedding: the
+// heading and unlabeled values on the first line, then each "Label: value"
+// field on its own indented line, with any unlabeled values that follow it.
+func prettyContent(parts []string) string {
+	var b strings.Builder
+	for i, part := range parts {
+		switch {
+		case i == 0:
+		case isLabeled(part):
+			b.WriteString("\n  ")
+		default:
+			b.WriteString(" ")
+		}
+		b.WriteString(part)
+	}
+	return b.String()
+}
+
+// isLabeled reports whether a content part is a "Label: value" field, such
+// as "Status: active" or "Date of Birth: 1980-04-02".
+func isLabeled(part string) bool {
+	label, _, ok := strings.Cut(part, ": ")
+	if !ok || label == "" || label[0] < 'A' || label[0] > 'Z' {
+		return false
+	}
+	for _, r := range label {
+		if !unicode.IsLetter(r) && r != ' ' {
+			return false
+		}
+	}
+	return true
+}
+
+// choiceTimeText formats a FHIR choice-type timing element such as onset[x]
+// or abatement[x], checking the DateTime, Period, Age, and String variants of
+// prefix in that order. Periods render as "start to end" when both are set.
+func choiceTimeText(resource map[string]interface{}, prefix string) string {
+	if dateTime, ok := resource[prefix+"DateTime"].(string); ok && dateTime != "" {
+		return normalizeDate(dateTime)
+	}
+	if period := periodText(resource[prefix+"Period"]); period != "" {
+		return period
+	}
+	if age, ok := resource[prefix+"Age"].(map[string]interface{}); ok {
+		if value, ok := age["value"].(float64); ok {
+			if unit, ok := age["unit"].(string); ok {
+				return fmt.Sprintf("age %g %s", value, unit)
+			}
+			return fmt.Sprintf("age %g", value)
+		}
+	}
+	if text, ok := resource[prefix+"String"].(string); ok {
+		return text
+	}
+	return ""
+}
+
+// readsVersion reports whether elements named as in version ("stu3" or "r4")
+// are read under cfg's -fhir-version. Where STU3 and R4 name an element
+// differently, "stu3" and "r4" read only that release's name and "auto"
+// tries R4's and then STU3's. The elements extracted that differ are:
+//
+//	Immunization       date                    occurrence[x]
+//	Encounter          reason[]                reasonCode[], reasonReference[]
+//	DocumentReference  class                   category[]
+//	Claim.item         service                 productOrService
+//	Condition          clinicalStatus (code)   clinicalStatus (CodeableConcept)
+//	Observation        interpretation          interpretation[]
+//
+// Only renamed elements depend on the version; a status or interpretation
+// is read in whichever shape it has, since the two cannot be confused. An
+// unset FHIRVersion reads both, like "auto".
+func readsVersion(cfg *Config, version string) bool {
+	return cfg.FHIRVersion == "" || cfg.FHIRVersion == "auto" || cfg.FHIRVersion == version
+}
+
+// versionedField returns the element object names in R4 as r4 and in STU3 as
+// stu3, as -fhir-version allows; "auto" prefers R4's when both are present.
+func versionedField(cfg *Config, object map[string]interface{}, r4, stu3 string) interface{} {
+	if v, ok := object[r4]; ok && readsVersion(cfg, "r4") {
+		return v
+	}
+	if readsVersion(cfg, "stu3") {
+		return object[stu3]
+	}
+	return nil
+}
+
+// effectiveDate returns when an Observation or DiagnosticReport applies,
+// normalized: effectiveDateTime, else effectiveInstant, else the start of
+// effectivePeriod, else the issued time.
+func effectiveDate(resource map[string]interface{}) string {
+	for _, field := range []string{"effectiveDateTime", "effectiveInstant"} {
+		if date, ok := resource[field].(string); ok && date != "" {
+			return normalizeDate(date)
+		}
+	}
+	if period, ok := resource["effectivePeriod"].(map[string]interface{}); ok {
+		if start, ok := period["start"].(string); ok && start != "" {
+			return normalizeDate(start)
+		}
+	}
+	if issued, ok := resource["issued"].(string); ok {
+		return normalizeDate(issued)
+	}
+	return ""
+}
+
+// periodText formats a Period as "start to end", "start", or "until end",
+// depending on which bounds are set.
+func periodText(v interface{}) string {
+	period, ok := v.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	start, _ := period["start"].(string)
+	end, _ := period["end"].(string)
+	start, end = normalizeDate(start), normalizeDate(end)
+	switch {
+	case start != "" && end != "":
+		return fmt.Sprintf("%s to %s", start, end)
+	case start != "":
+		return start
+	case end != "":
+		return fmt.Sprintf("until %s", end)
+	}
+	return ""
+}
+
+// fhirDateLayouts are the FHIR date and dateTime forms normalizeDate accepts,
+// from least to most precise. Time zones are required on dateTimes by the
+// spec, but exports without one are common enough to accept.
+var fhirDateLayouts = []string{
+	"2006",
+	"2006-01",
+	"2006-01-02",
+	"2006-01-02T15:04:05Z07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04",
+}
+
+// parseFHIRDate parses a FHIR date or dateTime of any precision. Partial
+// dates resolve to the start of their year or month.
+func parseFHIRDate(raw string) (time.Time, bool) {
+	raw = strings.TrimSpace(raw)
+	for _, layout := range fhirDateLayouts {
+		if t, err := time.Parse(layout, raw); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// normalizeDate rewrites a FHIR date or dateTime in a consistent ISO-8601
+// form. Partial dates keep their precision ("2020", "2020-03"); dateTimes are
+// rendered to the second, dropping fractional seconds and writing UTC as "Z",
+// in their original offset so the local calendar date is preserved. Values
+// that do not parse are returned trimmed but otherwise unchanged.
+func normalizeDate(raw string) string {
+	raw = strings.TrimSpace(raw)
+	// time.Parse accepts fractional seconds after a seconds field, so the
+	// layouts above also cover "2020-03-15T10:00:00.123-05:00"
+	for i, layout := range fhirDateLayouts {
+		t, err := time.Parse(layout, raw)
+		if err != nil {
+			continue
+		}
+		switch {
+		case i < 3:
+			return t.Format(layout)
+		case strings.HasSuffix(layout, "Z07:00"):
+			return t.Format(time.RFC3339)
+		default:
+			return t.Format("2006-01-02T15:04:05")
+		}
+	}
+	return raw
+}
+
+// codeableConceptText returns the human-readable text of a CodeableConcept:
+// its text if set, otherwise the display of its first coding that has one. With
+// -include-codes it is followed by the concept's codes from clinical code
+// systems, "Asthma (SNOMED 195967001)", or is just those codes when there is
+// no text. It returns "" for anything else, so callers can pass raw resource
+// fields directly.
+func codeableConceptText(cfg *Config, v interface{}) string {
+	concept, ok := v.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	text, _ := concept["text"].(string)
+	if text == "" {
+		codings, _ := concept["coding"].([]interface{})
+		for _, c := range codings {
+			if coding, ok := c.(map[string]interface{}); ok {
+				if text, _ = coding["display"].(string); text != "" {
+					break
+				}
+			}
+		}
+	}
+	if !cfg.IncludeCodes {
+		return text
+	}
+	codes := strings.Join(codingCodes(concept["coding"]), ", ")
+	switch {
+	case codes == "":
+		return text
+	case text == "":
+		return codes
+	}
+	return fmt.Sprintf("%s (%s)", text, codes)
+}
+
+// dataAbsentText describes an Observation's dataAbsentReason: its text or
+// display, else its code with hyphens as spaces ("not-performed" gives
+// "not performed").
+func dataAbsentText(cfg *Config, v interface{}) string {
+	if text := codeableConceptText(cfg, v); text != "" {
+		return text
+	}
+	return strings.ReplaceAll(extractStatus(v), "-", " ")
+}
+
+// sentenceEnd splits narrative into the phrases compared by
+// mergeNarrativeParts.
+var sentenceEnd = regexp.MustCompile(`[.;!?]+(\s+|$)`)
+
+// mergeNarrativeParts appends narrative to the structured parts as a
+// "Narrative:" field, leaving out each sentence whose words already appear
+// in the parts or earlier in the narrative. With no structured parts the
+// narrative is returned whole.
+func mergeNarrativeParts(parts []string, narrative string) []string {
+	if len(parts) == 0 {
+		return []string{narrative}
+	}
+	seen := normalizePhrase(strings.Join(parts, " "))
+	var kept []string
+	for _, sentence := range sentenceEnd.Split(narrative, -1) {
+		phrase := normalizePhrase(sentence)
+		if phrase == "" || strings.Contains(seen, phrase) {
+			continue
+		}
+		seen += " " + phrase
+		kept = append(kept, strings.TrimSpace(sentence)+".")
+	}
+	if len(kept) == 0 {
+		return parts
+	}
+	return append(parts, "Narrative: "+strings.Join(kept, " "))
+}
+
+// normalizePhrase lowercases s and reduces it to its words, so phrases can
+// be compared regardless of case, spacing, and punctuation.
+func normalizePhrase(s string) string {
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	return strings.Join(words, " ")
+}
+
+// codeSystemNames are the clinical code systems whose codes -include-codes
+// adds to content. Codes from other systems, such as HL7's own vocabularies
+// for statuses and categories, are left out as noise.
+var codeSystemNames = map[string]string{
+	"http://snomed.info/sct":                      "SNOMED",
+	"http://loinc.org":                            "LOINC",
+	"http://www.nlm.nih.gov/research/umls/rxnorm": "RxNorm",
+	"http://hl7.org/fhir/sid/icd-10":              "ICD-10",
+	"http://hl7.org/fhir/sid/icd-10-cm":           "ICD-10-CM",
+	"http://hl7.org/fhir/sid/icd-9-cm":            "ICD-9-CM",
+	"http://hl7.org/fhir/sid/cvx":                 "CVX",
+	"http://www.ama-assn.org/go/cpt":              "CPT",
+	"http://hl7.org/fhir/sid/ndc":                 "NDC",
+}
+
+// codingCodes lists each coding's code as "SYSTEM code", for the systems in
+// codeSystemNames.
+func codingCodes(v interface{}) []string {
+	list, _ := v.([]interface{})
+	var codes []string
+	for _, c := range list {
+		coding, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		system, _ := coding["system"].(string)
+		code, _ := coding["code"].(string)
+		if name := codeSystemNames[system]; name != "" && code != "" {
+			codes = append(codes, name+" "+code)
+		}
+	}
+	return codes
+}
+
+// attachmentText returns the text of a FHIR Attachment. Inline data is
+// base64-decoded when the contentType is text/plain or text/html (HTML is
+// cleaned to plain text); other types and URL-only attachments are not
+// fetched or decoded and are represented by their title, if any.
+func attachmentText(attachment map[string]interface{}) string {
+	title, _ := attachment["title"].(string)
+	data, _ := attachment["data"].(string)
+	contentType, _ := attachment["contentType"].(string)
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	if data != "" && (mediaType == "text/plain" || mediaType == "text/html") {
+		decoded, err := base64.StdEncoding.DecodeString(data)
+		if err == nil {
+			text := string(decoded)
+			if mediaType == "text/html" {
+				text = cleanHTML(text)
+			} else {
+				text = strings.Join(strings.Fields(text), " ")
+			}
+			if text != "" {
+				return text
+			}
+		}
+	}
+	if title != "" {
+		return fmt.Sprintf("Attachment: %s", title)
+	}
+	return ""
+}
+
+// medicationText names the medication of a MedicationRequest, -Statement,
+// or -Dispense: medicationCodeableConcept, else the resolved
+// medicationReference, else R5's medication CodeableReference.
+func medicationText(cfg *Config, resource map[string]interface{}, refs resourceIndex) string {
+	if text := codeableConceptText(cfg, resource["medicationCodeableConcept"]); text != "" {
+		return text
+	}
+	if text := refs.referenceText(cfg, resource["medicationReference"]); text != "" {
+		return text
+	}
+	if medication, ok := resource["medication"].(map[string]interface{}); ok {
+		if text := codeableConceptText(cfg, medication["concept"]); text != "" {
+			return text
+		}
+		return refs.referenceText(cfg, medication["reference"])
+	}
+	return ""
+}
+
+// dosageText joins the text of each Dosage in a list such as
+// MedicationStatement.dosage or MedicationDispense.dosageInstruction.
+func dosageText(v interface{}) string {
+	list, ok := v.([]interface{})
+	if !ok {
+		return ""
+	}
+	var texts []string
+	for _, d := range list {
+		if dosage, ok := d.(map[string]interface{}); ok {
+			if text, ok := dosage["text"].(string); ok && text != "" {
+				texts = append(texts, text)
+			}
+		}
+	}
+	return strings.Join(texts, "; ")
+}
+
+// quantityText formats a Quantity as "value unit", or "" if it has no value.
+func quantityText(v interface{}) string {
+	quantity, ok := v.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	value, ok := quantity["value"].(float64)
+	if !ok {
+		return ""
+	}
+	if unit, ok := quantity["unit"].(string); ok && unit != "" {
+		return fmt.Sprintf("%g %s", value, unit)
+	}
+	return fmt.Sprintf("%g", value)
+}
+
+// referenceRangeText formats an Observation.referenceRange as "low–high
+// unit", or as ">= low"/"<= high" when it is open-ended. A range given only
+// as text is returned as is.
+func referenceRangeText(v interface{}) string {
+	r, ok := v.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	low, hasLow := rangeBound(r["low"])
+	high, hasHigh := rangeBound(r["high"])
+	unit := quantityUnit(r["high"])
+	if unit == "" {
+		unit = quantityUnit(r["low"])
+	}
+	var text string
+	switch {
+	case hasLow && hasHigh:
+		text = fmt.Sprintf("%g–%g", low, high)
+	case hasLow:
+		text = fmt.Sprintf(">= %g", low)
+	case hasHigh:
+		text = fmt.Sprintf("<= %g", high)
+	default:
+		text, _ = r["text"].(string)
+		return text
+	}
+	if unit != "" {
+		text += " " + unit
+	}
+	return text
+}
+
+// rangeBound returns the value of a Range.low or Range.high Quantity.
+func rangeBound(v interface{}) (float64, bool) {
+	quantity, ok := v.(map[string]interface{})
+	if !ok {
+		return 0, false
+	}
+	value, ok := quantity["value"].(float64)
+	return value, ok
+}
+
+// quantityUnit returns the unit of a Quantity, or "" if it has none.
+func quantityUnit(v interface{}) string {
+	if quantity, ok := v.(map[string]interface{}); ok {
+		unit, _ := quantity["unit"].(string)
+		return unit
+	}
+	return ""
+}
+
+// interpretationCodes names the common HL7 v3 ObservationInterpretation codes
+// for interpretations that carry a code but no display text.
+var interpretationCodes = map[string]string{
+	"N": "Normal", "A": "Abnormal", "AA": "Critical abnormal",
+	"H": "High", "HH": "Critical high", "L": "Low", "LL": "Critical low",
+}
+
+// interpretationText joins the texts of an Observation.interpretation list
+// (a single CodeableConcept in STU3), naming bare v3 codes.
+func interpretationText(cfg *Config, v interface{}) string {
+	list, ok := v.([]interface{})
+	if !ok {
+		list = []interface{}{v}
+	}
+	var texts []string
+	for _, item := range list {
+		text := codeableConceptText(cfg, item)
+		if text == "" {
+			code := extractStatus(item)
+			if name, ok := interpretationCodes[code]; ok {
+				text = name
+			} else {
+				text = code
+			}
+		}
+		if text != "" {
+			texts = append(texts, text)
+		}
+	}
+	return strings.Join(texts, ", ")
+}
+
+// reasonTexts lists why an Encounter, Procedure, or request happened. STU3 Encounters
+// have reason[]; R4 renames it reasonCode[] and adds reasonReference[]
+// (usually a Condition in the same Bundle, resolved through refs).
+func reasonTexts(cfg *Config, resource map[string]interface{}, refs resourceIndex) []string {
+	var reasons []string
+	if readsVersion(cfg, "stu3") {
+		if reason := codeableConceptText(cfg, resource["reason"]); reason != "" {
+			reasons = append(reasons, reason)
+		}
+		reasons = append(reasons, conceptListText(cfg, resource["reason"])...)
+	}
+	reasons = append(reasons, conceptListText(cfg, resource["reasonCode"])...)
+	if list, ok := resource["reasonReference"].([]interface{}); ok {
+		for _, ref := range list {
+			if text := refs.referenceText(cfg, ref); text != "" {
+				reasons = append(reasons, text)
+			}
+		}
+	}
+	return reasons
+}
+
+// noteTexts returns the text of each Annotation in a note[] list.
+func noteTexts(v interface{}) []string {
+	list, _ := v.([]interface{})
+	var texts []string
+	for _, n := range list {
+		note, ok := n.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if text, ok := note["text"].(string); ok && strings.TrimSpace(text) != "" {
+			texts = append(texts, strings.TrimSpace(text))
+		}
+	}
+	return texts
+}
+
+// conceptListText returns the text of each CodeableConcept in a list such as
+// category[], skipping entries with no text.
+func conceptListText(cfg *Config, v interface{}) []string {
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil
+	}
+	var texts []string
+	for _, item := range list {
+		if text := codeableConceptText(cfg, item); text != "" {
+			texts = append(texts, text)
+		}
+	}
+	return texts
+}
+
+// categoryTexts returns the categories of a resource, accepting a list of
+// CodeableConcepts (the usual R4 shape), a single CodeableConcept (as in
+// some STU3 elements), or plain codes. Categories without display text fall
+// back to their code, since category codes such as "vital-signs" are
+// readable on their own.
+func categoryTexts(cfg *Config, v interface{}) []string {
+	list, ok := v.([]interface{})
+	if !ok {
+		list = []interface{}{v}
+	}
+	var texts []string
+	for _, item := range list {
+		text := codeableConceptText(cfg, item)
+		if text == "" {
+			text = extractStatus(item)
+		}
+		if text != "" {
+			texts = append(texts, text)
+		}
+	}
+	return texts
+}
+
+// goalTargetText formats a Goal.target as "measure detail by dueDate",
+// omitting whichever parts are absent. detail[x] is read like an Observation
+// value, with detailQuantity, detailCodeableConcept, detailString, and
+// detailBoolean supported.
+func goalTargetText(cfg *Config, target map[string]interface{}) string {
+	var words []string
+	if measure := codeableConceptText(cfg, target["measure"]); measure != "" {
+		words = append(words, measure)
+	}
+	detail := observationValue(cfg, map[string]interface{}{
+		"valueQuantity":        target["detailQuantity"],
+		"valueCodeableConcept": target["detailCodeableConcept"],
+		"valueString":          target["detailString"],
+		"valueBoolean":         target["detailBoolean"],
+	})
+	if detail != "" {
+		words = append(words, detail)
+	}
+	if due, ok := target["dueDate"].(string); ok && due != "" {
+		words = append(words, "by", normalizeDate(due))
+	}
+	return strings.Join(words, " ")
+}
+
+// observationValue formats the value[x] of an Observation or one of its
+// components: valueQuantity, valueCodeableConcept, valueString,
+// valueInteger, valueDateTime, or valueBoolean. It returns "" when no supported value is present.
+func observationValue(cfg *Config, obs map[string]interface{}) string {
+	if valueQty, ok := obs["valueQuantity"].(map[string]interface{}); ok {
+		if value, ok := valueQty["value"].(float64); ok {
+			if unit, ok := valueQty["unit"].(string); ok {
+				return fmt.Sprintf("%.2f %s", value, unit)
+			}
+			return fmt.Sprintf("%.2f", value)
+		}
+	}
+	if concept := codeableConceptText(cfg, obs["valueCodeableConcept"]); concept != "" {
+		return concept
+	}
+	if value, ok := obs["valueString"].(string); ok {
+		return value
+	}
+	// Social-history answers such as pack-years or a quit date
+	if value, ok := obs["valueInteger"].(float64); ok {
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	if value, ok := obs["valueDateTime"].(string); ok {
+		return normalizeDate(value)
+	}
+	if value, ok := obs["valueBoolean"].(bool); ok {
+		if value {
+			return "Yes"
+		}
+		return "No"
+	}
+	return ""
+}
+
+// resultText summarizes an Observation in DiagnosticReport.result as "name
+// value (interpretation)". The Observation is looked up among the report's
+// contained resources for "#id" references and through refs otherwise; an
+// unresolved reference contributes its display text.
+func resultText(cfg *Config, report map[string]interface{}, ref interface{}, refs resourceIndex) string {
+	obs := refs.resolve(ref)
+	if refObj, ok := ref.(map[string]interface{}); ok {
+		if reference, _ := refObj["reference"].(string); strings.HasPrefix(reference, "#") {
+			obs = containedResource(report, strings.TrimPrefix(reference, "#"))
+		}
+	}
+	if obs == nil {
+		return refs.referenceText(cfg, ref)
+	}
+	var parts []string
+	if name := codeableConceptText(cfg, obs["code"]); name != "" {
+		parts = append(parts, name)
+	}
+	if value := observationValue(cfg, obs); value != "" {
+		parts = append(parts, value)
+	}
+	if interpretation := interpretationText(cfg, obs["interpretation"]); interpretation != "" {
+		parts = append(parts, fmt.Sprintf("(%s)", interpretation))
+	}
+	return strings.Join(parts, " ")
+}
+
+// containedResource returns the resource in resource.contained with the
+// given id, or nil.
+func containedResource(resource map[string]interface{}, id string) map[string]interface{} {
+	contained, ok := resource["contained"].([]interface{})
+	if !ok {
+		return nil
+	}
+	for _, c := range contained {
+		if r, ok := c.(map[string]interface{}); ok && r["id"] == id {
+			return r
+		}
+	}
+	return nil
+}
+
+// US Core Patient extensions for OMB race and ethnicity categories.
+const (
+	usCoreRaceURL      = "http://hl7.org/fhir/us/core/StructureDefinition/us-core-race"
+	usCoreEthnicityURL = "http://hl7.org/fhir/us/core/StructureDefinition/us-core-ethnicity"
+)
+
+// usCoreCategoryText reads a US Core race or ethnicity extension from a
+// Patient: its "text" sub-extension if present, otherwise the displays of its
+// "ombCategory" and then "detailed" codings, joined with commas.
+func usCoreCategoryText(resource map[string]interface{}, url string) string {
+	extensions, ok := resource["extension"].([]interface{})
+	if !ok {
+		return ""
+	}
+	for _, e := range extensions {
+		ext, ok := e.(map[string]interface{})
+		if !ok || ext["url"] != url {
+			continue
+		}
+		subExtensions, _ := ext["extension"].([]interface{})
+		var text string
+		codings := make(map[string][]string) // by sub-extension url
+		for _, se := range subExtensions {
+			sub, ok := se.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			subURL, _ := sub["url"].(string)
+			if subURL == "text" {
+				text, _ = sub["valueString"].(string)
+			} else if coding, ok := sub["valueCoding"].(map[string]interface{}); ok {
+				if display, ok := coding["display"].(string); ok && display != "" {
+					codings[subURL] = append(codings[subURL], display)
+				}
+			}
+		}
+		if text != "" {
+			return text
+		}
+		return strings.Join(append(codings["ombCategory"], codings["detailed"]...), ", ")
+	}
+	return ""
+}
+
+// humanName formats a FHIR HumanName list as a readable full name. The
+// "official" name is preferred over other uses; within it, name.text wins,
+// otherwise prefix, all given names, family, and suffix are joined in order.
+func humanName(names []interface{}) string {
+	var chosen map[string]interface{}
+	for _, n := range names {
+		nameObj, ok := n.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if chosen == nil {
+			chosen = nameObj
+		}
+		if use, _ := nameObj["use"].(string); use == "official" {
+			chosen = nameObj
+			break
+		}
+	}
+	if chosen == nil {
+		return ""
+	}
+
+	if text, ok := chosen["text"].(string); ok && strings.TrimSpace(text) != "" {
+		return strings.TrimSpace(text)
+	}
+
+	var words []string
+	appendStrings := func(v interface{}) {
+		if list, ok := v.([]interface{}); ok {
+			for _, item := range list {
+				if str, ok := item.(string); ok && str != "" {
+					words = append(words, str)
+				}
+			}
+		}
+	}
+	appendStrings(chosen["prefix"])
+	appendStrings(chosen["given"])
+	if family, ok := chosen["family"].(string); ok && family != "" {
+		words = append(words, family)
+	}
+	appendStrings(chosen["suffix"])
+
+	return strings.Join(words, " ")
+}
+
+// addressText formats a Patient's home address (or its first address, if
+// none is marked home) as a single line: "12 Main St, Boston, MA 02101, US".
+// A single Address, as in Location.address, is formatted the same way.
+func addressText(v interface{}) string {
+	list, _ := v.([]interface{})
+	if address, ok := v.(map[string]interface{}); ok {
+		list = []interface{}{address}
+	}
+	var chosen map[string]interface{}
+	for _, a := range list {
+		address, ok := a.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if chosen == nil {
+			chosen = address
+		}
+		if use, _ := address["use"].(string); use == "home" {
+			chosen = address
+			break
+		}
+	}
+	if chosen == nil {
+		return ""
+	}
+	if text, ok := chosen["text"].(string); ok && strings.TrimSpace(text) != "" {
+		return strings.TrimSpace(text)
+	}
+
+	var fields []string
+	if lines, ok := chosen["line"].([]interface{}); ok {
+		for _, line := range lines {
+			if str, ok := line.(string); ok && str != "" {
+				fields = append(fields, str)
+			}
+		}
+	}
+	if city, ok := chosen["city"].(string); ok && city != "" {
+		fields = append(fields, city)
+	}
+	state, _ := chosen["state"].(string)
+	postalCode, _ := chosen["postalCode"].(string)
+	if region := strings.TrimSpace(state + " " + postalCode); region != "" {
+		fields = append(fields, region)
+	}
+	if country, ok := chosen["country"].(string); ok && country != "" {
+		fields = append(fields, country)
+	}
+	return strings.Join(fields, ", ")
+}
+
+// telecomTexts lists a Patient's phone numbers and email addresses, labeled
+// "Phone:" or "Email:" and with their use when given ("Home phone: ...").
+func telecomTexts(v interface{}) []string {
+	list, _ := v.([]interface{})
+	var texts []string
+	for _, t := range list {
+		contact, ok := t.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		value, _ := contact["value"].(string)
+		if value == "" {
+			continue
+		}
+		label := "phone"
+		switch system, _ := contact["system"].(string); system {
+		case "email":
+			label = "email"
+		case "phone", "sms", "":
+		default:
+			continue
+		}
+		if use, ok := contact["use"].(string); ok && use != "" {
+			label = use + " " + label
+		}
+		label = strings.ToUpper(label[:1]) + label[1:]
+		texts = append(texts, fmt.Sprintf("%s: %s", label, value))
+	}
+	return texts
+}
+
+// maritalStatusCodes names the HL7 v3 MaritalStatus codes, which Synthea
+// uses as the display text too.
+var maritalStatusCodes = map[string]string{
+	"A": "Annulled", "D": "Divorced", "I": "Interlocutory", "L": "Legally separated",
+	"M": "Married", "P": "Polygamous", "S": "Never married", "T": "Domestic partner",
+	"U": "Unmarried", "W": "Widowed", "UNK": "Unknown",
+}
+
+// maritalStatusText returns a Patient's maritalStatus, naming bare v3 codes.
+func maritalStatusText(cfg *Config, v interface{}) string {
+	text := codeableConceptText(cfg, v)
+	if text == "" {
+		text = extractStatus(v)
+	}
+	if name, ok := maritalStatusCodes[text]; ok {
+		return name
+	}
+	return text
+}
+
+// extractStatus returns a status code from either a plain string (STU3 and
+// older data) or a CodeableConcept (R4), preferring coding[0].code over text.
+func extractStatus(v interface{}) string {
+	switch status := v.(type) {
+	case string:
+		return status
+	case map[string]interface{}:
+		if coding, ok := status["coding"].([]interface{}); ok && len(coding) > 0 {
+			if codingObj, ok := coding[0].(map[string]interface{}); ok {
+				if code, ok := codingObj["code"].(string); ok && code != "" {
+					return code
+				}
+			}
+		}
+		if text, ok := status["text"].(string); ok {
+			return text
+		}
+	}
+	return ""
+}
+
+// blockTags are the elements whose boundaries separate words in rendered
+// text. Table cells are included so FHIR narrative tables keep their columns
+// apart instead of running values together.
+var blockTags = map[string]bool{
+	"address": true, "article": true, "blockquote": true, "br": true,
+	"caption": true, "dd": true, "div": true, "dl": true, "dt": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"hr": true, "li": true, "ol": true, "p": true, "pre": true,
+	"section": true, "table": true, "tbody": true, "td": true, "tfoot": true,
+	"th": true, "thead": true, "tr": true, "ul": true,
+}
+
+// cleanHTML converts an XHTML narrative (text.div) to plain text. It parses
+// the markup as HTML, then walks the node tree collecting text: comments and
+// script/style bodies are dropped, block and table-cell content is separated
+// with spaces, and whitespace is collapsed. The parser has already decoded
+// entities.
+func cleanHTML(markup string) string {
+	doc, err := html.Parse(strings.NewReader(markup))
+	if err != nil {
+		return ""
+	}
+
+	var b strings.Builder
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		switch n.Type {
+		case html.TextNode:
+			b.WriteString(n.Data)
+			return
+		case html.CommentNode:
+			return
+		case html.ElementNode:
+			if n.Data == "script" || n.Data == "style" {
+				return
+			}
+		}
+		block := n.Type == html.ElementNode && blockTags[n.Data]
+		if block {
+			b.WriteByte(' ')
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+		if block {
+			b.WriteByte(' ')
+		}
+	}
+	walk(doc)
+
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+// jsonlFile appends records to a file as JSON lines. Writes are serialized so
+// concurrent workers never interleave partial lines.
+type jsonlFile struct {
+	mu sync.Mutex
+	f  *os.File
+	w  *bufio.Writer
+}
+
+func openJSONLFile(path string) (*jsonlFile, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonlFile{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+// Write appends v as a single JSON line.
+func (j *jsonlFile) Write(v any) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Flush writes buffered lines to the file.
+func (j *jsonlFile) Flush() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.w.Flush()
+}
+
+// Close flushes buffered lines and closes the file.
+func (j *jsonlFile) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.w.Flush(); err != nil {
+		j.f.Close()
+		return err
+	}
+	return j.f.Close()
+}
+
+// printRecord writes a record to stdout as indented JSON for -dry-run. The
+// raw resourceJson is omitted since it only repeats the input file, and the
+// idempotencyKey the record would be sent with and the estimatedTokens of its
+// content are shown.
+func printRecord(data map[string]string, estimateTokens tokenEstimator) {
+	view := make(map[string]string, len(data))
+	for k, v := range data {
+		if k != "resourceJson" {
+			view[k] = v
+		}
+	}
+	view["idempotencyKey"] = idempotencyKey(data)
+	view["estimatedTokens"] = strconv.Itoa(estimateTokens(data["content"]))
+	out, err := json.MarshalIndent(view, "", "  ")
+	if err != nil {
+		logger.Error(fmt.Sprintf("Error marshaling data: %v", err), "error", err)
+		return
+	}
+	// A single write keeps records from interleaving across workers
+	os.Stdout.Write(append(out, '\n'))
+}
+
+// checkPipelineHealth GETs cfg.HealthURL and returns an error unless it
+// answers with a 2xx status within cfg.RequestTimeout.
+func checkPipelineHealth(ctx context.Context, cfg *Config, client *http.Client) error {
+	ctx, cancel := context.WithTimeout(ctx, cfg.RequestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cfg.HealthURL, nil)
+	if err != nil {
+		return fmt.Errorf("error building health request: %w", err)
+	}
+	setPipelineHeaders(req, cfg)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned status %d", cfg.HealthURL, resp.StatusCode)
+	}
+	return nil
+}
+
+// setPipelineHeaders adds the JSON content type (for requests with a body),
+// any -header values, and the -auth-token bearer token to a pipeline
+// request. The token is set last so a -header cannot replace it.
+func setPipelineHeaders(req *http.Request, cfg *Config) {
+	if req.Body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for key, values := range cfg.Headers {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	if cfg.AuthToken != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.AuthToken)
+	}
+}
+
+// idempotencyKey derives the Idempotency-Key sent with a record from its
+// sourceFile and resourceType/id, so a record sent again (by a later run or
+// a dead-letter replay) carries the same key and the pipeline can drop the
+// repeat.
+func idempotencyKey(record map[string]string) string {
+	sum := sha256.Sum256([]byte(record["sourceFile"] + "\x00" + record["resourceType"] + "/" + record["id"]))
+	return hex.EncodeToString(sum[:])
+}
+
+// Sink is where records are delivered: the pipeline's ingest endpoint, the
+// -output-file, a Kafka topic, or stdout for -dry-run. Send returns an
+// *IngestError for a record the destination did not accept; recordSender
+// does the logging, counting, and dead-lettering for every Sink alike. Send
+// is called from many workers at once. Flush is called as each input file
+// finishes and Close once at the end of the run.
+type Sink interface {
+	Send(ctx context.Context, record map[string]string) error
+	Flush() error
+	Close() error
+}
+
+// fileFinisher is implemented by sinks that keep state for each input file;
+// finishFile releases it once the file has been processed.
+type fileFinisher interface {
+	finishFile(sourceFile string) error
+}
+
+// openSink returns the Sink the run's records go to, as chosen by -dry-run,
+// -output-file, -output-dir, and -sink. dataDir is the directory input files
+// are found in.
+func openSink(cfg *Config, state *runState, dataDir string) (Sink, error) {
+	switch {
+	case cfg.DryRun:
+		return stdoutSink{state.estimateTokens}, nil
+	case cfg.OutputDir != "":
+		return newOutputDirSink(cfg.OutputDir, dataDir), nil
+	case cfg.OutputFile != "":
+		file, err := openJSONLFile(cfg.OutputFile)
+		if err != nil {
+			return nil, err
+		}
+		return fileSink{file}, nil
+	case cfg.Sink == "kafka" && len(cfg.KafkaRESTURLs) > 0:
+		return kafkaRESTSink{cfg, state}, nil
+	case cfg.Sink == "kafka":
+		return newKafkaSink(cfg, state), nil
+	case cfg.Sink == "grpc":
+		return newGRPCSink(cfg, state)
+	}
+	return httpSink{cfg, state}, nil
+}
+
+// isLocalSink reports whether sink only prints or saves records. Records
+// sent to it are not logged one by one, nor remembered for -incremental,
+// since the pipeline has not seen them.
+func isLocalSink(sink Sink) bool {
+	switch sink.(type) {
+	case stdoutSink, fileSink, *outputDirSink:
+		return true
+	}
+	return false
+}
+
+// httpSink POSTs each record to the pipeline's ingest endpoint.
+type httpSink struct {
+	cfg   *Config
+	state *runState
+}
+
+func (s httpSink) Send(ctx context.Context, record map[string]string) error {
+	return sendToPipeline(ctx, s.cfg, s.state, record)
+}
+
+func (httpSink) Flush() error { return nil }
+
+func (httpSink) Close() error { return nil }
+
+// fileSink appends each record to the -output-file.
+type fileSink struct{ file *jsonlFile }
+
+func (s fileSink) Send(_ context.Context, record map[string]string) error {
+	if err := s.file.Write(record); err != nil {
+		return &IngestError{Err: fmt.Errorf("error writing record: %w", err)}
+	}
+	return nil
+}
+
+func (s fileSink) Flush() error { return s.file.Flush() }
+
+func (s fileSink) Close() error { return s.file.Close() }
+
+// outputDirSink writes the records from each input file to a file of their
+// own for -output-dir, mirroring the data directory: records from
+// <dataDir>/a/b.json go to <dir>/a/b.json.extracted.jsonl. Output files are
+// created (replacing any from an earlier run) on the first record and closed
+// when the input file is finished.
+type outputDirSink struct {
+	dir, dataDir string
+
+	mu      sync.Mutex
+	open    map[string]*jsonlFile // by sourceFile
+	outputs map[string]string     // sourceFile by lower-cased output path
+	paths   map[string]string     // output path by sourceFile
+}
+
+func newOutputDirSink(dir, dataDir string) *outputDirSink {
+	return &outputDirSink{dir: dir, dataDir: dataDir, open: make(map[string]*jsonlFile),
+		outputs: make(map[string]string), paths: make(map[string]string)}
+}
+
+func (s *outputDirSink) Send(_ context.Context, record map[string]string) error {
+	file, err := s.file(record["sourceFile"])
+	if err == nil {
+		err = file.Write(record)
+	}
+	if err != nil {
+		return &IngestError{Err: fmt.Errorf("error writing record: %w", err)}
+	}
+	return nil
+}
+
+// file returns the open output file for sourceFile, creating it and any
+// missing directories on first use.
+func (s *outputDirSink) file(sourceFile string) (*jsonlFile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if file, ok := s.open[sourceFile]; ok {
+		return file, nil
+	}
+	path, seen := s.paths[sourceFile]
+	if !seen {
+		path = s.outputPath(sourceFile)
+		s.paths[sourceFile] = path
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if seen {
+		// Records for a finished file, as from a -replay, are added to it
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	f, err := os.OpenFile(path, flags, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	file := &jsonlFile{f: f, w: bufio.NewWriter(f)}
+	s.open[sourceFile] = file
+	return file, nil
+}
+
+// outputPath maps sourceFile to its path under the output directory. Files
+// outside the data directory, such as standard input, go at the top level.
+// Paths that would collide with another file's (on a case-insensitive file
+// system too) get a "-2", "-3", ... suffix.
+func (s *outputDirSink) outputPath(sourceFile string) string {
+	rel, err := filepath.Rel(s.dataDir, sourceFile)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		rel = filepath.Base(sourceFile)
+	}
+	base := filepath.Join(s.dir, rel)
+	path := base + ".extracted.jsonl"
+	for n := 2; ; n++ {
+		if other, taken := s.outputs[strings.ToLower(path)]; !taken || other == sourceFile {
+			break
+		}
+		path = fmt.Sprintf("%s-%d.extracted.jsonl", base, n)
+	}
+	s.outputs[strings.ToLower(path)] = sourceFile
+	return path
+}
+
+func (s *outputDirSink) finishFile(sourceFile string) error {
+	s.mu.Lock()
+	file, ok := s.open[sourceFile]
+	delete(s.open, sourceFile)
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return file.Close()
+}
+
+func (s *outputDirSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, file := range s.open {
+		if err := file.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *outputDirSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	for sourceFile, file := range s.open {
+		errs = append(errs, file.Close())
+		delete(s.open, sourceFile)
+	}
+	return errors.Join(errs...)
+}
+
+// stdoutSink prints each record for -dry-run.
+type stdoutSink struct{ estimateTokens tokenEstimator }
+
+func (s stdoutSink) Send(_ context.Context, record map[string]string) error {
+	printRecord(record, s.estimateTokens)
+	return nil
+}
+
+func (stdoutSink) Flush() error { return nil }
+
+func (stdoutSink) Close() error { return nil }
+
+// kafkaSink publishes each record to -kafka-topic on the -kafka-brokers as
+// a JSON message keyed by patientId, so a patient's records land in one
+// partition in order.
+type kafkaSink struct {
+	cfg    *Config
+	state  *runState
+	writer kafkaWriter
+}
+
+// kafkaWriter is the part of *kafka.Writer kafkaSink uses.
+type kafkaWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+func newKafkaSink(cfg *Config, state *runState) *kafkaSink {
+	return &kafkaSink{cfg: cfg, state: state, writer: &kafka.Writer{
+		Addr:  kafka.TCP(cfg.KafkaBrokers...),
+		Topic: cfg.KafkaTopic,
+		// The Java client's partitioner, so keys map to the same
+		// partitions as with -kafka-rest-urls
+		Balancer:     &kafka.Murmur2Balancer{},
+		RequiredAcks: kafka.RequireAll,
+		// Workers send one record at a time; a short linger still lets
+		// concurrent sends share a produce request
+		BatchTimeout: 10 * time.Millisecond,
+		WriteTimeout: cfg.RequestTimeout,
+	}}
+}
+
+func (s *kafkaSink) Send(ctx context.Context, record map[string]string) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("error marshaling data: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.RequestTimeout)
+	defer cancel()
+	if err := s.state.pacer.wait(ctx); err != nil {
+		return &IngestError{Err: err}
+	}
+
+	start := time.Now()
+	err = s.writer.WriteMessages(ctx, kafka.Message{Key: []byte(record["patientId"]), Value: value})
+	s.state.metrics.observeRequest(time.Since(start))
+	if err != nil {
+		return &IngestError{Err: fmt.Errorf("error publishing to Kafka: %w", err)}
+	}
+	return nil
+}
+
+func (*kafkaSink) Flush() error { return nil }
+
+func (s *kafkaSink) Close() error {
+	return s.writer.Close()
+}
+
+// kafkaRESTSink publishes records like kafkaSink, but through a Kafka REST
+// Proxy (the -kafka-rest-urls) for deployments where the brokers are not
+// reachable directly.
+type kafkaRESTSink struct {
+	cfg   *Config
+	state *runState
+}
+
+// kafkaResponse is the REST Proxy's answer to a produce request: one offset
+// per record, with ErrorCode set for a record the broker refused.
+type kafkaResponse struct {
+	Offsets []struct {
+		ErrorCode *int   `json:"error_code"`
+		Error     string `json:"error"`
+	} `json:"offsets"`
+}
+
+func (s kafkaRESTSink) Send(ctx context.Context, record map[string]string) error {
+	type message struct {
+		Key   string            `json:"key,omitempty"`
+		Value map[string]string `json:"value"`
+	}
+	body := struct {
+		Records []message `json:"records"`
+	}{[]message{{Key: record["patientId"], Value: record}}}
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("error marshaling data: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.RequestTimeout)
+	defer cancel()
+
+	base := s.state.endpoints.pick(s.cfg.KafkaRESTURLs[0])
+	url := strings.TrimSuffix(base, "/") + "/topics/" + s.cfg.KafkaTopic
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(jsonData))
+	if err != nil {
+		return fmt.Errorf("error building request: %w", err)
+	}
+	setPipelineHeaders(req, s.cfg)
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+
+	start := time.Now()
+	resp, err := s.state.httpClient.Do(req)
+	s.state.metrics.observeRequest(time.Since(start))
+	s.state.endpoints.report(base, err == nil && resp.StatusCode < 500)
+	if err != nil {
+		return &IngestError{Err: fmt.Errorf("error publishing to Kafka: %w", err)}
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error reading Kafka REST Proxy response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &IngestError{StatusCode: resp.StatusCode}
+	}
+	var parsed kafkaResponse
+	if json.Unmarshal(respBody, &parsed) == nil {
+		for _, offset := range parsed.Offsets {
+			if offset.ErrorCode != nil {
+				return &IngestError{Err: fmt.Errorf("kafka error %d: %s", *offset.ErrorCode, offset.Error)}
+			}
+		}
+	}
+	return nil
+}
+
+func (kafkaRESTSink) Flush() error { return nil }
+
+func (kafkaRESTSink) Close() error { return nil }
+
+//go:generate protoc --go_out=. --go_opt=module=github.com/rsanandres/hc_ai/POC_embeddings --go-grpc_out=. --go-grpc_opt=module=github.com/rsanandres/hc_ai/POC_embeddings ingest.proto
+
+// grpcSink calls the pipeline's gRPC Ingest method for each record through
+// the client generated from ingest.proto (see the ingestpb package).
+type grpcSink struct {
+	cfg    *Config
+	state  *runState
+	conn   *grpc.ClientConn
+	client ingestpb.IngestServiceClient
+}
+
+func newGRPCSink(cfg *Config, state *runState) (*grpcSink, error) {
+	creds := insecure.NewCredentials()
+	if cfg.GRPCTLS {
+		creds = credentials.NewTLS(&tls.Config{})
+	}
+	pacer := state.pacer
+	options := []grpc.DialOption{
+		grpc.WithTransportCredentials(creds),
+		grpc.WithUnaryInterceptor(func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			if err := pacer.wait(ctx); err != nil {
+				return err
+			}
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}),
+	}
+	if cfg.Compress {
+		options = append(options, grpc.WithDefaultCallOptions(grpc.UseCompressor(grpcgzip.Name)))
+	}
+	conn, err := grpc.NewClient(cfg.GRPCAddr, options...)
+	if err != nil {
+		return nil, fmt.Errorf("-grpc-addr %s: %w", cfg.GRPCAddr, err)
+	}
+	return &grpcSink{cfg: cfg, state: state, conn: conn, client: ingestpb.NewIngestServiceClient(conn)}, nil
+}
+
+// Send makes one Ingest call, bounded by cfg.RequestTimeout; gRPC passes
+// the deadline on to the server as grpc-timeout.
+func (s *grpcSink) Send(ctx context.Context, record map[string]string) error {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.RequestTimeout)
+	defer cancel()
+	ctx = metadata.NewOutgoingContext(ctx, pipelineMetadata(s.cfg))
+
+	start := time.Now()
+	_, err := s.client.Ingest(ctx, ingestRequest(record))
+	s.state.metrics.observeRequest(time.Since(start))
+	if err != nil {
+		st := status.Convert(err)
+		return &IngestError{StatusCode: grpcHTTPStatus[st.Code()], Err: fmt.Errorf("gRPC status %s: %s", st.Code(), st.Message())}
+	}
+	return nil
+}
+
+// grpcHTTPStatus maps gRPC status codes to the HTTP status an http sink
+// would have reported, so failures and dead letters read the same for
+// either sink. Codes without a close HTTP equivalent are left out.
+var grpcHTTPStatus = map[codes.Code]int{
+	codes.InvalidArgument:    http.StatusBadRequest,
+	codes.FailedPrecondition: http.StatusBadRequest,
+	codes.OutOfRange:         http.StatusBadRequest,
+	codes.Unauthenticated:    http.StatusUnauthorized,
+	codes.PermissionDenied:   http.StatusForbidden,
+	codes.NotFound:           http.StatusNotFound,
+	codes.AlreadyExists:      http.StatusConflict,
+	codes.Aborted:            http.StatusConflict,
+	codes.ResourceExhausted:  http.StatusTooManyRequests,
+	codes.Canceled:           499,
+	codes.Internal:           http.StatusInternalServerError,
+	codes.Unknown:            http.StatusInternalServerError,
+	codes.DataLoss:           http.StatusInternalServerError,
+	codes.Unimplemented:      http.StatusNotImplemented,
+	codes.Unavailable:        http.StatusServiceUnavailable,
+	codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+}
+
+func (*grpcSink) Flush() error { return nil }
+
+func (s *grpcSink) Close() error {
+	return s.conn.Close()
+}
+
+// pipelineMetadata is the gRPC counterpart of setPipelineHeaders: -header
+// values and the -auth-token, sent as call metadata.
+func pipelineMetadata(cfg *Config) metadata.MD {
+	md := metadata.MD{}
+	for key, values := range cfg.Headers {
+		md.Append(key, values...)
+	}
+	if cfg.AuthToken != "" {
+		md.Set("authorization", "Bearer "+cfg.AuthToken)
+	}
+	return md
+}
+
+// ingestRequest converts record to an IngestRequest. Record fields without
+// an IngestRequest field of their own, such as sourceLine or embedding, go
+// in its metadata map.
+func ingestRequest(record map[string]string) *ingestpb.IngestRequest {
+	req := &ingestpb.IngestRequest{
+		Id:           record["id"],
+		FullUrl:      record["fullUrl"],
+		ResourceType: record["resourceType"],
+		Content:      record["content"],
+		PatientId:    record["patientId"],
+		ResourceJson: record["resourceJson"],
+		SourceFile:   record["sourceFile"],
+	}
+	for key, value := range record {
+		switch key {
+		case "id", "fullUrl", "resourceType", "content", "patientId", "resourceJson", "sourceFile":
+		default:
+			if req.Metadata == nil {
+				req.Metadata = make(map[string]string)
+			}
+			req.Metadata[key] = value
+		}
+	}
+	return req
+}
+
+// IngestError reports a record or batch the pipeline did not accept:
+// StatusCode is set for a non-200 response, and Err holds the connection
+// error or the reason the pipeline gave for rejecting it. A failed gRPC
+// call sets both.
+type IngestError struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *IngestError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("pipeline returned status %d", e.StatusCode)
+	}
+	return e.Err.Error()
+}
+
+func (e *IngestError) Unwrap() error { return e.Err }
+
+// sendToPipeline POSTs a single record to the ingest endpoint, with its
+// idempotencyKey as the Idempotency-Key header, and returns an error if it
+// was not accepted as an *IngestError. The
+// request is bounded by cfg.RequestTimeout and aborted early if ctx is
+// cancelled. Logging is left to the caller.
+func sendToPipeline(ctx context.Context, cfg *Config, state *runState, data map[string]string) error {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("error marshaling data: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.RequestTimeout)
+	defer cancel()
+
+	base, pooled := pipelineBase(cfg, state.endpoints, data["resourceType"])
+	req, err := newIngestRequest(ctx, cfg, joinURLPath(base, cfg.PipelinePath), jsonData)
+	if err != nil {
+		return fmt.Errorf("error building request: %w", err)
+	}
+	req.Header.Set("Idempotency-Key", idempotencyKey(data))
+
+	start := time.Now()
+	resp, err := state.httpClient.Do(req)
+	state.metrics.observeRequest(time.Since(start))
+	if pooled {
+		state.endpoints.report(base, err == nil && resp.StatusCode < 500)
+	}
+	if err != nil {
+		return &IngestError{Err: fmt.Errorf("error sending to pipeline: %w", err)}
+	}
+	defer resp.Body.Close()
+	// Drain the body so the connection can be reused by the pool
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return &IngestError{StatusCode: resp.StatusCode}
+	}
+	return nil
+}
+
+// newIngestRequest builds a POST of the JSON body to an ingest endpoint with
+// the pipeline headers. With -compress-requests the body is gzipped and sent
+// with Content-Encoding: gzip.
+func newIngestRequest(ctx context.Context, cfg *Config, url string, body []byte) (*http.Request, error) {
+	encoding := ""
+	if cfg.Compress {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(body); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		body, encoding = buf.Bytes(), "gzip"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	setPipelineHeaders(req, cfg)
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	return req, nil
+}
+
+// pipelineBase returns the pipeline base URL for a record of resourceType:
+// its -route if it has one, otherwise the next of the -pipeline-urls or
+// -pipeline-url. pooled reports whether the URL came from the endpoint pool,
+// and so whether the outcome should be reported back to it.
+func pipelineBase(cfg *Config, endpoints *endpointPool, resourceType string) (base string, pooled bool) {
+	if url, ok := cfg.Routes[resourceType]; ok {
+		return url, false
+	}
+	return endpoints.pick(cfg.PipelineURL), true
+}
+
+// joinURLPath appends path to the base URL with exactly one slash between
+// them, so "http://host/api/" and "/ingest" give "http://host/api/ingest".
+// An empty path leaves base as it is.
+func joinURLPath(base, path string) string {
+	if path == "" {
+		return base
+	}
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(path, "/")
+}
+
+// embeddingsRequest and embeddingsResponse are the bodies of an
+// OpenAI-compatible embeddings call. Error is set instead of Data when the
+// call fails.
+type embeddingsRequest struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+type embeddingsResponse struct {
+	Data []struct {
+		Index     int       `json:"index"`
+		Embedding []float64 `json:"embedding"`
+	} `json:"data"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// requestEmbeddings POSTs inputs to -embed-endpoint and returns their
+// vectors, in the same order. The request is bounded by cfg.RequestTimeout
+// and goes through the run's client, so -rate-limit and Retry-After on 429
+// responses apply to it as they do to the pipeline.
+func requestEmbeddings(ctx context.Context, cfg *Config, client *http.Client, inputs []string) ([][]float64, error) {
+	jsonData, err := json.Marshal(embeddingsRequest{Model: cfg.EmbedModel, Input: inputs})
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling embeddings request: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.RequestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.EmbedEndpoint, bytes.NewReader(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("error building embeddings request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if cfg.EmbedAPIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.EmbedAPIKey)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error requesting embeddings: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading embeddings response: %w", err)
+	}
+	var parsed embeddingsResponse
+	parseErr := json.Unmarshal(body, &parsed)
+	if resp.StatusCode != http.StatusOK {
+		if parseErr == nil && parsed.Error != nil && parsed.Error.Message != "" {
+			return nil, fmt.Errorf("embeddings endpoint returned status %d: %s", resp.StatusCode, parsed.Error.Message)
+		}
+		return nil, fmt.Errorf("embeddings endpoint returned status %d", resp.StatusCode)
+	}
+	if parseErr != nil {
+		return nil, fmt.Errorf("error parsing embeddings response: %w", parseErr)
+	}
+
+	vectors := make([][]float64, len(inputs))
+	for _, d := range parsed.Data {
+		if d.Index < 0 || d.Index >= len(inputs) {
+			return nil, fmt.Errorf("embeddings response has index %d for %d inputs", d.Index, len(inputs))
+		}
+		vectors[d.Index] = d.Embedding
+	}
+	for i, vector := range vectors {
+		if len(vector) == 0 {
+			return nil, fmt.Errorf("embeddings response has no vector for input %d", i)
+		}
+	}
+	return vectors, nil
+}
+
+// batchResponse is the optional body returned by the batch endpoint. Records
+// listed in Failed were rejected; all others were accepted.
+type batchResponse struct {
+	Failed []struct {
+		ID    string `json:"id"`
+		Error string `json:"error"`
+	} `json:"failed"`
+}
+
+// sendBatchToPipeline POSTs records as a JSON array to
+// <pipeline-url><pipeline-path>/batch, or the -route base URL of their
+// resourceType; the caller batches routed records apart.
+// A non-200 status fails the whole batch and is returned as an error;
+// otherwise the returned map holds the ids the pipeline rejected, with reasons.
+func sendBatchToPipeline(ctx context.Context, cfg *Config, state *runState, records []map[string]string) (map[string]string, error) {
+	jsonData, err := json.Marshal(records)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling batch: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.RequestTimeout)
+	defer cancel()
+
+	base, pooled := pipelineBase(cfg, state.endpoints, records[0]["resourceType"])
+	url := joinURLPath(base, strings.TrimSuffix(cfg.PipelinePath, "/")+"/batch")
+	req, err := newIngestRequest(ctx, cfg, url, jsonData)
+	if err != nil {
+		return nil, fmt.Errorf("error building request: %w", err)
+	}
+
+	start := time.Now()
+	resp, err := state.httpClient.Do(req)
+	state.metrics.observeRequest(time.Since(start))
+	if pooled {
+		state.endpoints.report(base, err == nil && resp.StatusCode < 500)
+	}
+	if err != nil {
+		return nil, &IngestError{Err: fmt.Errorf("error sending to pipeline: %w", err)}
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading pipeline response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &IngestError{StatusCode: resp.StatusCode}
+	}
+
+	failed := make(map[string]string)
+	var parsed batchResponse
+	if len(bytes.TrimSpace(body)) > 0 && json.Unmarshal(body, &parsed) == nil {
+		for _, f := range parsed.Failed {
+			failed[f.ID] = f.Error
+		}
+	}
+	return failed, nil
+}
+
+// endpointCooldown is how long an endpoint is skipped after a request to it
+// fails with a connection error, timeout, or 5xx response.
+const endpointCooldown = 30 * time.Second
+
+// endpointPool hands out pipeline endpoints round-robin, passing over any
+// that failed within the last endpointCooldown.
+type endpointPool struct {
+	mu        sync.Mutex
+	urls      []string
+	next      int
+	downUntil map[string]time.Time
+}
+
+func newEndpointPool(urls []string) *endpointPool {
+	return &endpointPool{urls: urls, downUntil: make(map[string]time.Time)}
+}
+
+// pick returns the next endpoint to send to, or fallback if p is nil. When
+// every endpoint is cooling down, the one that recovers first is returned
+// rather than failing the request outright.
+func (p *endpointPool) pick(fallback string) string {
+	if p == nil {
+		return fallback
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	soonest := ""
+	for range p.urls {
+		url := p.urls[p.next]
+		p.next = (p.next + 1) % len(p.urls)
+		until, down := p.downUntil[url]
+		if !down || !now.Before(until) {
+			return url
+		}
+		if soonest == "" || until.Before(p.downUntil[soonest]) {
+			soonest = url
+		}
+	}
+	return soonest
+}
+
+// report records the outcome of a request to url. A failure takes the
+// endpoint out of rotation for endpointCooldown; a success puts it back.
+func (p *endpointPool) report(url string, ok bool) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ok {
+		delete(p.downUntil, url)
+		return
+	}
+	if until, down := p.downUntil[url]; !down || !time.Now().Before(until) {
+		logger.Warn(fmt.Sprintf("Pipeline endpoint %s failed; skipping it for %s", url, endpointCooldown),
+			"pipelineURL", url, "cooldown", endpointCooldown.String())
+	}
+	p.downUntil[url] = time.Now().Add(endpointCooldown)
+}
+
+// latencyBuckets are the upper bounds, in seconds, of the pipeline request
+// duration histogram.
+var latencyBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// runMetrics holds file and entry counts, updated as each file finishes, and
+// a histogram of pipeline request durations. It serves them in the
+// Prometheus text exposition format.
+type runMetrics struct {
+	mu           sync.Mutex
+	files        map[string]int // by status: completed, failed, interrupted
+	entries      Summary
+	bucketCounts []int // cumulative counts per latencyBuckets bound
+	latencySum   float64
+	latencyCount int
+}
+
+func newRunMetrics() *runMetrics {
+	return &runMetrics{
+		files:        map[string]int{"completed": 0, "failed": 0, "interrupted": 0},
+		entries:      newSummary(),
+		bucketCounts: make([]int, len(latencyBuckets)),
+	}
+}
+
+// addFile counts a finished file and its entry outcomes.
+func (m *runMetrics) addFile(status string, summary Summary) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[status]++
+	m.entries.Add(summary)
+}
+
+// observeRequest records the duration of one pipeline request.
+func (m *runMetrics) observeRequest(d time.Duration) {
+	if m == nil {
+		return
+	}
+	seconds := d.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			m.bucketCounts[i]++
+		}
+	}
+	m.latencySum += seconds
+	m.latencyCount++
+}
+
+// ServeHTTP writes the metrics at /metrics.
+func (m *runMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/metrics" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP fhir_ingest_files_total Input files finished, by status.")
+	fmt.Fprintln(w, "# TYPE fhir_ingest_files_total counter")
+	for _, status := range []string{"completed", "failed", "interrupted"} {
+		fmt.Fprintf(w, "fhir_ingest_files_total{status=%q} %d\n", status, m.files[status])
+	}
+
+	fmt.Fprintln(w, "# HELP fhir_ingest_entries_total Resources in finished files, by outcome.")
+	fmt.Fprintln(w, "# TYPE fhir_ingest_entries_total counter")
+	for _, c := range []struct {
+		outcome string
+		n       int
+	}{
+		{"ingested", m.entries.Ingested},
+		{"skipped_empty", m.entries.SkippedEmpty},
+		{"skipped_filtered", m.entries.SkippedFiltered},
+		{"skipped_heading_only", m.entries.SkippedHeadingOnly},
+		{"skipped_too_short", m.entries.SkippedTooShort},
+		{"duplicate", m.entries.Duplicates},
+		{"unchanged", m.entries.Unchanged},
+		{"missing_resource_type", m.entries.MissingResourceType},
+		{"duplicate_id", m.entries.DuplicateIDs},
+		{"invalid", m.entries.Invalid},
+		{"malformed", m.entries.MalformedRecords},
+		{"failed", m.entries.PipelineFailures},
+	} {
+		fmt.Fprintf(w, "fhir_ingest_entries_total{outcome=%q} %d\n", c.outcome, c.n)
+	}
+
+	fmt.Fprintln(w, "# HELP fhir_ingest_request_duration_seconds Pipeline request duration.")
+	fmt.Fprintln(w, "# TYPE fhir_ingest_request_duration_seconds histogram")
+	for i, bound := range latencyBuckets {
+		fmt.Fprintf(w, "fhir_ingest_request_duration_seconds_bucket{le=\"%g\"} %d\n", bound, m.bucketCounts[i])
+	}
+	fmt.Fprintf(w, "fhir_ingest_request_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.latencyCount)
+	fmt.Fprintf(w, "fhir_ingest_request_duration_seconds_sum %g\n", m.latencySum)
+	fmt.Fprintf(w, "fhir_ingest_request_duration_seconds_count %d\n", m.latencyCount)
+}
+
+// errTooManyFailures is the cancellation cause once -max-failures is
+// exceeded.
+var errTooManyFailures = errors.New("too many pipeline failures")
+
+// errTimeoutTotal is the cancellation cause once -timeout-total has passed.
+var errTimeoutTotal = errors.New("run exceeded -timeout-total")
+
+// errFailFast is the cancellation cause after the first error with
+// -fail-fast.
+var errFailFast = errors.New("stopped at first error")
+
+// errParseFailure is the cancellation cause after a file cannot be parsed
+// with -on-parse-error fail.
+var errParseFailure = errors.New("stopped at unparseable file")
+
+// failureLimit cancels the run with cause once more than max records have
+// failed.
+type failureLimit struct {
+	max   int64
+	count atomic.Int64
+	abort context.CancelCauseFunc
+	cause error
+}
+
+func (f *failureLimit) add() {
+	if f.count.Add(1) > f.max {
+		f.abort(f.cause)
+	}
+}
+
+// deadLetterEntry is one line of a -dead-letter-file: the record as it would
+// have been sent, why it failed, and how many times delivery was attempted.
+type deadLetterEntry struct {
+	Record     map[string]string `json:"record"`
+	Error      string            `json:"error"`
+	StatusCode int               `json:"statusCode,omitempty"`
+	Attempts   int               `json:"attempts"`
+	FailedAt   time.Time         `json:"failedAt"`
+}
+
+// deadLetterKey identifies a record across a replay.
+func deadLetterKey(record map[string]string) string {
+	return record["sourceFile"] + "\x00" + record["resourceType"] + "/" + record["id"]
+}
+
+// replayDeadLetters re-sends the records in a dead-letter file written by
+// -dead-letter-file. Records that fail again are written to the current
+// -dead-letter-file with their attempt count incremented. Malformed lines are
+// logged, counted, and skipped.
+func replayDeadLetters(ctx context.Context, cfg *Config, state *runState, sink Sink, path string) (Summary, error) {
+	summary := newSummary()
+
+	r, err := openInput(path)
+	if err != nil {
+		return summary, err
+	}
+	defer r.Close()
+
+	out := newRecordSender(ctx, cfg, state, sink, &summary)
+	out.attempts = make(map[string]int)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxNDJSONLineBytes)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if ctx.Err() != nil {
+			out.flush()
+			return summary, fmt.Errorf("%s: stopped at line %d: %w", path, lineNum, context.Cause(ctx))
+		}
+
+		var entry deadLetterEntry
+		if err := json.Unmarshal(line, &entry); err != nil || entry.Record == nil {
+			if err == nil {
+				err = errors.New("missing record")
+			}
+			logger.Warn(fmt.Sprintf("  Line %d: Error parsing dead-letter entry: %v", lineNum, err),
+				"file", path, "line", lineNum, "error", err)
+			summary.MalformedRecords++
+			summary.outcome(path, "", "", "skipped", "malformed", err)
+			continue
+		}
+		out.attempts[deadLetterKey(entry.Record)] = entry.Attempts
+		out.send(entry.Record)
+	}
+	out.flush()
+	if err := scanner.Err(); err != nil {
+		return summary, readError(path, err)
+	}
+	logger.Info(fmt.Sprintf("  Replayed %d lines", lineNum), "file", path, "lines", lineNum)
+	return summary, nil
+}
+
+// dedupStore is a concurrency-safe set of record keys.
+type dedupStore interface {
+	// CheckAndAdd records key and reports whether it was already present.
+	CheckAndAdd(key [16]byte) (bool, error)
+	Close() error
+}
+
+// openDedupStore returns a file-backed store when -dedup-file is set and an
+// in-memory one otherwise.
+func openDedupStore(cfg *Config) (dedupStore, error) {
+	if cfg.DedupFile != "" {
+		return openFileDedupStore(cfg.DedupFile, cfg.DedupCapacity)
+	}
+	return &memoryDedupStore{keys: make(map[[16]byte]struct{})}, nil
+}
+
+// dedupKey identifies a record by resourceType/id and content, so an updated
+// version of a resource is not mistaken for a duplicate.
+func dedupKey(record map[string]string) [16]byte {
+	sum := sha256.Sum256([]byte(record["resourceType"] + "/" + record["id"] + "\x00" + record["content"]))
+	var key [16]byte
+	copy(key[:], sum[:])
+	return key
+}
+
+// isDuplicate reports whether record was already seen in this run, going by
+// the -dedup store seen, and counts
+// it in summary if so. Lookup errors are logged and treated as unseen so
+// that a dedup problem never drops data.
+func isDuplicate(seen dedupStore, summary *Summary, record map[string]string) bool {
+	dup, err := seen.CheckAndAdd(dedupKey(record))
+	if err != nil {
+		logger.Error(fmt.Sprintf("Error checking dedup store for %s/%s: %v", record["resourceType"], record["id"], err),
+			"file", record["sourceFile"], "resourceType", record["resourceType"], "id", record["id"], "error", err)
+		return false
+	}
+	if dup {
+		logger.Debug(fmt.Sprintf("  Skipping duplicate: %s/%s", record["resourceType"], record["id"]),
+			"file", record["sourceFile"], "resourceType", record["resourceType"], "id", record["id"])
+		summary.Duplicates++
+		summary.typeCounts(record["resourceType"]).Duplicates++
+		summary.outcome(record["sourceFile"], record["resourceType"], record["id"], "skipped", "duplicate", nil)
+	}
+	return dup
+}
+
+// changeCache maps "resourceType/id" to the hex sha256 of the content last
+// accepted by the pipeline. It is loaded from and saved to a JSON file.
+type changeCache struct {
+	path   string
+	mu     sync.Mutex
+	hashes map[string]string
+}
+
+// loadChangeCache reads the cache at path; a missing file is an empty cache.
+func loadChangeCache(path string) (*changeCache, error) {
+	c := &changeCache{path: path, hashes: make(map[string]string)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &c.hashes); err != nil {
+		return nil, fmt.Errorf("%s is not an incremental cache: %w", path, err)
+	}
+	if c.hashes == nil {
+		c.hashes = make(map[string]string)
+	}
+	return c, nil
+}
+
+// contentHash is the hex sha256 of a record's content.
+func contentHash(record map[string]string) string {
+	sum := sha256.Sum256([]byte(record["content"]))
+	return hex.EncodeToString(sum[:])
+}
+
+// unchanged reports whether record's content matches what the pipeline last
+// accepted for the same resource.
+func (c *changeCache) unchanged(record map[string]string) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	hash, ok := c.hashes[record["resourceType"]+"/"+record["id"]]
+	return ok && hash == contentHash(record)
+}
+
+// update remembers record's content as accepted by the pipeline.
+func (c *changeCache) update(record map[string]string) {
+	if c == nil {
+		return
+	}
+	hash := contentHash(record)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hashes[record["resourceType"]+"/"+record["id"]] = hash
+}
+
+// save writes the cache to a temporary file and renames it over path, so an
+// interrupted save leaves the previous cache intact.
+func (c *changeCache) save() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	data, err := json.Marshal(c.hashes)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// isUnchanged reports whether record can be skipped under -incremental, as
+// its content is in cache, counting it in summary if so.
+func isUnchanged(cache *changeCache, summary *Summary, record map[string]string) bool {
+	if !cache.unchanged(record) {
+		return false
+	}
+	logger.Debug(fmt.Sprintf("  Skipping unchanged: %s/%s", record["resourceType"], record["id"]),
+		"file", record["sourceFile"], "resourceType", record["resourceType"], "id", record["id"])
+	summary.Unchanged++
+	summary.typeCounts(record["resourceType"]).Unchanged++
+	summary.outcome(record["sourceFile"], record["resourceType"], record["id"], "skipped", "unchanged", nil)
+	return true
+}
+
+type memoryDedupStore struct {
+	mu   sync.Mutex
+	keys map[[16]byte]struct{}
+}
+
+func (m *memoryDedupStore) CheckAndAdd(key [16]byte) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.keys[key]; ok {
+		return true, nil
+	}
+	m.keys[key] = struct{}{}
+	return false, nil
+}
+
+func (m *memoryDedupStore) Close() error { return nil }
+
+// fileDedupStore is an open-addressing hash table of 16-byte keys stored in a
+// fixed-size file, so memory use stays constant however many resources are
+// seen. An all-zero slot is empty. Because the file persists, keys from a
+// previous run using the same file are also treated as seen.
+type fileDedupStore struct {
+	mu    sync.Mutex
+	f     *os.File
+	slots int64
+	used  int64
+}
+
+func openFileDedupStore(path string, capacity int) (*fileDedupStore, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// Size the table for a load factor of at most 50%; reuse an existing
+	// table's size so its slot positions stay valid, and count the slots it
+	// already fills so the load factor holds across runs.
+	slots := int64(capacity) * 2
+	var used int64
+	if info.Size() > 0 {
+		if info.Size()%16 != 0 {
+			f.Close()
+			return nil, fmt.Errorf("%s is not a dedup file", path)
+		}
+		slots = info.Size() / 16
+		if used, err = countUsedSlots(io.NewSectionReader(f, 0, info.Size())); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+	} else if err := f.Truncate(slots * 16); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &fileDedupStore{f: f, slots: slots, used: used}, nil
+}
+
+// countUsedSlots returns how many of the 16-byte slots read from r are not
+// all zero.
+func countUsedSlots(r io.Reader) (int64, error) {
+	r = bufio.NewReaderSize(r, 64*1024)
+	var used int64
+	var slot [16]byte
+	for {
+		if _, err := io.ReadFull(r, slot[:]); err == io.EOF {
+			return used, nil
+		} else if err != nil {
+			return 0, err
+		}
+		if slot != ([16]byte{}) {
+			used++
+		}
+	}
+}
+
+func (d *fileDedupStore) CheckAndAdd(key [16]byte) (bool, error) {
+	if key == ([16]byte{}) {
+		// Reserve the zero key as the empty-slot marker
+		key[15] = 1
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var slot [16]byte
+	start := int64(binary.BigEndian.Uint64(key[:8]) % uint64(d.slots))
+	for i := int64(0); i < d.slots; i++ {
+		pos := (start + i) % d.slots * 16
+		if _, err := d.f.ReadAt(slot[:], pos); err != nil {
+			return false, err
+		}
+		if slot == key {
+			return true, nil
+		}
+		if slot == ([16]byte{}) {
+			if d.used*2 >= d.slots {
+				return false, fmt.Errorf("dedup file is full; raise -dedup-capacity and use a new file")
+			}
+			if _, err := d.f.WriteAt(key[:], pos); err != nil {
+				return false, err
+			}
+			d.used++
+			return false, nil
+		}
+	}
+	return false, fmt.Errorf("dedup file is full; raise -dedup-capacity and use a new file")
+}
 
-	fmt.Printf("  ✓ Ingested: %s (%s)\n", data["id"], data["resourceType"])
+func (d *fileDedupStore) Close() error {
+	return d.f.Close()
 }
@@ -0,0 +1,3966 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/rsanandres/hc_ai/POC_embeddings/ingestpb"
+	"github.com/segmentio/kafka-go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// quietLogger silences log output for the duration of a test.
+func quietLogger(t testing.TB) {
+	t.Helper()
+	prev := logger
+	logger = slog.New(newHumanHandler(io.Discard, io.Discard, slog.LevelInfo))
+	t.Cleanup(func() { logger = prev })
+}
+
+// mustResource decodes an inline JSON resource for use in tests.
+func mustResource(t *testing.T, raw string) map[string]interface{} {
+	t.Helper()
+	var resource map[string]interface{}
+	if err := json.Unmarshal([]byte(raw), &resource); err != nil {
+		t.Fatalf("invalid test resource: %v", err)
+	}
+	return resource
+}
+
+func TestExtractStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{"plain string", `{"clinicalStatus": "active"}`, "active"},
+		{"codeable concept", `{"clinicalStatus": {"coding": [{"code": "resolved"}], "text": "Resolved"}}`, "resolved"},
+		{"text only", `{"clinicalStatus": {"text": "Inactive"}}`, "Inactive"},
+		{"missing", `{}`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resource := mustResource(t, tt.raw)
+			if got := extractStatus(resource["clinicalStatus"]); got != tt.want {
+				t.Errorf("extractStatus() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractContentR4ConditionStatus(t *testing.T) {
+	resource := mustResource(t, `{
+		"resourceType": "Condition",
+		"clinicalStatus": {
+			"coding": [{"system": "http://terminology.hl7.org/CodeSystem/condition-clinical", "code": "active"}]
+		},
+		"code": {"coding": [{"display": "Hypertension"}]}
+	}`)
+
+	content := extractContent(&Config{}, resource, "Condition", nil)
+	if !strings.Contains(content, "Status: active") {
+		t.Errorf("content %q does not contain R4 clinicalStatus", content)
+	}
+}
+
+func TestCleanHTML(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "xhtml div with attributes",
+			in:   `<div xmlns="http://www.w3.org/1999/xhtml"><p>Generated <b>Narrative</b></p></div>`,
+			want: "Generated Narrative",
+		},
+		{
+			name: "entities decoded",
+			in:   `<div>Fever &amp; chills, temp &gt; 38&#176;C&nbsp;&lt;ok&gt;</div>`,
+			want: "Fever & chills, temp > 38°C <ok>",
+		},
+		{
+			name: "nested tables keep cells apart",
+			in: `<div><table><tr><th>Test</th><th>Result</th></tr>
+				<tr><td>Glucose</td><td><table><tr><td>110</td><td>mg/dL</td></tr></table></td></tr>
+				</table></div>`,
+			want: "Test Result Glucose 110 mg/dL",
+		},
+		{
+			name: "links and comments",
+			in:   `<div><a href="Patient/1?x=1&amp;y=>2">John</a><!-- hidden -->Doe</div>`,
+			want: "JohnDoe",
+		},
+		{
+			name: "script bodies dropped",
+			in:   `<div><script>alert("x")</script>Visible</div>`,
+			want: "Visible",
+		},
+		{
+			name: "whitespace collapsed",
+			in:   "<div>\n  Line one<br/>\n\tLine   two\n</div>",
+			want: "Line one Line two",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cleanHTML(tt.in); got != tt.want {
+				t.Errorf("cleanHTML() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSummaryAdd(t *testing.T) {
+	total := newSummary()
+
+	a := newSummary()
+	a.Ingested = 2
+	a.typeCounts("Condition").Ingested = 2
+	a.MissingResourceType = 1
+
+	b := newSummary()
+	b.Ingested = 1
+	b.SkippedEmpty = 1
+	b.PipelineFailures = 1
+	b.typeCounts("Condition").Ingested = 1
+	b.typeCounts("Observation").SkippedEmpty = 1
+	b.typeCounts("Observation").PipelineFailures = 1
+
+	total.Add(a)
+	total.Add(b)
+
+	if total.Ingested != 3 || total.SkippedEmpty != 1 || total.PipelineFailures != 1 || total.MissingResourceType != 1 {
+		t.Errorf("unexpected totals: %+v", total)
+	}
+	if got := total.ByType["Condition"].Ingested; got != 3 {
+		t.Errorf("Condition ingested = %d, want 3", got)
+	}
+	if got := *total.ByType["Observation"]; got != (TypeCounts{SkippedEmpty: 1, PipelineFailures: 1}) {
+		t.Errorf("Observation counts = %+v", got)
+	}
+}
+
+func TestResourcePatientID(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{"patient itself", `{"resourceType": "Patient", "id": "p1"}`, "p1"},
+		{"subject reference", `{"resourceType": "Condition", "subject": {"reference": "Patient/p2"}}`, "p2"},
+		{"patient reference", `{"resourceType": "Immunization", "patient": {"reference": "urn:uuid:p3"}}`, "urn:uuid:p3"},
+		{"no reference", `{"resourceType": "Organization"}`, "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resourcePatientID(mustResource(t, tt.raw)); got != tt.want {
+				t.Errorf("resourcePatientID() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHumanHandlerRoutesByLevel(t *testing.T) {
+	var out, errOut bytes.Buffer
+	l := slog.New(newHumanHandler(&out, &errOut, slog.LevelInfo))
+
+	l.Debug("hidden")
+	l.Info("  Found 3 entries", "entries", 3)
+	l.Warn("Entry 1: Missing resourceType")
+
+	if got := out.String(); got != "  Found 3 entries\n" {
+		t.Errorf("stdout = %q", got)
+	}
+	if got := errOut.String(); !strings.HasSuffix(got, " Entry 1: Missing resourceType\n") {
+		t.Errorf("stderr = %q", got)
+	}
+	if strings.Contains(out.String()+errOut.String(), "hidden") {
+		t.Error("debug message logged at info level")
+	}
+}
+
+func TestHumanName(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{
+			name: "prefix and two given names",
+			raw:  `{"name": [{"prefix": ["Dr."], "given": ["John", "Michael"], "family": "Smith", "suffix": ["Jr."]}]}`,
+			want: "Dr. John Michael Smith Jr.",
+		},
+		{
+			name: "official preferred",
+			raw:  `{"name": [{"use": "nickname", "given": ["Johnny"]}, {"use": "official", "given": ["John"], "family": "Smith"}]}`,
+			want: "John Smith",
+		},
+		{
+			name: "text preferred",
+			raw:  `{"name": [{"text": "Jane Q. Public", "given": ["Jane"], "family": "Public"}]}`,
+			want: "Jane Q. Public",
+		},
+		{
+			name: "empty",
+			raw:  `{"name": []}`,
+			want: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			names, _ := mustResource(t, tt.raw)["name"].([]interface{})
+			if got := humanName(names); got != tt.want {
+				t.Errorf("humanName() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractContentPatientName(t *testing.T) {
+	resource := mustResource(t, `{
+		"resourceType": "Patient",
+		"name": [{"use": "official", "prefix": ["Mrs."], "given": ["Ana", "Maria"], "family": "Lopez"}],
+		"gender": "female"
+	}`)
+
+	content := extractContent(&Config{}, resource, "Patient", nil)
+	if !strings.Contains(content, "Name: Mrs. Ana Maria Lopez") {
+		t.Errorf("content %q does not contain full name", content)
+	}
+}
+
+func TestRecordSenderBatches(t *testing.T) {
+	quietLogger(t)
+
+	var batchSizes []int
+	var single int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ingest/batch" {
+			single++
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		var records []map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&records); err != nil {
+			t.Errorf("batch body: %v", err)
+		}
+		batchSizes = append(batchSizes, len(records))
+		// Reject one specific record to exercise partial failure
+		for _, rec := range records {
+			if rec["id"] == "bad" {
+				w.Write([]byte(`{"failed": [{"id": "bad", "error": "empty content"}]}`))
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	cfg := &Config{PipelineURL: server.URL, PipelinePath: "/ingest", RequestTimeout: time.Second, BatchSize: 2}
+	summary := newSummary()
+	state := newRunState(cfg)
+	out := newRecordSender(context.Background(), cfg, state, httpSink{cfg, state}, &summary)
+	for _, id := range []string{"a", "bad", "c"} {
+		out.send(map[string]string{"id": id, "resourceType": "Condition"})
+	}
+	out.flush()
+
+	if len(batchSizes) != 2 || batchSizes[0] != 2 || batchSizes[1] != 1 {
+		t.Errorf("batch sizes = %v, want [2 1]", batchSizes)
+	}
+	if summary.Ingested != 2 || summary.PipelineFailures != 1 {
+		t.Errorf("ingested=%d failures=%d, want 2 and 1", summary.Ingested, summary.PipelineFailures)
+	}
+
+	// Batch size 1 falls back to the per-record endpoint
+	cfg.BatchSize = 1
+	out.send(map[string]string{"id": "d", "resourceType": "Condition"})
+	if single != 1 {
+		t.Errorf("single requests = %d, want 1", single)
+	}
+}
+
+func TestOpenInputGzip(t *testing.T) {
+	dir := t.TempDir()
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(`{"resourceType": "Bundle"}`))
+	zw.Close()
+
+	good := filepath.Join(dir, "bundle.json.gz")
+	if err := os.WriteFile(good, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := openInput(good)
+	if err != nil {
+		t.Fatalf("openInput: %v", err)
+	}
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || string(data) != `{"resourceType": "Bundle"}` {
+		t.Errorf("read %q, %v", data, err)
+	}
+
+	// A truncated stream is reported as a decompression error, not a JSON error
+	truncated := filepath.Join(dir, "truncated.json.gz")
+	os.WriteFile(truncated, buf.Bytes()[:buf.Len()-6], 0o644)
+	cfg := &Config{Format: "auto"}
+	state := newRunState(cfg)
+	_, _, err = processFile(context.Background(), cfg, state, stdoutSink{state.estimateTokens}, truncated)
+	if !errors.Is(err, errDecompress) {
+		t.Errorf("truncated gzip error = %v, want errDecompress", err)
+	}
+
+	if !isNDJSON(&Config{Format: "auto"}, "Condition.ndjson.gz") {
+		t.Error("Condition.ndjson.gz not detected as NDJSON")
+	}
+}
+
+func TestExtractContentObservationValues(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want []string
+	}{
+		{
+			name: "quantity",
+			raw:  `{"code": {"text": "Body Weight"}, "valueQuantity": {"value": 72.5, "unit": "kg"}}`,
+			want: []string{"Body Weight", "Value: 72.50 kg"},
+		},
+		{
+			name: "codeable concept",
+			raw:  `{"code": {"text": "COVID-19 PCR"}, "valueCodeableConcept": {"coding": [{"display": "Negative"}]}}`,
+			want: []string{"COVID-19 PCR", "Value: Negative"},
+		},
+		{
+			name: "string",
+			raw:  `{"code": {"text": "Comment"}, "valueString": "Sample hemolyzed"}`,
+			want: []string{"Value: Sample hemolyzed"},
+		},
+		{
+			name: "boolean",
+			raw:  `{"code": {"text": "Pregnant"}, "valueBoolean": false}`,
+			want: []string{"Value: No"},
+		},
+		{
+			name: "blood pressure components",
+			raw: `{
+				"code": {"text": "Blood Pressure"},
+				"component": [
+					{"code": {"coding": [{"display": "Systolic Blood Pressure"}]}, "valueQuantity": {"value": 120, "unit": "mm[Hg]"}},
+					{"code": {"coding": [{"display": "Diastolic Blood Pressure"}]}, "valueQuantity": {"value": 80, "unit": "mm[Hg]"}}
+				]
+			}`,
+			want: []string{"Systolic Blood Pressure: 120.00 mm[Hg]", "Diastolic Blood Pressure: 80.00 mm[Hg]"},
+		},
+		{
+			name: "reference range and interpretation",
+			raw: `{
+				"code": {"text": "Glucose"}, "valueQuantity": {"value": 182, "unit": "mg/dL"},
+				"referenceRange": [{"low": {"value": 70, "unit": "mg/dL"}, "high": {"value": 99, "unit": "mg/dL"}}],
+				"interpretation": [{"coding": [{"system": "http://terminology.hl7.org/CodeSystem/v3-ObservationInterpretation", "code": "H", "display": "High"}]}]
+			}`,
+			want: []string{"Value: 182.00 mg/dL", "Reference range: 70–99 mg/dL", "Interpretation: High"},
+		},
+		{
+			name: "effectivePeriod",
+			raw:  `{"code": {"text": "Sleep duration"}, "valueQuantity": {"value": 7.5, "unit": "h"}, "effectivePeriod": {"start": "2021-06-01T22:00:00Z", "end": "2021-06-02T05:30:00Z"}, "issued": "2021-06-02T08:00:00Z"}`,
+			want: []string{"Date: 2021-06-01T22:00:00Z"},
+		},
+		{
+			name: "data absent reason",
+			raw:  `{"code": {"text": "Hemoglobin A1c"}, "dataAbsentReason": {"coding": [{"system": "http://terminology.hl7.org/CodeSystem/data-absent-reason", "code": "not-performed"}]}}`,
+			want: []string{"Hemoglobin A1c", "Value not available: not performed"},
+		},
+		{
+			name: "data absent reason display and component",
+			raw: `{
+				"code": {"text": "Blood Pressure"}, "dataAbsentReason": {"coding": [{"code": "unknown", "display": "Unknown"}]},
+				"component": [
+					{"code": {"text": "Systolic"}, "valueQuantity": {"value": 120, "unit": "mm[Hg]"}},
+					{"code": {"text": "Diastolic"}, "dataAbsentReason": {"text": "patient refused"}}
+				]
+			}`,
+			want: []string{"Value not available: Unknown", "Systolic: 120.00 mm[Hg]", "Diastolic: not available (patient refused)"},
+		},
+		{
+			name: "issued only",
+			raw:  `{"code": {"text": "Glucose"}, "valueQuantity": {"value": 95, "unit": "mg/dL"}, "issued": "2021-06-02T08:00:00.000+02:00"}`,
+			want: []string{"Date: 2021-06-02T08:00:00+02:00"},
+		},
+		{
+			name: "open-ended range and bare interpretation code",
+			raw: `{
+				"code": {"text": "HDL Cholesterol"}, "valueQuantity": {"value": 35, "unit": "mg/dL"},
+				"referenceRange": [{"low": {"value": 40, "unit": "mg/dL"}}],
+				"interpretation": [{"coding": [{"code": "L"}]}]
+			}`,
+			want: []string{"Reference range: >= 40 mg/dL", "Interpretation: Low"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := extractContent(&Config{}, mustResource(t, tt.raw), "Observation", nil)
+			for _, want := range tt.want {
+				if !strings.Contains(content, want) {
+					t.Errorf("content %q missing %q", content, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCodeableConceptText(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{"text only", `{"code": {"text": "Diabetes"}}`, "Diabetes"},
+		{"coding only", `{"code": {"coding": [{"system": "http://snomed.info/sct", "code": "44054006", "display": "Type 2 diabetes"}]}}`, "Type 2 diabetes"},
+		{"text wins over coding", `{"code": {"text": "T2DM", "coding": [{"display": "Type 2 diabetes"}]}}`, "T2DM"},
+		{"empty concept", `{"code": {}}`, ""},
+		{"coding without display", `{"code": {"coding": [{"code": "44054006"}]}}`, ""},
+		{"missing", `{}`, ""},
+		{"wrong shape", `{"code": "44054006"}`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := codeableConceptText(&Config{}, mustResource(t, tt.raw)["code"]); got != tt.want {
+				t.Errorf("codeableConceptText() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONLFileConcurrentWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.jsonl")
+	out, err := openJSONLFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			out.Write(map[string]string{"id": fmt.Sprint(i), "content": strings.Repeat("x", 1000)})
+		}(i)
+	}
+	wg.Wait()
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 50 {
+		t.Fatalf("got %d lines, want 50", len(lines))
+	}
+	for _, line := range lines {
+		var record map[string]string
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Errorf("malformed line %q: %v", line, err)
+		}
+	}
+}
+
+// extractBundle runs streamBundle over r, reading it into memory so it can be
+// reopened for the second pass, and collects the records.
+func extractBundle(cfg *Config, r io.Reader, sourceFile string) ([]map[string]string, Summary, error) {
+	summary := newSummary()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, summary, readError(sourceFile, err)
+	}
+	var records []map[string]string
+	reopen := func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(data)), nil }
+	err = streamBundle(cfg, bytes.NewReader(data), reopen, sourceFile, &summary, func(record map[string]string) error {
+		records = append(records, record)
+		return nil
+	})
+	return records, summary, err
+}
+
+// extractNDJSON runs streamNDJSON over r and collects the records.
+func extractNDJSON(cfg *Config, r io.Reader, sourceFile string) ([]map[string]string, Summary, error) {
+	summary := newSummary()
+	var records []map[string]string
+	err := streamNDJSON(cfg, r, sourceFile, &summary, func(record map[string]string) error {
+		records = append(records, record)
+		return nil
+	})
+	return records, summary, err
+}
+
+// bundleJSON wraps inline resource JSON in a collection Bundle.
+func bundleJSON(resources ...string) string {
+	entries := make([]string, len(resources))
+	for i, r := range resources {
+		entries[i] = fmt.Sprintf(`{"fullUrl": "urn:uuid:entry-%d", "resource": %s}`, i, r)
+	}
+	return `{"resourceType": "Bundle", "type": "collection", "entry": [` + strings.Join(entries, ",") + `]}`
+}
+
+const testPatient = `{"resourceType": "Patient", "id": "pat-1", "name": [{"given": ["Jane"], "family": "Doe"}], "gender": "female", "birthDate": "1980-04-02"}`
+
+func TestExtractBundleResourceTypes(t *testing.T) {
+	quietLogger(t)
+
+	tests := []struct {
+		resourceType string
+		resource     string
+		want         []string
+	}{
+		{"Patient", testPatient, []string{"Patient Information:", "Name: Jane Doe", "Gender: female", "Date of Birth: 1980-04-02"}},
+		{"Condition", `{"resourceType": "Condition", "id": "c1", "code": {"text": "Asthma"}, "clinicalStatus": {"coding": [{"code": "active"}]}, "onsetDateTime": "2010-05-01"}`,
+			[]string{"Medical Condition:", "Asthma", "Status: active", "Onset: 2010-05-01"}},
+		{"Observation", `{"resourceType": "Observation", "id": "o1", "code": {"coding": [{"display": "Heart rate"}]}, "valueQuantity": {"value": 72, "unit": "/min"}, "effectiveDateTime": "2020-01-01"}`,
+			[]string{"Clinical Observation:", "Heart rate", "Value: 72.00 /min", "Date: 2020-01-01"}},
+		{"Encounter", `{"resourceType": "Encounter", "id": "e1", "type": [{"text": "Office visit"}], "period": {"start": "2020-02-02"}}`,
+			[]string{"Healthcare Encounter:", "Office visit", "Start: 2020-02-02"}},
+		{"MedicationRequest", `{"resourceType": "MedicationRequest", "id": "mr1", "medicationReference": {"reference": "Medication/m1"}, "status": "active", "authoredOn": "2021-03-03"}`,
+			[]string{"Medication Prescription:", "Medication Reference: Medication/m1", "Status: active", "Prescribed: 2021-03-03"}},
+		{"Medication", `{"resourceType": "Medication", "id": "m1", "code": {"coding": [{"display": "Metformin 500 MG"}]}}`,
+			[]string{"Medication:", "Metformin 500 MG"}},
+		{"Immunization", `{"resourceType": "Immunization", "id": "i1", "vaccineCode": {"coding": [{"display": "Influenza vaccine"}]}, "date": "2019-10-10"}`,
+			[]string{"Immunization:", "Influenza vaccine", "Date: 2019-10-10"}},
+		{"DiagnosticReport", `{"resourceType": "DiagnosticReport", "id": "d1", "code": {"coding": [{"display": "Lipid panel"}]}, "effectiveDateTime": "2022-04-04"}`,
+			[]string{"Diagnostic Report:", "Lipid panel", "Date: 2022-04-04"}},
+		{"Procedure", `{"resourceType": "Procedure", "id": "pr1", "code": {"coding": [{"display": "Appendectomy"}]}, "performedDateTime": "2015-06-06"}`,
+			[]string{"Medical Procedure:", "Appendectomy", "Performed: 2015-06-06"}},
+		{"AllergyIntolerance", `{"resourceType": "AllergyIntolerance", "id": "a1", "code": {"text": "Peanut"}, "criticality": "high", "reaction": [{"manifestation": [{"coding": [{"display": "Hives"}]}]}]}`,
+			[]string{"Allergy/Intolerance:", "Peanut", "Criticality: high", "Reactions: Hives"}},
+		{"CarePlan", `{"resourceType": "CarePlan", "id": "cp1", "status": "active", "title": "Diabetes self-management plan", "category": [{"coding": [{"display": "Diabetes self management plan"}]}], "activity": [{"detail": {"code": {"coding": [{"display": "Diabetic diet"}]}, "status": "in-progress"}}, {"detail": {"description": "Check blood glucose daily"}}]}`,
+			[]string{"Care Plan:", "Diabetes self-management plan", "Category: Diabetes self management plan", "Status: active", "Activities: Diabetic diet (in-progress); Check blood glucose daily"}},
+		{"Goal", `{"resourceType": "Goal", "id": "g1", "lifecycleStatus": "active", "description": {"text": "Hemoglobin A1c below 7%"}, "target": [{"measure": {"coding": [{"display": "Hemoglobin A1c"}]}, "detailQuantity": {"value": 7, "unit": "%"}, "dueDate": "2024-06-01"}]}`,
+			[]string{"Goal:", "Hemoglobin A1c below 7%", "Status: active", "Target: Hemoglobin A1c 7.00 % by 2024-06-01"}},
+		{"ServiceRequest", `{"resourceType": "ServiceRequest", "id": "sr1", "status": "active", "intent": "order", "code": {"coding": [{"display": "MRI of lumbar spine"}]}, "occurrenceDateTime": "2023-02-10T08:00:00Z", "reasonCode": [{"text": "Low back pain"}]}`,
+			[]string{"Service Request:", "MRI of lumbar spine", "Status: active", "Intent: order", "Scheduled: 2023-02-10T08:00:00Z", "Reason: Low back pain"}},
+		{"Organization", `{"resourceType": "Organization", "id": "org1", "name": "General Hospital"}`,
+			[]string{"Organization:", "General Hospital"}},
+		{"Specimen", `{"resourceType": "Specimen", "id": "s1", "code": {"text": "Blood sample"}}`,
+			[]string{"Blood sample"}},
+		{"Narrative", `{"resourceType": "Condition", "id": "n1", "text": {"div": "<div>Chronic <b>sinusitis</b></div>"}, "code": {"text": "ignored"}}`,
+			[]string{"Chronic sinusitis"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.resourceType, func(t *testing.T) {
+			records, summary, err := extractBundle(&Config{}, strings.NewReader(bundleJSON(testPatient, tt.resource)), "test.json")
+			if err != nil {
+				t.Fatalf("extractBundle: %v", err)
+			}
+			if summary.SkippedEmpty != 0 {
+				t.Fatalf("unexpected skipped entries: %+v", summary)
+			}
+			record := records[len(records)-1]
+			for _, want := range tt.want {
+				if !strings.Contains(record["content"], want) {
+					t.Errorf("content %q missing %q", record["content"], want)
+				}
+			}
+			if record["patientId"] != "pat-1" {
+				t.Errorf("patientId = %q, want pat-1", record["patientId"])
+			}
+			if record["sourceFile"] != "test.json" || record["resourceJson"] == "" {
+				t.Errorf("record missing source metadata: %v", record)
+			}
+		})
+	}
+}
+
+func TestExtractBundleSkipsAndErrors(t *testing.T) {
+	quietLogger(t)
+
+	records, summary, err := extractBundle(&Config{}, strings.NewReader(bundleJSON(
+		`{"resourceType": "Basic", "id": "b1"}`,
+		`{"id": "no-type"}`,
+		`{"resourceType": "Organization", "name": "Clinic"}`,
+	)), "test.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || summary.SkippedEmpty != 1 || summary.MissingResourceType != 1 {
+		t.Errorf("records=%d summary=%+v", len(records), summary)
+	}
+	// Resources without an id fall back to fullUrl; no Patient means unknown
+	if records[0]["id"] != "urn:uuid:entry-2" || records[0]["patientId"] != "unknown" {
+		t.Errorf("record = %v", records[0])
+	}
+
+	if _, _, err := extractBundle(&Config{}, strings.NewReader(`{"resourceType": "Patient"}`), "p.json"); !errors.Is(err, ErrNotBundle) {
+		t.Errorf("non-Bundle input: err = %v, want ErrNotBundle", err)
+	}
+	var parseErr *ParseError
+	if _, _, err := extractBundle(&Config{}, strings.NewReader(`{not json`), "bad.json"); !errors.As(err, &parseErr) || parseErr.File != "bad.json" {
+		t.Errorf("malformed JSON: err = %v, want a ParseError for bad.json", err)
+	}
+}
+
+// largeBundleReader generates a Bundle of n Observations, each with a
+// narrative of narrativeBytes, without holding the whole document in memory.
+func largeBundleReader(n, narrativeBytes int) io.Reader {
+	narrative := strings.Repeat("x", narrativeBytes)
+	readers := []io.Reader{strings.NewReader(`{"resourceType": "Bundle", "type": "collection", "entry": [` + testPatientEntry)}
+	for i := 0; i < n; i++ {
+		readers = append(readers, &lazyReader{fn: func() string {
+			return fmt.Sprintf(`,{"fullUrl": "urn:uuid:obs-%d", "resource": {"resourceType": "Observation", "id": "obs-%d", `+
+				`"subject": {"reference": "Patient/pat-1"}, "code": {"text": "Note %d"}, "text": {"div": "<div>%s</div>"}}}`, i, i, i, narrative)
+		}})
+	}
+	readers = append(readers, strings.NewReader(`]}`))
+	return io.MultiReader(readers...)
+}
+
+const testPatientEntry = `{"fullUrl": "urn:uuid:pat-1", "resource": ` + testPatient + `}`
+
+// lazyReader produces its content only when first read.
+type lazyReader struct {
+	fn func() string
+	r  io.Reader
+}
+
+func (l *lazyReader) Read(p []byte) (int, error) {
+	if l.r == nil {
+		l.r = strings.NewReader(l.fn())
+	}
+	return l.r.Read(p)
+}
+
+func TestStreamBundleBoundedMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("generates a ~50MB Bundle")
+	}
+	quietLogger(t)
+
+	const entries, narrativeBytes = 5000, 10 * 1024
+	reopen := func() (io.ReadCloser, error) { return io.NopCloser(largeBundleReader(entries, narrativeBytes)), nil }
+
+	var peak uint64
+	sample := func() {
+		var m runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&m)
+		peak = max(peak, m.HeapAlloc)
+	}
+	sample()
+	base := peak
+
+	summary := newSummary()
+	records := 0
+	err := streamBundle(&Config{}, largeBundleReader(entries, narrativeBytes), reopen, "large.json", &summary, func(record map[string]string) error {
+		records++
+		if records%500 == 0 {
+			sample()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("streamBundle: %v", err)
+	}
+	if records != entries+1 {
+		t.Fatalf("got %d records, want %d", records, entries+1)
+	}
+	// The Bundle is ~50MB; streaming should keep only the index and one entry live
+	if grown := peak - base; grown > 16<<20 {
+		t.Errorf("heap grew by %d MB while streaming a %d MB Bundle", grown>>20, entries*narrativeBytes>>20)
+	}
+}
+
+func TestStreamBundleForwardReferencesOnStdin(t *testing.T) {
+	quietLogger(t)
+
+	// Without reopen only references to earlier entries resolve
+	input := bundleJSON(
+		`{"resourceType": "Observation", "id": "o1", "subject": {"reference": "urn:uuid:entry-1"}, "code": {"text": "Heart rate"}}`,
+		testPatient,
+	)
+	records, _, err := extractBundle(&Config{}, strings.NewReader(input), "test.json")
+	if err != nil {
+		t.Fatalf("extractBundle: %v", err)
+	}
+	if records[0]["patientId"] != "pat-1" {
+		t.Errorf("two-pass patientId = %q, want pat-1", records[0]["patientId"])
+	}
+
+	summary := newSummary()
+	records = nil
+	err = streamBundle(&Config{}, strings.NewReader(input), nil, stdinName, &summary, func(record map[string]string) error {
+		records = append(records, record)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("streamBundle: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2", len(records))
+	}
+	if records[0]["patientId"] != "unknown" {
+		t.Errorf("single-pass patientId = %q, want unknown", records[0]["patientId"])
+	}
+}
+
+func TestStreamBundleStopsOnEmitError(t *testing.T) {
+	quietLogger(t)
+
+	stop := errors.New("stop")
+	summary := newSummary()
+	calls := 0
+	input := bundleJSON(testPatient, `{"resourceType": "Condition", "id": "c1", "code": {"text": "Asthma"}}`)
+	err := streamBundle(&Config{}, strings.NewReader(input), nil, "test.json", &summary, func(map[string]string) error {
+		calls++
+		return stop
+	})
+	if !errors.Is(err, stop) {
+		t.Errorf("err = %v, want %v", err, stop)
+	}
+	if calls != 1 {
+		t.Errorf("emit called %d times, want 1", calls)
+	}
+}
+
+func TestExtractNDJSON(t *testing.T) {
+	quietLogger(t)
+
+	input := `{"resourceType": "Patient", "id": "p1", "gender": "male"}
+
+{"resourceType": "Condition", "id": "c1", "code": {"text": "Asthma"}, "subject": {"reference": "Patient/p1"}}
+not json
+`
+	records, summary, err := extractNDJSON(&Config{}, strings.NewReader(input), "Condition.ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || summary.MalformedRecords != 1 {
+		t.Fatalf("records=%d summary=%+v", len(records), summary)
+	}
+	if records[1]["patientId"] != "p1" || records[1]["content"] != "Medical Condition: Asthma" {
+		t.Errorf("record = %v", records[1])
+	}
+}
+
+func TestSourcePosition(t *testing.T) {
+	quietLogger(t)
+
+	input := `{"resourceType": "Patient", "id": "p1", "gender": "male"}
+
+not json
+{"resourceType": "Condition", "id": "c1", "code": {"text": "Asthma"}}
+`
+	records, _, err := extractNDJSON(&Config{}, strings.NewReader(input), "Condition.ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0]["sourceLine"] != "1" || records[1]["sourceLine"] != "4" {
+		t.Errorf("NDJSON records = %v, want sourceLine 1 and 4", records)
+	}
+
+	bundle := bundleJSON(
+		`{"resourceType": "Condition", "id": "c1", "code": {"text": "Asthma"}}`,
+		`{"resourceType": "Bundle", "type": "collection", "entry": [
+			{"resource": {"resourceType": "Condition", "id": "c2", "code": {"text": "Eczema"}}}
+		]}`,
+	)
+	records, _, err = extractBundle(&Config{}, strings.NewReader(bundle), "test.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := make(map[string]string)
+	for _, record := range records {
+		entries[record["id"]] = record["sourceEntry"]
+	}
+	if entries["c1"] != "0" || entries["c2"] != "1.0" {
+		t.Errorf("sourceEntry = %v, want c1 at 0 and c2 at 1.0", entries)
+	}
+
+	if got := sourcePosition(records[0]); got != " at entry 0" {
+		t.Errorf("sourcePosition = %q", got)
+	}
+}
+
+func TestExtractContentConditionOnsetAndAbatement(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want []string
+		not  []string
+	}{
+		{
+			name: "resolved with onset period",
+			raw: `{
+				"code": {"text": "Acute bronchitis"},
+				"clinicalStatus": {"coding": [{"code": "resolved"}]},
+				"verificationStatus": {"coding": [{"code": "confirmed"}]},
+				"onsetPeriod": {"start": "2019-01-10", "end": "2019-01-12"},
+				"abatementDateTime": "2019-02-01"
+			}`,
+			want: []string{"Status: resolved", "Verification: confirmed", "Onset: 2019-01-10 to 2019-01-12", "Abated: 2019-02-01"},
+		},
+		{
+			name: "onset age and abatement boolean",
+			raw:  `{"code": {"text": "Chickenpox"}, "onsetAge": {"value": 6, "unit": "years"}, "abatementBoolean": true}`,
+			want: []string{"Onset: age 6 years", "Abated: yes"},
+		},
+		{
+			name: "still active",
+			raw:  `{"code": {"text": "Hypertension"}, "verificationStatus": {"coding": [{"code": "provisional"}]}, "abatementBoolean": false}`,
+			want: []string{"Verification: provisional"},
+			not:  []string{"Abated"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := extractContent(&Config{}, mustResource(t, tt.raw), "Condition", nil)
+			for _, want := range tt.want {
+				if !strings.Contains(content, want) {
+					t.Errorf("content %q missing %q", content, want)
+				}
+			}
+			for _, not := range tt.not {
+				if strings.Contains(content, not) {
+					t.Errorf("content %q unexpectedly contains %q", content, not)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractContentConditionSeverityAndBodySite(t *testing.T) {
+	resource := mustResource(t, `{
+		"code": {"text": "Burn of skin"},
+		"clinicalStatus": {"coding": [{"code": "active"}]},
+		"severity": {"coding": [{"system": "http://snomed.info/sct", "code": "24484000", "display": "Severe"}]},
+		"bodySite": [{"text": "Left forearm"}, {"coding": [{"display": "Left hand"}]}],
+		"onsetDateTime": "2022-07-04"
+	}`)
+	want := "Medical Condition: Burn of skin Status: active Severity: Severe Body site: Left forearm, Left hand Onset: 2022-07-04"
+	if got := extractContent(&Config{}, resource, "Condition", nil); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestTypeFilters(t *testing.T) {
+	quietLogger(t)
+
+	input := bundleJSON(
+		testPatient,
+		`{"resourceType": "Condition", "id": "c1", "code": {"text": "Asthma"}}`,
+		`{"resourceType": "Encounter", "id": "e1", "type": [{"text": "Office visit"}]}`,
+	)
+
+	var include, exclude stringSet
+	include.Set("Condition, Observation")
+	exclude.Set("Encounter")
+
+	tests := []struct {
+		name     string
+		cfg      Config
+		want     []string
+		filtered int
+	}{
+		{"no filters", Config{}, []string{"Patient", "Condition", "Encounter"}, 0},
+		{"include", Config{IncludeTypes: include}, []string{"Condition"}, 2},
+		{"exclude", Config{ExcludeTypes: exclude}, []string{"Patient", "Condition"}, 1},
+		{"include wins", Config{IncludeTypes: include, ExcludeTypes: stringSet{"Condition": true}}, []string{"Condition"}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, summary, err := extractBundle(&tt.cfg, strings.NewReader(input), "test.json")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, r := range records {
+				got = append(got, r["resourceType"])
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("types = %v, want %v", got, tt.want)
+			}
+			if summary.SkippedFiltered != tt.filtered {
+				t.Errorf("SkippedFiltered = %d, want %d", summary.SkippedFiltered, tt.filtered)
+			}
+		})
+	}
+}
+
+func TestExtractBundleSearchsetSkipsOperationOutcome(t *testing.T) {
+	quietLogger(t)
+
+	input := `{
+		"resourceType": "Bundle",
+		"type": "searchset",
+		"entry": [
+			{"fullUrl": "Condition/c1", "resource": {"resourceType": "Condition", "id": "c1", "code": {"text": "Asthma"}}, "search": {"mode": "match"}},
+			{"resource": {"resourceType": "OperationOutcome", "issue": [{"severity": "warning", "code": "processing", "diagnostics": "Results truncated"}]}, "search": {"mode": "outcome"}},
+			{"resource": {"resourceType": "Bundle", "type": "collection", "entry": []}}
+		]
+	}`
+	records, summary, err := extractBundle(&Config{}, strings.NewReader(input), "search.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0]["resourceType"] != "Condition" {
+		t.Fatalf("records = %v", records)
+	}
+	// The empty nested Bundle is descended into and contributes nothing
+	if summary.SkippedFiltered != 1 || summary.ByType["OperationOutcome"].SkippedFiltered != 1 {
+		t.Errorf("summary = %+v", summary)
+	}
+}
+
+func TestExtractBundleNested(t *testing.T) {
+	quietLogger(t)
+
+	// A searchset of $everything results: one nested Bundle per patient
+	everything := func(patient, condition string) string {
+		return fmt.Sprintf(`{"resource": {"resourceType": "Bundle", "type": "searchset", "entry": [
+			{"fullUrl": "urn:uuid:%[1]s", "resource": {"resourceType": "Patient", "id": "%[1]s", "gender": "male"}},
+			{"fullUrl": "urn:uuid:%[1]s-c", "resource": {"resourceType": "Condition", "id": "%[1]s-c", "code": {"text": "%[2]s"}}}
+		]}}`, patient, condition)
+	}
+	input := `{"resourceType": "Bundle", "type": "searchset", "entry": [` +
+		everything("pat-a", "Asthma") + "," + everything("pat-b", "Gout") + "," +
+		`{"resource": {"resourceType": "Observation", "id": "o1", "subject": {"reference": "urn:uuid:pat-b"}, "code": {"text": "Uric acid"}}}` +
+		`]}`
+	records, _, err := extractBundle(&Config{}, strings.NewReader(input), "everything.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"pat-a": "pat-a", "pat-a-c": "pat-a", "pat-b": "pat-b", "pat-b-c": "pat-b", "o1": "pat-b"}
+	if len(records) != len(want) {
+		t.Fatalf("got %d records, want %d", len(records), len(want))
+	}
+	for _, record := range records {
+		if record["patientId"] != want[record["id"]] {
+			t.Errorf("%s patientId = %q, want %q", record["id"], record["patientId"], want[record["id"]])
+		}
+	}
+
+	// Nesting beyond maxBundleDepth is skipped rather than followed
+	deep := `{"resourceType": "Condition", "id": "deep", "code": {"text": "Too deep"}}`
+	// The file's own Bundle plus one more nested level than allowed
+	for i := 0; i < maxBundleDepth+2; i++ {
+		deep = `{"resourceType": "Bundle", "type": "collection", "entry": [{"resource": ` + deep + `}]}`
+	}
+	records, summary, err := extractBundle(&Config{}, strings.NewReader(deep), "deep.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 0 || summary.ByType["Bundle"].SkippedFiltered != 1 {
+		t.Errorf("deep nesting: %d records, summary %+v", len(records), summary)
+	}
+}
+
+func TestDedupStores(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seen.bin")
+	stores := map[string]func() (dedupStore, error){
+		"memory": func() (dedupStore, error) { return openDedupStore(&Config{}) },
+		"file":   func() (dedupStore, error) { return openDedupStore(&Config{DedupFile: path, DedupCapacity: 64}) },
+	}
+	for name, open := range stores {
+		t.Run(name, func(t *testing.T) {
+			store, err := open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+
+			a := dedupKey(map[string]string{"resourceType": "Condition", "id": "c1", "content": "Asthma"})
+			changed := dedupKey(map[string]string{"resourceType": "Condition", "id": "c1", "content": "Asthma, resolved"})
+			for i, tc := range []struct {
+				key  [16]byte
+				want bool
+			}{{a, false}, {a, true}, {changed, false}, {changed, true}} {
+				got, err := store.CheckAndAdd(tc.key)
+				if err != nil || got != tc.want {
+					t.Errorf("step %d: CheckAndAdd = %v, %v; want %v", i, got, err, tc.want)
+				}
+			}
+		})
+	}
+
+	// The file-backed store remembers keys across reopen
+	store, err := openDedupStore(&Config{DedupFile: path, DedupCapacity: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	seen, _ := store.CheckAndAdd(dedupKey(map[string]string{"resourceType": "Condition", "id": "c1", "content": "Asthma"}))
+	if !seen {
+		t.Error("key not persisted in dedup file")
+	}
+}
+
+func TestFileDedupStoreReopenFull(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seen.bin")
+	key := func(id string) [16]byte {
+		return dedupKey(map[string]string{"resourceType": "Condition", "id": id})
+	}
+
+	// Capacity 2 is a 4-slot table, full at 2 keys
+	store, err := openFileDedupStore(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"c1", "c2"} {
+		if _, err := store.CheckAndAdd(key(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Close()
+
+	// Reopened, the keys already in the file still count toward the load
+	// factor, whatever capacity is asked for
+	store, err = openFileDedupStore(path, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if store.used != 2 {
+		t.Errorf("reopened store has %d used slots, want 2", store.used)
+	}
+	if seen, err := store.CheckAndAdd(key("c1")); err != nil || !seen {
+		t.Errorf("CheckAndAdd(c1) = %v, %v; want seen", seen, err)
+	}
+	if _, err := store.CheckAndAdd(key("c3")); err == nil || !strings.Contains(err.Error(), "full") {
+		t.Errorf("CheckAndAdd(c3) error = %v, want dedup file is full", err)
+	}
+}
+
+func TestProcessFileDedupAcrossFiles(t *testing.T) {
+	quietLogger(t)
+
+	dir := t.TempDir()
+	bundle := bundleJSON(`{"resourceType": "Condition", "id": "c1", "code": {"text": "Asthma"}}`)
+	cfg := &Config{Format: "auto", DryRun: true}
+	state := newRunState(cfg)
+	state.seenResources, _ = openDedupStore(cfg)
+
+	var total Summary = newSummary()
+	for _, name := range []string{"a.json", "b.json"} {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte(bundle), 0o644)
+		s, _, err := processFile(context.Background(), cfg, state, stdoutSink{state.estimateTokens}, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total.Add(s)
+	}
+	if total.Ingested != 1 || total.Duplicates != 1 {
+		t.Errorf("ingested=%d duplicates=%d, want 1 and 1", total.Ingested, total.Duplicates)
+	}
+}
+
+func TestExtractContentImmunizationOccurrence(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want []string
+	}{
+		{
+			name: "R4 occurrenceDateTime",
+			raw:  `{"vaccineCode": {"text": "Td (adult)"}, "status": "completed", "occurrenceDateTime": "2021-09-14T10:00:00Z"}`,
+			want: []string{"Td (adult)", "Status: completed", "Date: 2021-09-14T10:00:00Z"},
+		},
+		{
+			name: "R4 occurrenceString",
+			raw:  `{"vaccineCode": {"text": "MMR"}, "status": "not-done", "occurrenceString": "childhood"}`,
+			want: []string{"Status: not-done", "Date: childhood"},
+		},
+		{
+			name: "STU3 date",
+			raw:  `{"vaccineCode": {"text": "Influenza"}, "date": "2017-10-01"}`,
+			want: []string{"Date: 2017-10-01"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := extractContent(&Config{}, mustResource(t, tt.raw), "Immunization", nil)
+			for _, want := range tt.want {
+				if !strings.Contains(content, want) {
+					t.Errorf("content %q missing %q", content, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDeadLetterReplay(t *testing.T) {
+	quietLogger(t)
+
+	var accept bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !accept {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	cfg := &Config{PipelineURL: server.URL, RequestTimeout: time.Second, BatchSize: 1}
+	state := newRunState(cfg)
+	sink := httpSink{cfg, state}
+
+	dir := t.TempDir()
+	openDeadLetters := func(name string) string {
+		path := filepath.Join(dir, name)
+		f, err := openJSONLFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		state.deadLetters = f
+		return path
+	}
+	readEntries := func(path string) []deadLetterEntry {
+		t.Helper()
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var entries []deadLetterEntry
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var entry deadLetterEntry
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("dead-letter line %q: %v", line, err)
+			}
+			entries = append(entries, entry)
+		}
+		return entries
+	}
+
+	record := map[string]string{"id": "c1", "resourceType": "Condition", "content": "Medical Condition: Asthma", "sourceFile": "p1.ndjson", "sourceLine": "7"}
+
+	// The first failure is written with its status and a single attempt
+	first := openDeadLetters("first.jsonl")
+	summary := newSummary()
+	newRecordSender(context.Background(), cfg, state, sink, &summary).send(record)
+	state.deadLetters.Close()
+
+	entries := readEntries(first)
+	if len(entries) != 1 {
+		t.Fatalf("got %d dead-letter entries, want 1", len(entries))
+	}
+	if e := entries[0]; e.Record["id"] != "c1" || e.Record["sourceLine"] != "7" || e.StatusCode != http.StatusServiceUnavailable || e.Attempts != 1 || e.Error == "" {
+		t.Errorf("entry = %+v", e)
+	}
+
+	// Replaying against a still-failing pipeline increments the attempt count
+	cfg.Replay = first
+	second := openDeadLetters("second.jsonl")
+	summary, _, err := processFile(context.Background(), cfg, state, sink, first)
+	state.deadLetters.Close()
+	state.deadLetters = nil
+	if err != nil || summary.PipelineFailures != 1 {
+		t.Fatalf("replay: failures=%d err=%v", summary.PipelineFailures, err)
+	}
+	if entries := readEntries(second); len(entries) != 1 || entries[0].Attempts != 2 {
+		t.Errorf("replayed entries = %+v, want one with 2 attempts", entries)
+	}
+
+	// Once the pipeline recovers the record is ingested
+	accept = true
+	summary, err = replayDeadLetters(context.Background(), cfg, state, sink, second)
+	if err != nil || summary.Ingested != 1 || summary.PipelineFailures != 0 {
+		t.Errorf("recovered replay: ingested=%d failures=%d err=%v", summary.Ingested, summary.PipelineFailures, err)
+	}
+}
+
+func TestNormalizeDate(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{"2020", "2020"},
+		{"2020-03", "2020-03"},
+		{"2020-03-15", "2020-03-15"},
+		{"2020-03-15T10:00:00-05:00", "2020-03-15T10:00:00-05:00"},
+		{"2020-03-15T10:00:00.123+00:00", "2020-03-15T10:00:00Z"},
+		{"2020-03-15T10:00:00Z", "2020-03-15T10:00:00Z"},
+		{"2020-03-15T10:00:00", "2020-03-15T10:00:00"},
+		{"2020-03-15T10:00Z", "2020-03-15T10:00:00Z"},
+		{" 2020-03-15 ", "2020-03-15"},
+		// Invalid or unrecognized values pass through
+		{"2020-13", "2020-13"},
+		{"March 2020", "March 2020"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeDate(tt.raw); got != tt.want {
+			t.Errorf("normalizeDate(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+
+	// Dates are normalized where extractContent appends them
+	resource := mustResource(t, `{
+		"resourceType": "Procedure",
+		"code": {"text": "Appendectomy"},
+		"performedDateTime": "2019-07-04T08:30:00.000+00:00"
+	}`)
+	if got, want := extractContent(&Config{}, resource, "Procedure", nil), "Medical Procedure: Appendectomy Performed: 2019-07-04T08:30:00Z"; got != want {
+		t.Errorf("extractContent = %q, want %q", got, want)
+	}
+}
+
+func TestProcessFileStdin(t *testing.T) {
+	quietLogger(t)
+
+	stdin := filepath.Join(t.TempDir(), "bundle.json")
+	if err := os.WriteFile(stdin, []byte(bundleJSON(testPatient)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(stdin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	prev := os.Stdin
+	os.Stdin = f
+	t.Cleanup(func() { os.Stdin = prev })
+
+	out := filepath.Join(t.TempDir(), "records.jsonl")
+	cfg := &Config{Stdin: true, Format: "auto", OutputFile: out}
+	sink, err := openSink(cfg, newRunState(cfg), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	summary, _, err := processFile(context.Background(), cfg, newRunState(cfg), sink, stdinName)
+	sink.Close()
+	if err != nil || summary.Ingested != 1 {
+		t.Fatalf("ingested=%d err=%v, want 1 record", summary.Ingested, err)
+	}
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var record map[string]string
+	if err := json.Unmarshal(data, &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["sourceFile"] != "stdin" || record["patientId"] != "pat-1" {
+		t.Errorf("record = %v", record)
+	}
+}
+
+func TestEmbedPatientContext(t *testing.T) {
+	quietLogger(t)
+
+	bundle := bundleJSON(testPatient,
+		`{"resourceType": "Condition", "id": "c1", "code": {"text": "Asthma"}, "onsetDateTime": "2023-04-01T09:00:00Z"}`,
+		`{"resourceType": "Medication", "id": "m1", "code": {"text": "Albuterol"}}`,
+	)
+	records, _, err := extractBundle(&Config{EmbedPatientContext: true}, strings.NewReader(bundle), "test.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"Patient Information: Name: Jane Doe Gender: female Date of Birth: 1980-04-02",
+		"Patient: 42-year-old female. Medical Condition: Asthma Onset: 2023-04-01T09:00:00Z",
+		"Patient: female, born 1980-04-02. Medication: Albuterol",
+	}
+	if len(records) != len(want) {
+		t.Fatalf("got %d records, want %d", len(records), len(want))
+	}
+	for i, record := range records {
+		if record["content"] != want[i] {
+			t.Errorf("record %d content = %q, want %q", i, record["content"], want[i])
+		}
+	}
+
+	// Without the flag content is unchanged
+	records, _, _ = extractBundle(&Config{}, strings.NewReader(bundle), "test.json")
+	if got := records[1]["content"]; strings.HasPrefix(got, "Patient:") {
+		t.Errorf("content without -embed-patient-context = %q", got)
+	}
+}
+
+func TestAgeText(t *testing.T) {
+	tests := []struct {
+		birthDate, asOf, want string
+	}{
+		{"1980-04-02", "2023-04-02", "43-year-old"},
+		{"1980-04-02", "2023-04-01", "42-year-old"},
+		{"2022-01-15", "2022-09-20", "8-month-old"},
+		{"1980", "2020-06-01", "40-year-old"},
+		{"1980-04-02", "", ""},
+		{"", "2020-01-01", ""},
+		{"2020-01-01", "2019-01-01", ""},
+	}
+	for _, tt := range tests {
+		if got := ageText(tt.birthDate, tt.asOf); got != tt.want {
+			t.Errorf("ageText(%q, %q) = %q, want %q", tt.birthDate, tt.asOf, got, tt.want)
+		}
+	}
+}
+
+func TestMaxFailuresStopsRun(t *testing.T) {
+	quietLogger(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	var resources []string
+	for i := 0; i < 5; i++ {
+		resources = append(resources, fmt.Sprintf(`{"resourceType": "Condition", "id": "c%d", "code": {"text": "Asthma"}}`, i))
+	}
+	path := filepath.Join(t.TempDir(), "bundle.json")
+	if err := os.WriteFile(path, []byte(bundleJSON(resources...)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, abort := context.WithCancelCause(context.Background())
+	defer abort(nil)
+	cfg := &Config{Format: "auto", PipelineURL: server.URL, RequestTimeout: time.Second, BatchSize: 1, MaxFailures: 2}
+	state := newRunState(cfg)
+	state.failures = &failureLimit{max: 2, abort: abort, cause: errTooManyFailures}
+	summary, _, err := processFile(ctx, cfg, state, httpSink{cfg, state}, path)
+	if !errors.Is(err, errTooManyFailures) {
+		t.Errorf("processFile error = %v, want errTooManyFailures", err)
+	}
+	if summary.PipelineFailures != 3 {
+		t.Errorf("pipeline failures = %d, want 3 (stopped once the limit of 2 was exceeded)", summary.PipelineFailures)
+	}
+}
+
+func TestTimeoutTotalStopsRun(t *testing.T) {
+	quietLogger(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(40 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	var resources []string
+	for i := 0; i < 20; i++ {
+		resources = append(resources, fmt.Sprintf(`{"resourceType": "Condition", "id": "c%d", "code": {"text": "Asthma"}}`, i))
+	}
+	path := filepath.Join(t.TempDir(), "bundle.json")
+	if err := os.WriteFile(path, []byte(bundleJSON(resources...)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeoutCause(context.Background(), 100*time.Millisecond, errTimeoutTotal)
+	defer cancel()
+	cfg := &Config{Format: "auto", PipelineURL: server.URL, RequestTimeout: time.Second, BatchSize: 1, TimeoutTotal: 100 * time.Millisecond}
+	state := newRunState(cfg)
+	summary, _, err := processFile(ctx, cfg, state, httpSink{cfg, state}, path)
+	if !errors.Is(err, errTimeoutTotal) {
+		t.Errorf("processFile error = %v, want errTimeoutTotal", err)
+	}
+	// The request in flight at the deadline is allowed to finish
+	if summary.Ingested == 0 || summary.Ingested == len(resources) || summary.PipelineFailures != 0 {
+		t.Errorf("ingested=%d failures=%d, want a partial run with no failures", summary.Ingested, summary.PipelineFailures)
+	}
+}
+
+func TestExtractContentDocumentReference(t *testing.T) {
+	note := base64.StdEncoding.EncodeToString([]byte("Patient seen for follow-up.\nBlood pressure well controlled."))
+	html := base64.StdEncoding.EncodeToString([]byte("<p>Discharge &amp; follow-up</p>"))
+	tests := []struct {
+		name     string
+		resource string
+		want     string
+	}{
+		{
+			"plain text note",
+			`{"resourceType": "DocumentReference", "type": {"coding": [{"display": "Progress note"}]}, "date": "2021-05-04T10:00:00Z",
+			  "content": [{"attachment": {"contentType": "text/plain; charset=utf-8", "data": "` + note + `"}}]}`,
+			"Clinical Document: Progress note Date: 2021-05-04T10:00:00Z Patient seen for follow-up. Blood pressure well controlled.",
+		},
+		{
+			"html note",
+			`{"resourceType": "DocumentReference", "description": "Discharge summary",
+			  "content": [{"attachment": {"contentType": "text/html", "data": "` + html + `"}}]}`,
+			"Clinical Document: Discharge summary Discharge & follow-up",
+		},
+		{
+			"url attachment is not fetched",
+			`{"resourceType": "DocumentReference", "type": {"text": "Imaging report"},
+			  "content": [{"attachment": {"contentType": "application/pdf", "url": "https://example.org/r.pdf", "title": "CT chest"}}]}`,
+			"Clinical Document: Imaging report Attachment: CT chest",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := extractContent(&Config{}, mustResource(t, tt.resource), "DocumentReference", nil); got != tt.want {
+				t.Errorf("extractContent = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckPipelineHealth(t *testing.T) {
+	healthy := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/health" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+
+	cfg := &Config{HealthURL: server.URL + "/health", RequestTimeout: time.Second}
+	if err := checkPipelineHealth(context.Background(), cfg, newRunState(cfg).httpClient); err != nil {
+		t.Errorf("healthy pipeline: %v", err)
+	}
+	healthy = false
+	if err := checkPipelineHealth(context.Background(), cfg, newRunState(cfg).httpClient); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("unhealthy pipeline: err = %v, want status 503", err)
+	}
+	server.Close()
+	if err := checkPipelineHealth(context.Background(), cfg, newRunState(cfg).httpClient); err == nil {
+		t.Error("unreachable pipeline: want error")
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Time
+	}{
+		{"2024-03-01T08:00:00Z", time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)},
+		{"24h", now.Add(-24 * time.Hour)},
+		{"90m", now.Add(-90 * time.Minute)},
+		{"2024-03-01", time.Date(2024, 3, 1, 0, 0, 0, 0, time.Local)},
+	}
+	for _, tt := range tests {
+		got, err := parseSince(tt.value, now)
+		if err != nil || !got.Equal(tt.want) {
+			t.Errorf("parseSince(%q) = %v, %v; want %v", tt.value, got, err, tt.want)
+		}
+	}
+	for _, bad := range []string{"yesterday", "-24h", ""} {
+		if _, err := parseSince(bad, now); err == nil {
+			t.Errorf("parseSince(%q): want error", bad)
+		}
+	}
+}
+
+func TestExpandPath(t *testing.T) {
+	t.Setenv("DATA_DIR", "/mnt/exports")
+	t.Setenv("HOME", "/home/ingest")
+	t.Setenv("TILDE_DIR", "~/fhir")
+	for _, c := range []struct{ path, want string }{
+		{"$DATA_DIR/fhir", "/mnt/exports/fhir"},
+		{"${DATA_DIR}", "/mnt/exports"},
+		{"~/data/fhir", "/home/ingest/data/fhir"},
+		{"~", "/home/ingest"},
+		{"$TILDE_DIR", "/home/ingest/fhir"},
+		{"../data/fhir", "../data/fhir"},
+		{"data/~user", "data/~user"},
+	} {
+		got, err := expandPath(c.path)
+		if err != nil || got != c.want {
+			t.Errorf("expandPath(%q) = %q, %v; want %q", c.path, got, err, c.want)
+		}
+	}
+}
+
+func TestQuarantineFile(t *testing.T) {
+	quietLogger(t)
+
+	dataDir := filepath.Join(t.TempDir(), "fhir")
+	quarantine := filepath.Join(t.TempDir(), "quarantine")
+	bad := filepath.Join(dataDir, "site-a", "bad.json")
+	os.MkdirAll(filepath.Dir(bad), 0o755)
+	malformed := []byte(`{"resourceType": "Bundle", "entry": [`)
+	os.WriteFile(bad, malformed, 0o644)
+
+	cfg := &Config{Format: "auto"}
+	_, _, err := processFile(context.Background(), cfg, newRunState(cfg), &captureSink{}, bad)
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) || parseErr.File != bad {
+		t.Fatalf("err = %v, want a ParseError for %s", err, bad)
+	}
+	dest, err := quarantineFile(quarantine, dataDir, bad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(quarantine, "site-a", "bad.json"); dest != want {
+		t.Errorf("quarantined as %s, want %s", dest, want)
+	}
+	if data, err := os.ReadFile(dest); err != nil || !bytes.Equal(data, malformed) {
+		t.Errorf("quarantined file = %q, %v", data, err)
+	}
+	if _, err := os.Stat(bad); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("original still present: %v", err)
+	}
+
+	// A file outside the data directory keeps just its name
+	outside := filepath.Join(t.TempDir(), "export.ndjson")
+	os.WriteFile(outside, []byte("{"), 0o644)
+	if dest, err := quarantineFile(quarantine, dataDir, outside); err != nil || dest != filepath.Join(quarantine, "export.ndjson") {
+		t.Errorf("quarantined as %s, %v", dest, err)
+	}
+}
+
+func TestFilterModifiedSince(t *testing.T) {
+	dir := t.TempDir()
+	cutoff := time.Now().Add(-time.Hour)
+	var files []string
+	for name, modTime := range map[string]time.Time{
+		"old.json": cutoff.Add(-time.Hour),
+		"new.json": cutoff.Add(time.Minute),
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("{}"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, path)
+	}
+
+	kept, skipped, err := filterModifiedSince(files, cutoff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kept) != 1 || filepath.Base(kept[0]) != "new.json" || skipped != 1 {
+		t.Errorf("kept=%v skipped=%d, want [new.json] and 1", kept, skipped)
+	}
+}
+
+func TestCheckpointResume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.txt")
+	files := []string{"data/a.json", "data/b.json", "data/c.ndjson"}
+
+	// First run: a.json completes, then the run dies while adding b.json
+	first, err := openCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kept, skipped := first.filter(files); len(kept) != 3 || skipped != 0 {
+		t.Errorf("new checkpoint kept %v, skipped %d", kept, skipped)
+	}
+	if err := first.add("data/a.json"); err != nil {
+		t.Fatal(err)
+	}
+	first.f.WriteString("data/b.js")
+	first.Close()
+
+	// Resumed run: only a.json is skipped, and c.ndjson is added after it
+	second, err := openCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, skipped := second.filter(files)
+	if fmt.Sprint(kept) != "[data/b.json data/c.ndjson]" || skipped != 1 {
+		t.Errorf("resumed run kept %v, skipped %d", kept, skipped)
+	}
+	if err := second.add("data/c.ndjson"); err != nil {
+		t.Fatal(err)
+	}
+	second.Close()
+
+	third, err := openCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer third.Close()
+	if kept, _ := third.filter(files); fmt.Sprint(kept) != "[data/b.json]" {
+		t.Errorf("third run kept %v, want [data/b.json]", kept)
+	}
+
+	var none *checkpointFile
+	if err := none.add("data/a.json"); err != nil {
+		t.Errorf("nil checkpoint add: %v", err)
+	}
+}
+
+func TestExtractBundleR4EncounterReasons(t *testing.T) {
+	quietLogger(t)
+
+	bundle := `{"resourceType": "Bundle", "type": "collection", "entry": [
+		{"fullUrl": "urn:uuid:cond-1", "resource": {"resourceType": "Condition", "id": "cond-1", "code": {"coding": [{"display": "Acute bronchitis"}]}}},
+		{"fullUrl": "urn:uuid:enc-1", "resource": {"resourceType": "Encounter", "id": "enc-1",
+			"type": [{"text": "Urgent care visit"}],
+			"period": {"start": "2021-01-05T09:00:00-05:00", "end": "2021-01-05T09:45:00-05:00"},
+			"reasonCode": [{"coding": [{"display": "Cough"}]}],
+			"reasonReference": [{"reference": "urn:uuid:cond-1"}, {"reference": "Condition/missing", "display": "Fever"}]}}
+	]}`
+	records, _, err := extractBundle(&Config{}, strings.NewReader(bundle), "test.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Healthcare Encounter: Urgent care visit Start: 2021-01-05T09:00:00-05:00 End: 2021-01-05T09:45:00-05:00 Reason: Cough, Acute bronchitis, Fever"
+	if got := records[1]["content"]; got != want {
+		t.Errorf("content = %q, want %q", got, want)
+	}
+
+	// Without the Bundle only the reference display is available
+	encounter := mustResource(t, `{"resourceType": "Encounter", "reasonReference": [{"reference": "Condition/cond-1"}, {"reference": "Condition/c2", "display": "Fever"}]}`)
+	if got := extractContent(&Config{}, encounter, "Encounter", nil); got != "Healthcare Encounter: Reason: Fever" {
+		t.Errorf("unresolved content = %q", got)
+	}
+}
+
+func TestTruncateContent(t *testing.T) {
+	tests := []struct {
+		content   string
+		max       int
+		want      string
+		truncated bool
+	}{
+		{"short", 10, "short", false},
+		{"exactly ten", 11, "exactly ten", false},
+		{"Medical Condition: Asthma", 20, "Medical Condition:", true},
+		{"Medical Condition: Asthma", 18, "Medical Condition:", true},
+		{"Medical Condition: Asthma", 19, "Medical Condition:", true},
+		{"Supercalifragilistic", 5, "Super", true},
+		{"Prénom Zoë Müller", 11, "Prénom Zoë", true},
+	}
+	for _, tt := range tests {
+		got, truncated := truncateContent(tt.content, tt.max)
+		if got != tt.want || truncated != tt.truncated {
+			t.Errorf("truncateContent(%q, %d) = %q, %v; want %q, %v", tt.content, tt.max, got, truncated, tt.want, tt.truncated)
+		}
+		if n := len([]rune(got)); n > tt.max {
+			t.Errorf("truncateContent(%q, %d) is %d chars", tt.content, tt.max, n)
+		}
+	}
+}
+
+func TestPipelineAuthHeaders(t *testing.T) {
+	var got []http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Header.Clone())
+	}))
+	defer server.Close()
+
+	cfg := &Config{PipelineURL: server.URL, HealthURL: server.URL + "/health", RequestTimeout: time.Second, AuthToken: "s3cret"}
+	for _, h := range []string{"X-Tenant=north", "X-Trace = abc"} {
+		if err := cfg.Headers.Set(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cfg.Headers.Set("no-equals"); err == nil {
+		t.Error("-header without '=': want error")
+	}
+
+	if err := checkPipelineHealth(context.Background(), cfg, newRunState(cfg).httpClient); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendToPipeline(context.Background(), cfg, newRunState(cfg), map[string]string{"id": "c1"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d requests, want 2", len(got))
+	}
+	for i, h := range got {
+		if h.Get("Authorization") != "Bearer s3cret" || h.Get("X-Tenant") != "north" || h.Get("X-Trace") != "abc" {
+			t.Errorf("request %d headers = %v", i, h)
+		}
+	}
+	if got[0].Get("Content-Type") != "" || got[1].Get("Content-Type") != "application/json" {
+		t.Errorf("Content-Type: health %q, ingest %q", got[0].Get("Content-Type"), got[1].Get("Content-Type"))
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	var keys []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+	}))
+	defer server.Close()
+
+	cfg := &Config{PipelineURL: server.URL, RequestTimeout: time.Second}
+	record := map[string]string{"resourceType": "Condition", "id": "c1", "sourceFile": "a.json", "content": "Asthma"}
+	updated := map[string]string{"resourceType": "Condition", "id": "c1", "sourceFile": "a.json", "content": "Asthma, resolved"}
+	other := map[string]string{"resourceType": "Condition", "id": "c1", "sourceFile": "b.json", "content": "Asthma"}
+	for _, r := range []map[string]string{record, updated, other} {
+		if err := sendToPipeline(context.Background(), cfg, newRunState(cfg), r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(keys[0]) != 64 {
+		t.Errorf("key %q is not a hex sha256", keys[0])
+	}
+	if keys[0] != keys[1] {
+		t.Error("key changed with content; want it stable per resource")
+	}
+	if keys[0] == keys[2] {
+		t.Error("same key for different source files")
+	}
+}
+
+func TestEndpointPoolRoundRobin(t *testing.T) {
+	quietLogger(t)
+
+	hits := make([]int, 2)
+	var servers []string
+	for i := range hits {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits[i]++
+		}))
+		defer server.Close()
+		servers = append(servers, server.URL)
+	}
+	// Nothing listens on a closed server's address
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	cfg := &Config{PipelineURL: "http://unused.invalid", PipelineURLs: []string{servers[0], dead.URL, servers[1]}, RequestTimeout: time.Second}
+	state := newRunState(cfg)
+
+	var errs int
+	for i := 0; i < 7; i++ {
+		if err := sendToPipeline(context.Background(), cfg, state, map[string]string{"id": fmt.Sprint(i)}); err != nil {
+			errs++
+		}
+	}
+	// The dead endpoint fails once and is then skipped
+	if errs != 1 {
+		t.Errorf("got %d failed requests, want 1", errs)
+	}
+	if hits[0] != 3 || hits[1] != 3 {
+		t.Errorf("hits = %v, want [3 3]", hits)
+	}
+
+	// With every endpoint down, requests still go somewhere
+	pool := newEndpointPool([]string{"a", "b"})
+	pool.report("a", false)
+	pool.report("b", false)
+	if got := pool.pick("fallback"); got != "a" {
+		t.Errorf("pick with all endpoints down = %q, want a", got)
+	}
+	if got := (*endpointPool)(nil).pick("fallback"); got != "fallback" {
+		t.Errorf("nil pool pick = %q, want fallback", got)
+	}
+}
+
+func TestExtractBundleMedicationStatementAndDispense(t *testing.T) {
+	quietLogger(t)
+
+	bundle := `{"resourceType": "Bundle", "type": "collection", "entry": [
+		{"fullUrl": "urn:uuid:med-1", "resource": {"resourceType": "Medication", "id": "med-1", "code": {"coding": [{"display": "Lisinopril 10 MG Oral Tablet"}]}}},
+		{"fullUrl": "urn:uuid:ms-1", "resource": {"resourceType": "MedicationStatement", "id": "ms-1", "status": "active",
+			"medicationCodeableConcept": {"text": "Atorvastatin 20 MG"},
+			"dosage": [{"text": "1 tablet nightly"}],
+			"effectivePeriod": {"start": "2020-01-01"}, "dateAsserted": "2021-02-03"}},
+		{"fullUrl": "urn:uuid:md-1", "resource": {"resourceType": "MedicationDispense", "id": "md-1", "status": "completed",
+			"medicationReference": {"reference": "urn:uuid:med-1"},
+			"quantity": {"value": 30, "unit": "tablet"}, "daysSupply": {"value": 30, "unit": "days"},
+			"dosageInstruction": [{"text": "Take 1 tablet daily"}], "whenHandedOver": "2021-03-04T15:20:00Z"}},
+		{"fullUrl": "urn:uuid:mr-1", "resource": {"resourceType": "MedicationRequest", "id": "mr-1", "status": "active",
+			"medicationReference": {"reference": "Medication/med-1"}}}
+	]}`
+	records, _, err := extractBundle(&Config{}, strings.NewReader(bundle), "test.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"Medication: Lisinopril 10 MG Oral Tablet",
+		"Medication Statement: Atorvastatin 20 MG Status: active Dosage: 1 tablet nightly Effective: 2020-01-01 Asserted: 2021-02-03",
+		"Medication Dispense: Lisinopril 10 MG Oral Tablet Status: completed Quantity: 30 tablet Days Supply: 30 days Dosage: Take 1 tablet daily Handed Over: 2021-03-04T15:20:00Z",
+		"Medication Prescription: Lisinopril 10 MG Oral Tablet Status: active",
+	}
+	if len(records) != len(want) {
+		t.Fatalf("got %d records, want %d", len(records), len(want))
+	}
+	for i, record := range records {
+		if record["content"] != want[i] {
+			t.Errorf("record %d content = %q, want %q", i, record["content"], want[i])
+		}
+	}
+}
+
+func TestFindInputFiles(t *testing.T) {
+	quietLogger(t)
+
+	root := t.TempDir()
+	for _, name := range []string{
+		"a.json", "b.ndjson.gz", "notes.txt",
+		"patients/p1/bundle.json", "patients/p2/Patient.ndjson",
+	} {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("{}"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A loop back to the root and a link to a directory outside it
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "linked.json"), []byte("{}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(root, filepath.Join(root, "patients", "loop")); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "linked")); err != nil {
+		t.Fatal(err)
+	}
+
+	rel := func(files []string) string {
+		var names []string
+		for _, f := range files {
+			r, _ := filepath.Rel(root, f)
+			names = append(names, filepath.ToSlash(r))
+		}
+		return strings.Join(names, " ")
+	}
+	tests := []struct {
+		name string
+		cfg  Config
+		want string
+	}{
+		{"top level", Config{}, "a.json b.ndjson.gz"},
+		{"recursive", Config{Recursive: true}, "a.json b.ndjson.gz linked/linked.json patients/p1/bundle.json patients/p2/Patient.ndjson"},
+		{"glob", Config{Glob: "*.txt"}, "notes.txt"},
+		{"recursive glob", Config{Recursive: true, Glob: "Patient*.ndjson"}, "patients/p2/Patient.ndjson"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files, err := findInputFiles(&tt.cfg, root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := rel(files); got != tt.want {
+				t.Errorf("files = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunMetrics(t *testing.T) {
+	m := newRunMetrics()
+	fileSummary := newSummary()
+	fileSummary.Ingested = 3
+	fileSummary.SkippedEmpty = 1
+	fileSummary.PipelineFailures = 2
+	m.addFile("completed", fileSummary)
+	m.addFile("failed", newSummary())
+	m.observeRequest(30 * time.Millisecond)
+	m.observeRequest(2 * time.Second)
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		`fhir_ingest_files_total{status="completed"} 1`,
+		`fhir_ingest_files_total{status="failed"} 1`,
+		`fhir_ingest_files_total{status="interrupted"} 0`,
+		`fhir_ingest_entries_total{outcome="ingested"} 3`,
+		`fhir_ingest_entries_total{outcome="skipped_empty"} 1`,
+		`fhir_ingest_entries_total{outcome="failed"} 2`,
+		`fhir_ingest_request_duration_seconds_bucket{le="0.025"} 0`,
+		`fhir_ingest_request_duration_seconds_bucket{le="0.05"} 1`,
+		`fhir_ingest_request_duration_seconds_bucket{le="2.5"} 2`,
+		`fhir_ingest_request_duration_seconds_bucket{le="+Inf"} 2`,
+		`fhir_ingest_request_duration_seconds_count 2`,
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("metrics missing %q:\n%s", want, body)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/other", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("GET /other = %d, want 404", rec.Code)
+	}
+
+	// Disabled metrics are a nil *runMetrics
+	var disabled *runMetrics
+	disabled.addFile("completed", fileSummary)
+	disabled.observeRequest(time.Second)
+}
+
+func TestApplyConfigFile(t *testing.T) {
+	newFlags := func() (*flag.FlagSet, *Config) {
+		var cfg Config
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		fs.IntVar(&cfg.Concurrency, "concurrency", 4, "")
+		fs.BoolVar(&cfg.DryRun, "dry-run", false, "")
+		fs.StringVar(&cfg.PipelineURL, "pipeline-url", "http://localhost:8000/embeddings/ingest", "")
+		fs.DurationVar(&cfg.RequestTimeout, "request-timeout", 30*time.Second, "")
+		fs.Var(&cfg.IncludeTypes, "include-types", "")
+		fs.Var(&cfg.Headers, "header", "")
+		return fs, &cfg
+	}
+	writeConfig := func(t *testing.T, content string) string {
+		t.Helper()
+		path := filepath.Join(t.TempDir(), "config.json")
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	path := writeConfig(t, `{
+		"concurrency": 8,
+		"dry-run": true,
+		"pipeline-url": "http://ingest.internal/embeddings/ingest",
+		"request-timeout": "5s",
+		"include-types": ["Condition", "Observation"],
+		"header": ["X-Tenant=north", "X-Env=prod"]
+	}`)
+	fs, cfg := newFlags()
+	if err := fs.Parse([]string{"-concurrency", "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfigFile(fs, path); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Concurrency != 2 {
+		t.Errorf("concurrency = %d, want the command-line value 2", cfg.Concurrency)
+	}
+	if !cfg.DryRun || cfg.PipelineURL != "http://ingest.internal/embeddings/ingest" || cfg.RequestTimeout != 5*time.Second {
+		t.Errorf("config values not applied: %+v", cfg)
+	}
+	if !cfg.IncludeTypes["Condition"] || !cfg.IncludeTypes["Observation"] || len(cfg.IncludeTypes) != 2 {
+		t.Errorf("include-types = %v", cfg.IncludeTypes)
+	}
+	if http.Header(cfg.Headers).Get("X-Tenant") != "north" || http.Header(cfg.Headers).Get("X-Env") != "prod" {
+		t.Errorf("headers = %v", cfg.Headers)
+	}
+
+	for name, content := range map[string]string{
+		"unknown key":  `{"concurency": 8}`,
+		"bad value":    `{"concurrency": "many"}`,
+		"nested value": `{"pipeline-url": {"host": "x"}}`,
+		"invalid json": `{"concurrency": 8`,
+	} {
+		fs, _ := newFlags()
+		if err := applyConfigFile(fs, writeConfig(t, content)); err == nil {
+			t.Errorf("%s: want error", name)
+		}
+	}
+}
+
+func TestExtractContentUSCoreRaceEthnicity(t *testing.T) {
+	patient := mustResource(t, `{
+		"resourceType": "Patient",
+		"gender": "male",
+		"extension": [
+			{"url": "http://hl7.org/fhir/us/core/StructureDefinition/us-core-race", "extension": [
+				{"url": "ombCategory", "valueCoding": {"system": "urn:oid:2.16.840.1.113883.6.238", "code": "2106-3", "display": "White"}},
+				{"url": "ombCategory", "valueCoding": {"system": "urn:oid:2.16.840.1.113883.6.238", "code": "2028-9", "display": "Asian"}}
+			]},
+			{"url": "http://hl7.org/fhir/us/core/StructureDefinition/us-core-ethnicity", "extension": [
+				{"url": "ombCategory", "valueCoding": {"system": "urn:oid:2.16.840.1.113883.6.238", "code": "2186-5", "display": "Not Hispanic or Latino"}},
+				{"url": "text", "valueString": "Not Hispanic or Latino"}
+			]},
+			{"url": "http://hl7.org/fhir/StructureDefinition/patient-birthPlace", "valueAddress": {"city": "Boston"}}
+		]
+	}`)
+	want := "Patient Information: Gender: male Race: White, Asian Ethnicity: Not Hispanic or Latino"
+	if got := extractContent(&Config{}, patient, "Patient", nil); got != want {
+		t.Errorf("extractContent = %q, want %q", got, want)
+	}
+}
+
+func TestExtractBundleMultiplePatients(t *testing.T) {
+	quietLogger(t)
+
+	bundle := `{"resourceType": "Bundle", "type": "transaction", "entry": [
+		{"fullUrl": "urn:uuid:obs-1", "resource": {"resourceType": "Observation", "id": "obs-1", "code": {"text": "Heart rate"}, "subject": {"reference": "urn:uuid:pat-b"}}},
+		{"fullUrl": "urn:uuid:pat-a", "resource": {"resourceType": "Patient", "id": "pat-a", "gender": "female", "birthDate": "1970-01-01"}},
+		{"fullUrl": "urn:uuid:pat-b", "resource": {"resourceType": "Patient", "id": "pat-b", "gender": "male", "birthDate": "2000-01-01"}},
+		{"fullUrl": "urn:uuid:cond-1", "resource": {"resourceType": "Condition", "id": "cond-1", "code": {"text": "Asthma"}, "subject": {"reference": "Patient/pat-a"}, "onsetDateTime": "2020-06-01"}},
+		{"fullUrl": "urn:uuid:allergy-1", "resource": {"resourceType": "AllergyIntolerance", "id": "allergy-1", "code": {"text": "Peanut"}, "patient": {"reference": "Patient/pat-c"}}},
+		{"fullUrl": "urn:uuid:org-1", "resource": {"resourceType": "Organization", "id": "org-1", "name": "Clinic"}}
+	]}`
+	records, _, err := extractBundle(&Config{EmbedPatientContext: true}, strings.NewReader(bundle), "test.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"obs-1":     "pat-b", // resolved by fullUrl, listed before its Patient
+		"pat-a":     "pat-a",
+		"pat-b":     "pat-b",
+		"cond-1":    "pat-a", // resolved by Type/id
+		"allergy-1": "pat-c", // not in the Bundle
+		"org-1":     "pat-a", // no patient reference: first Patient in the Bundle
+	}
+	for _, record := range records {
+		if got := record["patientId"]; got != want[record["id"]] {
+			t.Errorf("%s: patientId = %q, want %q", record["id"], got, want[record["id"]])
+		}
+	}
+	if got := records[0]["content"]; !strings.HasPrefix(got, "Patient: male, born 2000-01-01.") {
+		t.Errorf("obs-1 content = %q, want pat-b's demographics", got)
+	}
+	if got := records[3]["content"]; !strings.HasPrefix(got, "Patient: 50-year-old female.") {
+		t.Errorf("cond-1 content = %q, want pat-a's demographics", got)
+	}
+}
+
+func TestExtractBundleCoverageAndClaim(t *testing.T) {
+	quietLogger(t)
+
+	bundle := `{"resourceType": "Bundle", "type": "collection", "entry": [
+		{"fullUrl": "urn:uuid:org-1", "resource": {"resourceType": "Organization", "id": "org-1", "name": "Acme Health Plan"}},
+		{"fullUrl": "urn:uuid:cond-1", "resource": {"resourceType": "Condition", "id": "cond-1", "code": {"text": "Type 2 diabetes"}}},
+		{"fullUrl": "urn:uuid:cov-1", "resource": {"resourceType": "Coverage", "id": "cov-1", "status": "active",
+			"type": {"coding": [{"display": "health insurance plan policy"}]},
+			"subscriber": {"reference": "Patient/pat-1"}, "relationship": {"coding": [{"code": "self"}]},
+			"payor": [{"reference": "urn:uuid:org-1"}], "period": {"start": "2021-01-01", "end": "2021-12-31"}}},
+		{"fullUrl": "urn:uuid:claim-1", "resource": {"resourceType": "Claim", "id": "claim-1", "status": "active",
+			"type": {"coding": [{"code": "professional"}]},
+			"billablePeriod": {"start": "2021-03-04T09:00:00Z", "end": "2021-03-04T09:30:00Z"},
+			"diagnosis": [{"sequence": 1, "diagnosisReference": {"reference": "urn:uuid:cond-1"}}],
+			"item": [{"sequence": 1, "productOrService": {"coding": [{"display": "Office visit"}]}},
+				{"sequence": 2, "productOrService": {"text": "Hemoglobin A1c"}}]}}
+	]}`
+	records, _, err := extractBundle(&Config{}, strings.NewReader(bundle), "test.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"cov-1":   "Insurance Coverage: health insurance plan policy Status: active Payor: Acme Health Plan Subscriber: self Period: 2021-01-01 to 2021-12-31",
+		"claim-1": "Claim: professional Status: active Billable period: 2021-03-04T09:00:00Z to 2021-03-04T09:30:00Z Diagnosis: Type 2 diabetes Items: Office visit, Hemoglobin A1c",
+	}
+	for _, record := range records {
+		if w, ok := want[record["id"]]; ok && record["content"] != w {
+			t.Errorf("%s content = %q, want %q", record["id"], record["content"], w)
+		}
+	}
+}
+
+func TestCategoryTexts(t *testing.T) {
+	tests := []struct {
+		name         string
+		resourceType string
+		resource     string
+		want         string
+	}{
+		{"observation array", "Observation",
+			`{"code": {"text": "Glucose"}, "category": [{"coding": [{"system": "http://terminology.hl7.org/CodeSystem/observation-category", "code": "laboratory", "display": "Laboratory"}]}]}`,
+			"Clinical Observation: Glucose Category: Laboratory"},
+		{"code only", "Observation",
+			`{"code": {"text": "Heart rate"}, "category": [{"coding": [{"code": "vital-signs"}]}]}`,
+			"Clinical Observation: Heart rate Category: vital-signs"},
+		{"condition multiple", "Condition",
+			`{"code": {"text": "Asthma"}, "category": [{"coding": [{"code": "problem-list-item"}]}, {"text": "Chronic"}]}`,
+			"Medical Condition: Asthma Category: problem-list-item, Chronic"},
+		{"single object", "Condition",
+			`{"code": {"text": "Smoker"}, "category": {"coding": [{"code": "social-history"}]}}`,
+			"Medical Condition: Smoker Category: social-history"},
+		{"STU3 document class", "DocumentReference",
+			`{"type": {"text": "Discharge summary"}, "class": {"coding": [{"display": "Clinical Note"}]}}`,
+			"Clinical Document: Discharge summary Category: Clinical Note"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := extractContent(&Config{}, mustResource(t, tt.resource), tt.resourceType, nil); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractBundleDiagnosticReportResults(t *testing.T) {
+	quietLogger(t)
+
+	bundle := `{"resourceType": "Bundle", "type": "collection", "entry": [
+		{"fullUrl": "urn:uuid:dr-1", "resource": {"resourceType": "DiagnosticReport", "id": "dr-1",
+			"code": {"text": "Basic metabolic panel"}, "effectiveDateTime": "2021-06-01",
+			"result": [{"reference": "urn:uuid:obs-1"}, {"reference": "Observation/obs-2"}, {"reference": "Observation/missing", "display": "Sodium"}],
+			"conclusion": "Hyperglycemia", "conclusionCode": [{"coding": [{"display": "Diabetes mellitus"}]}]}},
+		{"fullUrl": "urn:uuid:obs-1", "resource": {"resourceType": "Observation", "id": "obs-1", "code": {"text": "Glucose"},
+			"valueQuantity": {"value": 182, "unit": "mg/dL"}, "interpretation": [{"coding": [{"code": "H"}]}]}},
+		{"fullUrl": "urn:uuid:obs-2", "resource": {"resourceType": "Observation", "id": "obs-2", "code": {"text": "Potassium"},
+			"valueQuantity": {"value": 4.1, "unit": "mmol/L"}}},
+		{"fullUrl": "urn:uuid:dr-2", "resource": {"resourceType": "DiagnosticReport", "id": "dr-2", "code": {"text": "Urinalysis"},
+			"contained": [{"resourceType": "Observation", "id": "u1", "code": {"text": "Protein"}, "valueCodeableConcept": {"text": "Negative"}}],
+			"result": [{"reference": "#u1"}]}}
+	]}`
+	records, _, err := extractBundle(&Config{}, strings.NewReader(bundle), "test.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"dr-1": "Diagnostic Report: Basic metabolic panel Date: 2021-06-01 Results: Glucose 182.00 mg/dL (High); Potassium 4.10 mmol/L; Sodium Conclusion: Hyperglycemia; Diabetes mellitus",
+		"dr-2": "Diagnostic Report: Urinalysis Results: Protein Negative",
+	}
+	for _, record := range records {
+		if w, ok := want[record["id"]]; ok && record["content"] != w {
+			t.Errorf("%s content = %q, want %q", record["id"], record["content"], w)
+		}
+	}
+}
+
+func TestIncrementalCache(t *testing.T) {
+	quietLogger(t)
+
+	var received []string
+	reject := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var record map[string]string
+		json.NewDecoder(r.Body).Decode(&record)
+		if record["id"] == reject {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		received = append(received, record["id"])
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	cachePath := filepath.Join(dir, "cache.json")
+	input := filepath.Join(dir, "bundle.json")
+	cfg := &Config{Format: "auto", PipelineURL: server.URL, RequestTimeout: time.Second, BatchSize: 1}
+
+	// run processes input with a cache loaded from and saved to cachePath,
+	// like a separate invocation of the tool.
+	run := func(asthma string) Summary {
+		t.Helper()
+		os.WriteFile(input, []byte(bundleJSON(
+			`{"resourceType": "Condition", "id": "c1", "code": {"text": "`+asthma+`"}}`,
+			`{"resourceType": "Condition", "id": "c2", "code": {"text": "Eczema"}}`,
+		)), 0o644)
+		state := newRunState(cfg)
+		var err error
+		if state.ingestCache, err = loadChangeCache(cachePath); err != nil {
+			t.Fatal(err)
+		}
+		received = nil
+		summary, _, err := processFile(context.Background(), cfg, state, httpSink{cfg, state}, input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := state.ingestCache.save(); err != nil {
+			t.Fatal(err)
+		}
+		return summary
+	}
+
+	// c2 fails the first time, so it isn't cached
+	reject = "c2"
+	run("Asthma")
+	reject = ""
+	if s := run("Asthma"); s.Unchanged != 1 || fmt.Sprint(received) != "[c2]" {
+		t.Errorf("second run: unchanged=%d, sent %v; want 1 and [c2]", s.Unchanged, received)
+	}
+	if s := run("Asthma, resolved"); s.Unchanged != 1 || fmt.Sprint(received) != "[c1]" {
+		t.Errorf("after edit: unchanged=%d, sent %v; want 1 and [c1]", s.Unchanged, received)
+	}
+
+	if err := os.WriteFile(cachePath, []byte("not json"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadChangeCache(cachePath); err == nil {
+		t.Error("loading a corrupt cache: want error")
+	}
+}
+
+func TestDecodeXMLBundle(t *testing.T) {
+	quietLogger(t)
+
+	const xmlBundle = `<?xml version="1.0" encoding="UTF-8"?>
+<Bundle xmlns="http://hl7.org/fhir">
+  <id value="b1"/>
+  <type value="collection"/>
+  <entry>
+    <fullUrl value="urn:uuid:pat-1"/>
+    <resource>
+      <Patient>
+        <id value="pat-1"/>
+        <extension url="http://hl7.org/fhir/us/core/StructureDefinition/us-core-race">
+          <extension url="text"><valueString value="White"/></extension>
+        </extension>
+        <name><given value="Jane"/><family value="Doe"/></name>
+        <gender value="female"/>
+        <birthDate value="1980-04-02"/>
+      </Patient>
+    </resource>
+  </entry>
+  <entry>
+    <fullUrl value="urn:uuid:enc-1"/>
+    <resource>
+      <Encounter>
+        <id value="enc-1"/>
+        <type><text value="Office visit"/></type>
+        <subject><reference value="urn:uuid:pat-1"/></subject>
+        <period><start value="2021-03-04"/></period>
+      </Encounter>
+    </resource>
+  </entry>
+  <entry>
+    <fullUrl value="urn:uuid:obs-1"/>
+    <resource>
+      <Observation>
+        <id value="obs-1"/>
+        <category><coding><code value="laboratory"/></coding></category>
+        <code><coding><system value="http://loinc.org"/><code value="2339-0"/><display value="Glucose"/></coding></code>
+        <subject><reference value="urn:uuid:pat-1"/></subject>
+        <valueQuantity><value value="182"/><unit value="mg/dL"/></valueQuantity>
+        <referenceRange><low><value value="70"/><unit value="mg/dL"/></low><high><value value="99"/><unit value="mg/dL"/></high></referenceRange>
+      </Observation>
+    </resource>
+  </entry>
+  <entry>
+    <fullUrl value="urn:uuid:cond-1"/>
+    <resource>
+      <Condition>
+        <id value="cond-1"/>
+        <text><status value="generated"/><div xmlns="http://www.w3.org/1999/xhtml"><p>Asthma, <b>well controlled</b></p></div></text>
+        <subject><reference value="Patient/pat-1"/></subject>
+      </Condition>
+    </resource>
+  </entry>
+  <entry>
+    <fullUrl value="urn:uuid:org-1"/>
+    <resource>
+      <Organization>
+        <id value="org-1"/>
+        <name value="Acme Health"/>
+        <address><city value="Boston"/></address>
+      </Organization>
+    </resource>
+  </entry>
+  <entry>
+    <fullUrl value="urn:uuid:loc-1"/>
+    <resource>
+      <Location>
+        <id value="loc-1"/>
+        <name value="Cardiology Clinic"/>
+        <address><line value="1 Hospital Way"/><city value="Boston"/></address>
+        <managingOrganization><reference value="urn:uuid:org-1"/></managingOrganization>
+      </Location>
+    </resource>
+  </entry>
+</Bundle>`
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "bundle.xml")
+	if err := os.WriteFile(path, []byte(xmlBundle), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "out.jsonl")
+	cfg := &Config{Format: "auto", OutputFile: out}
+	sink, err := openSink(cfg, newRunState(cfg), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := processFile(context.Background(), cfg, newRunState(cfg), sink, path); err != nil {
+		t.Fatal(err)
+	}
+	sink.Close()
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"pat-1":  "Patient Information: Name: Jane Doe Gender: female Date of Birth: 1980-04-02 Race: White",
+		"enc-1":  "Healthcare Encounter: Office visit Start: 2021-03-04",
+		"obs-1":  "Clinical Observation: Glucose Category: laboratory Value: 182.00 mg/dL Reference range: 70–99 mg/dL",
+		"cond-1": "Asthma, well controlled",
+		"org-1":  "Organization: Acme Health",
+		"loc-1":  "Location: Cardiology Clinic Address: 1 Hospital Way, Boston Managed by: Acme Health",
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("got %d records, want %d:\n%s", len(lines), len(want), data)
+	}
+	for _, line := range lines {
+		var record map[string]string
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		if record["content"] != want[record["id"]] {
+			t.Errorf("%s content = %q, want %q", record["id"], record["content"], want[record["id"]])
+		}
+		if record["patientId"] != "pat-1" {
+			t.Errorf("%s patientId = %q, want pat-1", record["id"], record["patientId"])
+		}
+	}
+
+	if _, _, err := decodeXMLBundleEntries(strings.NewReader(`<Patient xmlns="http://hl7.org/fhir"/>`), "p.xml", nil); !errors.Is(err, ErrNotBundle) {
+		t.Errorf("non-Bundle XML: err = %v, want ErrNotBundle", err)
+	}
+}
+
+func TestProcessFileWorkersPerFile(t *testing.T) {
+	quietLogger(t)
+
+	var mu sync.Mutex
+	inFlight, peak, received := 0, 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		peak = max(peak, inFlight)
+		received++
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	var lines []string
+	for i := 0; i < 20; i++ {
+		lines = append(lines, fmt.Sprintf(`{"resourceType": "Condition", "id": "c%d", "code": {"text": "Condition %d"}}`, i, i))
+	}
+	path := filepath.Join(t.TempDir(), "Condition.ndjson")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &Config{Format: "auto", PipelineURL: server.URL, RequestTimeout: time.Second, BatchSize: 1, WorkersPerFile: 4}
+	state := newRunState(cfg)
+	summary, _, err := processFile(context.Background(), cfg, state, httpSink{cfg, state}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Ingested != 20 || summary.ByType["Condition"].Ingested != 20 || received != 20 {
+		t.Errorf("ingested=%d (Condition %d), received=%d, want 20", summary.Ingested, summary.ByType["Condition"].Ingested, received)
+	}
+	if peak < 2 || peak > 4 {
+		t.Errorf("peak concurrent requests = %d, want 2 to 4", peak)
+	}
+}
+
+func TestSendToPipelineIngestError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	var ingestErr *IngestError
+	cfg := &Config{PipelineURL: server.URL, RequestTimeout: time.Second}
+	err := sendToPipeline(context.Background(), cfg, newRunState(cfg), map[string]string{"id": "c1"})
+	if !errors.As(err, &ingestErr) || ingestErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("non-200: err = %v, want IngestError with status 503", err)
+	}
+	cfg = &Config{PipelineURL: dead.URL, RequestTimeout: time.Second}
+	err = sendToPipeline(context.Background(), cfg, newRunState(cfg), map[string]string{"id": "c1"})
+	if !errors.As(err, &ingestErr) || ingestErr.StatusCode != 0 || ingestErr.Err == nil {
+		t.Errorf("connection refused: err = %v, want IngestError wrapping the cause", err)
+	}
+}
+
+func TestPipelinePath(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+	}))
+	defer server.Close()
+
+	cfg := &Config{PipelineURL: server.URL + "/api/", PipelinePath: "v1/ingest/", RequestTimeout: time.Second}
+	if err := sendToPipeline(context.Background(), cfg, newRunState(cfg), map[string]string{"id": "c1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sendBatchToPipeline(context.Background(), cfg, newRunState(cfg), []map[string]string{{"id": "c1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(paths, " "), "/api/v1/ingest/ /api/v1/ingest/batch"; got != want {
+		t.Errorf("paths = %q, want %q", got, want)
+	}
+
+	for _, c := range []struct{ base, path, want string }{
+		{"http://pipeline:8000/embeddings", "/ingest", "http://pipeline:8000/embeddings/ingest"},
+		{"http://pipeline:8000/", "/api/v1/ingest", "http://pipeline:8000/api/v1/ingest"},
+		{"http://pipeline:8000/embeddings/ingest", "", "http://pipeline:8000/embeddings/ingest"},
+	} {
+		if got := joinURLPath(c.base, c.path); got != c.want {
+			t.Errorf("joinURLPath(%q, %q) = %q, want %q", c.base, c.path, got, c.want)
+		}
+	}
+}
+
+func TestCompressRequests(t *testing.T) {
+	quietLogger(t)
+
+	var encodings []string
+	var wireBytes, jsonBytes int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encodings = append(encodings, r.Header.Get("Content-Encoding"))
+		wire, _ := io.ReadAll(r.Body)
+		body := wire
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(bytes.NewReader(wire))
+			if err != nil {
+				t.Errorf("gzip body: %v", err)
+				return
+			}
+			body, _ = io.ReadAll(zr)
+		}
+		var records []map[string]string
+		if err := json.Unmarshal(body, &records); err != nil {
+			t.Errorf("batch body: %v", err)
+		}
+		wireBytes, jsonBytes = len(wire), len(body)
+	}))
+	defer server.Close()
+
+	var batch []map[string]string
+	for i := range 100 {
+		batch = append(batch, map[string]string{
+			"id": fmt.Sprintf("o%d", i), "resourceType": "Observation", "patientId": "p1", "sourceFile": "data/p1.json",
+			"content":      fmt.Sprintf("Clinical Observation: Heart rate Value: %d /min Date: 2021-06-01", 60+i%40),
+			"resourceJson": fmt.Sprintf(`{"resourceType":"Observation","id":"o%d","code":{"text":"Heart rate"},"valueQuantity":{"value":%d,"unit":"/min"}}`, i, 60+i%40),
+		})
+	}
+	for _, compress := range []bool{false, true} {
+		cfg := &Config{PipelineURL: server.URL, PipelinePath: "/ingest", Compress: compress, RequestTimeout: time.Second}
+		if _, err := sendBatchToPipeline(context.Background(), cfg, newRunState(cfg), batch); err != nil {
+			t.Fatal(err)
+		}
+		if compress {
+			t.Logf("batch of %d records: %d bytes of JSON sent as %d gzipped (%.0f%% smaller)",
+				len(batch), jsonBytes, wireBytes, 100*(1-float64(wireBytes)/float64(jsonBytes)))
+			if wireBytes*4 > jsonBytes {
+				t.Errorf("gzipped body is %d bytes of %d, want under a quarter", wireBytes, jsonBytes)
+			}
+		} else if wireBytes != jsonBytes {
+			t.Errorf("uncompressed body is %d bytes on the wire, %d decoded", wireBytes, jsonBytes)
+		}
+	}
+	if fmt.Sprint(encodings) != "[ gzip]" {
+		t.Errorf("Content-Encoding headers = %q, want none then gzip", encodings)
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	quietLogger(t)
+
+	var mu sync.Mutex
+	received := map[string][]string{}
+	handler := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			mu.Lock()
+			received[name] = append(received[name], r.URL.Path+" "+string(body))
+			mu.Unlock()
+		}
+	}
+	structured := httptest.NewServer(handler("structured"))
+	defer structured.Close()
+	notes := httptest.NewServer(handler("notes"))
+	defer notes.Close()
+
+	var routes routeFlags
+	if err := routes.Set("DocumentReference=" + notes.URL + "/notes"); err != nil {
+		t.Fatal(err)
+	}
+	if err := routes.Set("bad"); err == nil {
+		t.Error("Set(\"bad\") succeeded, want an error")
+	}
+	records := []map[string]string{
+		{"id": "o1", "resourceType": "Observation"},
+		{"id": "d1", "resourceType": "DocumentReference"},
+		{"id": "o2", "resourceType": "Observation"},
+	}
+
+	for _, batchSize := range []int{1, 10} {
+		received = map[string][]string{}
+		cfg := &Config{PipelineURL: structured.URL, PipelinePath: "/ingest", Routes: routes, BatchSize: batchSize, RequestTimeout: time.Second}
+		summary := newSummary()
+		state := newRunState(cfg)
+		out := newRecordSender(context.Background(), cfg, state, httpSink{cfg, state}, &summary)
+		for _, record := range records {
+			out.send(record)
+		}
+		out.flush()
+
+		want := map[string][]string{
+			"structured": {`/ingest {"id":"o1","resourceType":"Observation"}`, `/ingest {"id":"o2","resourceType":"Observation"}`},
+			"notes":      {`/notes/ingest {"id":"d1","resourceType":"DocumentReference"}`},
+		}
+		if batchSize > 1 {
+			want = map[string][]string{
+				"structured": {`/ingest/batch [{"id":"o1","resourceType":"Observation"},{"id":"o2","resourceType":"Observation"}]`},
+				"notes":      {`/notes/ingest/batch [{"id":"d1","resourceType":"DocumentReference"}]`},
+			}
+		}
+		if fmt.Sprint(received) != fmt.Sprint(want) {
+			t.Errorf("batch size %d: received %v, want %v", batchSize, received, want)
+		}
+		if summary.Ingested != 3 {
+			t.Errorf("batch size %d: ingested = %d, want 3", batchSize, summary.Ingested)
+		}
+	}
+}
+
+func TestEmbedEndpoint(t *testing.T) {
+	quietLogger(t)
+
+	var batches [][]string
+	fail := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer sk-test" {
+			t.Errorf("Authorization = %q", got)
+		}
+		var req embeddingsRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Model != "test-model" {
+			t.Errorf("request = %+v, %v", req, err)
+		}
+		if fail {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": {"message": "input too long", "type": "invalid_request_error"}}`))
+			return
+		}
+		batches = append(batches, req.Input)
+		// Answer out of order; vectors are matched up by index
+		var data []string
+		for i := len(req.Input) - 1; i >= 0; i-- {
+			data = append(data, fmt.Sprintf(`{"object": "embedding", "index": %d, "embedding": [%d, 0.5]}`, i, len(req.Input[i])))
+		}
+		fmt.Fprintf(w, `{"object": "list", "data": [%s], "model": "test-model"}`, strings.Join(data, ","))
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "bundle.json")
+	os.WriteFile(path, []byte(bundleJSON(
+		`{"resourceType": "Condition", "id": "c1", "code": {"text": "Asthma"}}`,
+		`{"resourceType": "Condition", "id": "c2", "code": {"text": "Eczema"}}`,
+		`{"resourceType": "Condition", "id": "c3", "code": {"text": "Migraine"}}`,
+	)), 0o644)
+	cfg := &Config{Format: "auto", RequestTimeout: time.Second,
+		EmbedEndpoint: server.URL + "/v1/embeddings", EmbedModel: "test-model", EmbedAPIKey: "sk-test", EmbedBatchSize: 2}
+
+	sink := &captureSink{}
+	summary, _, err := processFile(context.Background(), cfg, newRunState(cfg), sink, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batches) != 2 || len(batches[0]) != 2 || len(batches[1]) != 1 {
+		t.Errorf("embedding batches = %q, want 2 then 1 inputs", batches)
+	}
+	if summary.Ingested != 3 {
+		t.Errorf("ingested = %d, want 3", summary.Ingested)
+	}
+	for _, record := range sink.records {
+		if want := fmt.Sprintf("[%d,0.5]", len(record["content"])); record["embedding"] != want {
+			t.Errorf("%s embedding = %q, want %q", record["id"], record["embedding"], want)
+		}
+	}
+
+	fail = true
+	sink = &captureSink{}
+	summary, outcomes, err := processFile(context.Background(), cfg, newRunState(cfg), sink, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.PipelineFailures != 3 || len(sink.records) != 0 {
+		t.Errorf("failures = %d, sent = %d, want 3 and 0", summary.PipelineFailures, len(sink.records))
+	}
+	if len(outcomes) == 0 || outcomes[0].Error != "embeddings endpoint returned status 400: input too long" {
+		t.Errorf("outcomes = %+v", outcomes)
+	}
+}
+
+func TestFollowNext(t *testing.T) {
+	quietLogger(t)
+
+	var fetched []string
+	mux := http.NewServeMux()
+	page := func(next string, resources ...string) string {
+		bundle := bundleJSON(resources...)
+		return `{"link": [{"relation": "self", "url": "ignored"}, {"relation": "next", "url": "` + next + `"}],` + strings.TrimPrefix(bundle, "{")
+	}
+	mux.HandleFunc("/fhir/Condition", func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer fhir-secret" {
+			t.Errorf("Authorization = %q", got)
+		}
+		fetched = append(fetched, r.URL.RawQuery)
+		switch r.URL.Query().Get("page") {
+		case "2":
+			// Relative links resolve against -fhir-server
+			w.Write([]byte(page("Condition?page=3", `{"resourceType": "Condition", "id": "c2", "code": {"text": "Eczema"}}`)))
+		case "3":
+			// Loops back to page 2, which is not fetched again
+			w.Write([]byte(page("Condition?page=2", `{"resourceType": "Condition", "id": "c3", "code": {"text": "Migraine"}}`)))
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "search.json")
+	os.WriteFile(path, []byte(page(server.URL+"/fhir/Condition?page=2",
+		`{"resourceType": "Condition", "id": "c1", "code": {"text": "Asthma"}}`)), 0o644)
+	cfg := &Config{Format: "auto", FollowNext: true, FHIRServer: server.URL + "/fhir", FHIRToken: "fhir-secret", MaxPages: 10, RequestTimeout: time.Second}
+
+	sink := &captureSink{}
+	summary, _, err := processFile(context.Background(), cfg, newRunState(cfg), sink, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Ingested != 3 || len(sink.records) != 3 {
+		t.Errorf("ingested = %d, sent = %d, want 3", summary.Ingested, len(sink.records))
+	}
+	if got := strings.Join(fetched, " "); got != "page=2 page=3" {
+		t.Errorf("fetched %q, want page=2 page=3", got)
+	}
+
+	// -max-pages bounds the pages fetched after the file
+	fetched = nil
+	cfg.MaxPages = 1
+	if summary, _, err = processFile(context.Background(), cfg, newRunState(cfg), &captureSink{}, path); err != nil || summary.Ingested != 2 {
+		t.Errorf("with -max-pages 1: ingested = %d, err = %v, want 2", summary.Ingested, err)
+	}
+
+	// Links off the server are refused rather than sent the token
+	os.WriteFile(path, []byte(page("https://elsewhere.example/fhir/Condition?page=2",
+		`{"resourceType": "Condition", "id": "c1", "code": {"text": "Asthma"}}`)), 0o644)
+	if _, _, err = processFile(context.Background(), cfg, newRunState(cfg), &captureSink{}, path); err == nil || !strings.Contains(err.Error(), "not on -fhir-server") {
+		t.Errorf("err = %v, want a link not on -fhir-server", err)
+	}
+}
+
+// captureSink is a Sink that keeps the records sent to it, refusing those
+// whose id is in reject.
+type captureSink struct {
+	mu      sync.Mutex
+	records []map[string]string
+	reject  map[string]bool
+	flushes int
+}
+
+func (s *captureSink) Send(_ context.Context, record map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reject[record["id"]] {
+		return &IngestError{Err: errors.New("rejected")}
+	}
+	s.records = append(s.records, record)
+	return nil
+}
+
+func (s *captureSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flushes++
+	return nil
+}
+
+func (s *captureSink) Close() error { return nil }
+
+// slowReader is a file read at most 64 KiB at a time, each Read waiting
+// first like a slow disk.
+type slowReader struct {
+	r      io.Reader
+	delay  time.Duration
+	closed bool
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(s.delay)
+	return s.r.Read(p[:min(len(p), 64<<10)])
+}
+
+func (s *slowReader) Close() error {
+	s.closed = true
+	return nil
+}
+
+func ndjsonObservations(n int) []byte {
+	var b bytes.Buffer
+	for i := range n {
+		fmt.Fprintf(&b, `{"resourceType": "Observation", "id": "o%d", "subject": {"reference": "Patient/p%d"}, "code": {"text": "Heart rate"}, "valueQuantity": {"value": %d, "unit": "/min"}, "effectiveDateTime": "2021-06-01"}`+"\n", i, i%50, 60+i%40)
+	}
+	return b.Bytes()
+}
+
+func TestReadAhead(t *testing.T) {
+	data := ndjsonObservations(5000) // several chunks
+	src := &slowReader{r: bytes.NewReader(data)}
+	r := newReadAhead(src, 2)
+	got, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read %d of %d bytes, err %v", len(got), len(data), err)
+	}
+	if err := r.Close(); err != nil || !src.closed {
+		t.Errorf("Close = %v, source closed %v", err, src.closed)
+	}
+
+	// Closed part way, the reading goroutine stops before the source closes
+	src = &slowReader{r: bytes.NewReader(data)}
+	r = newReadAhead(src, 1)
+	if _, err := r.Read(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if !src.closed {
+		t.Error("source not closed")
+	}
+
+	failing := newReadAhead(io.NopCloser(io.MultiReader(bytes.NewReader(data[:100]), iotest.ErrReader(errDecompress))), 2)
+	defer failing.Close()
+	if got, err := io.ReadAll(failing); len(got) != 100 || !errors.Is(err, errDecompress) {
+		t.Errorf("read %d bytes, err %v; want 100 and the source's error", len(got), err)
+	}
+}
+
+// BenchmarkReadAhead extracts records from NDJSON on a disk that takes 2ms
+// per 64 KiB read, as for a file on network storage. Read inline,
+// extraction waits on every read; read ahead, the two overlap.
+func BenchmarkReadAhead(b *testing.B) {
+	quietLogger(b)
+	data := ndjsonObservations(20000)
+	for _, chunks := range []int{0, 4} {
+		b.Run(fmt.Sprintf("read-ahead=%d", chunks), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for b.Loop() {
+				var r io.ReadCloser = &slowReader{r: bytes.NewReader(data), delay: 2 * time.Millisecond}
+				if chunks > 0 {
+					r = newReadAhead(r, chunks)
+				}
+				summary := newSummary()
+				err := streamNDJSON(&Config{}, r, "bench.ndjson", &summary, func(map[string]string) error { return nil })
+				r.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessFileSink(t *testing.T) {
+	quietLogger(t)
+
+	path := filepath.Join(t.TempDir(), "bundle.json")
+	os.WriteFile(path, []byte(bundleJSON(
+		`{"resourceType": "Condition", "id": "c1", "code": {"text": "Asthma"}}`,
+		`{"resourceType": "Condition", "id": "c2", "code": {"text": "Eczema"}}`,
+		`{"resourceType": "Condition", "id": "c3", "code": {"text": "Migraine"}}`,
+	)), 0o644)
+
+	sink := &captureSink{reject: map[string]bool{"c2": true}}
+	cfg := &Config{Format: "auto", WorkersPerFile: 2}
+	summary, _, err := processFile(context.Background(), cfg, newRunState(cfg), sink, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Ingested != 2 || summary.PipelineFailures != 1 {
+		t.Errorf("ingested=%d failures=%d, want 2 and 1", summary.Ingested, summary.PipelineFailures)
+	}
+	ids := make(map[string]string)
+	for _, record := range sink.records {
+		ids[record["id"]] = record["content"]
+	}
+	if len(ids) != 2 || ids["c1"] != "Medical Condition: Asthma" || ids["c3"] != "Medical Condition: Migraine" {
+		t.Errorf("sink received %v", ids)
+	}
+	if sink.flushes != 1 {
+		t.Errorf("flushes = %d, want 1 per file", sink.flushes)
+	}
+}
+
+func TestFlattenBundle(t *testing.T) {
+	quietLogger(t)
+
+	path := filepath.Join(t.TempDir(), "bundle.json")
+	os.WriteFile(path, []byte(bundleJSON(
+		`{"resourceType": "Patient", "id": "p1", "gender": "female", "birthDate": "1980-02-03"}`,
+		`{"resourceType": "Condition", "id": "c1", "code": {"text": "Asthma"}}`,
+		`{"resourceType": "Observation", "id": "o1", "code": {"text": "Heart rate"}, "valueInteger": 72}`,
+		`{"resourceType": "Condition", "id": "c2", "code": {"text": "Eczema"}}`,
+	)), 0o644)
+
+	sink := &captureSink{}
+	cfg := &Config{Format: "auto", FlattenBundle: true}
+	summary, _, err := processFile(context.Background(), cfg, newRunState(cfg), sink, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.records) != 1 || summary.Ingested != 1 {
+		t.Fatalf("got %d records (%d ingested), want one for the Bundle", len(sink.records), summary.Ingested)
+	}
+	record := sink.records[0]
+	patient := "## Patient\n" + extractContent(&Config{}, mustResource(t, `{"gender": "female", "birthDate": "1980-02-03"}`), "Patient", nil)
+	want := patient + "\n## Condition\nMedical Condition: Asthma\nMedical Condition: Eczema\n## Observation\nClinical Observation: Heart rate Value: 72"
+	if record["id"] != "p1" || record["patientId"] != "p1" || record["resourceType"] != "Bundle" || record["content"] != want {
+		t.Errorf("record = %v, want id p1 and content %q", record, want)
+	}
+
+	// Split to fit -max-content-chars, between lines, repeating the heading
+	sink = &captureSink{}
+	cfg = &Config{Format: "auto", FlattenBundle: true, MaxContentChars: 60, ExcludeTypes: stringSet{"Patient": true}}
+	if _, _, err := processFile(context.Background(), cfg, newRunState(cfg), sink, path); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, record := range sink.records {
+		got = append(got, record["id"]+": "+record["content"])
+	}
+	wantChunks := []string{
+		"p1-1: ## Condition\nMedical Condition: Asthma",
+		"p1-2: ## Condition\nMedical Condition: Eczema",
+		"p1-3: ## Observation\nClinical Observation: Heart rate Value: 72",
+	}
+	if strings.Join(got, " | ") != strings.Join(wantChunks, " | ") {
+		t.Errorf("chunks = %q, want %q", got, wantChunks)
+	}
+}
+
+// TestSummaryTotalsConcurrent processes many Bundles at once, with several
+// senders per file, as run does. Run it with -race.
+func TestSummaryTotalsConcurrent(t *testing.T) {
+	quietLogger(t)
+
+	const files = 24
+	dir := t.TempDir()
+	for i := range files {
+		os.WriteFile(filepath.Join(dir, fmt.Sprintf("b%02d.json", i)), []byte(bundleJSON(
+			`{"resourceType": "Patient", "id": "p", "gender": "female"}`,
+			`{"resourceType": "Condition", "id": "c1", "code": {"text": "Asthma"}}`,
+			`{"resourceType": "Condition", "id": "c2", "code": {"text": "Eczema"}}`,
+			`{"resourceType": "Condition", "id": "bad", "code": {"text": "Migraine"}}`,
+			`{"resourceType": "Observation", "id": "o1", "code": {"text": "Heart rate"}, "valueQuantity": {"value": 72}}`,
+			`{"resourceType": "Basic", "id": "b1"}`,
+		)), 0o644)
+	}
+
+	sink := &captureSink{reject: map[string]bool{"bad": true}}
+	cfg := &Config{Format: "auto", WorkersPerFile: 4}
+	totals := newSummaryTotals()
+	var wg sync.WaitGroup
+	for i := range files {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			summary, _, err := processFile(context.Background(), cfg, newRunState(cfg), sink, filepath.Join(dir, fmt.Sprintf("b%02d.json", i)))
+			if err != nil {
+				t.Error(err)
+			}
+			totals.Add(summary)
+			totals.Snapshot() // as progress lines are read mid-run
+		}()
+	}
+	wg.Wait()
+
+	summary := totals.Snapshot()
+	if summary.Ingested != 4*files || summary.PipelineFailures != files || summary.SkippedEmpty != files {
+		t.Errorf("ingested=%d failures=%d empty=%d, want %d, %d, %d",
+			summary.Ingested, summary.PipelineFailures, summary.SkippedEmpty, 4*files, files, files)
+	}
+	want := map[string]TypeCounts{
+		"Patient":     {Ingested: files},
+		"Condition":   {Ingested: 2 * files, PipelineFailures: files},
+		"Observation": {Ingested: files},
+		"Basic":       {SkippedEmpty: files},
+	}
+	for resourceType, counts := range want {
+		got := summary.ByType[resourceType]
+		if got == nil {
+			t.Errorf("%s: no counts", resourceType)
+			continue
+		}
+		got.EstimatedTokens = 0
+		if *got != counts {
+			t.Errorf("%s: %+v, want %+v", resourceType, *got, counts)
+		}
+	}
+
+	// The snapshot is a copy
+	summary.ByType["Patient"].Ingested = 0
+	if totals.Snapshot().ByType["Patient"].Ingested != files {
+		t.Error("changing a snapshot changed the totals")
+	}
+}
+
+func TestProcessFileOutcomes(t *testing.T) {
+	quietLogger(t)
+
+	path := filepath.Join(t.TempDir(), "bundle.json")
+	os.WriteFile(path, []byte(bundleJSON(
+		`{"resourceType": "Condition", "id": "c1", "code": {"text": "Asthma"}}`,
+		`{"resourceType": "Condition", "id": "c2", "code": {"text": "Eczema"}}`,
+		`{"resourceType": "Basic", "id": "b1"}`,
+		`{"resourceType": "OperationOutcome", "id": "o1"}`,
+		`{"id": "x1"}`,
+	)), 0o644)
+
+	sink := &captureSink{reject: map[string]bool{"c2": true}}
+	cfg := &Config{Format: "auto", WorkersPerFile: 2}
+	_, outcomes, err := processFile(context.Background(), cfg, newRunState(cfg), sink, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]ResourceOutcome{
+		"c1": {File: path, ResourceType: "Condition", ID: "c1", Status: "ingested"},
+		"c2": {File: path, ResourceType: "Condition", ID: "c2", Status: "failed", Error: "rejected"},
+		"b1": {File: path, ResourceType: "Basic", ID: "b1", Status: "skipped", Reason: "empty"},
+		"o1": {File: path, ResourceType: "OperationOutcome", ID: "o1", Status: "skipped", Reason: "not-clinical"},
+		"x1": {File: path, ID: "x1", Status: "skipped", Reason: "missing-resourceType"},
+	}
+	if len(outcomes) != len(want) {
+		t.Fatalf("got %d outcomes, want %d: %+v", len(outcomes), len(want), outcomes)
+	}
+	for _, o := range outcomes {
+		if o != want[o.ID] {
+			t.Errorf("outcome for %s = %+v, want %+v", o.ID, o, want[o.ID])
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	quietLogger(t)
+
+	path := filepath.Join(t.TempDir(), "bundle.json")
+	os.WriteFile(path, []byte(bundleJSON(
+		`{"resourceType": "Condition", "id": "c1", "code": {"text": "Asthma"}}`,
+		`{"resourceType": "Condition", "code": {"text": "Eczema"}}`,
+		`{"resourceType": "Condition", "id": 7, "code": {"coding": {"display": "Migraine"}}}`,
+		`{"resourceType": "Patient", "id": "p1", "name": [{"text": "Ann"}], "identifier": {"value": "123"}}`,
+	)), 0o644)
+
+	for _, validate := range []bool{false, true} {
+		sink := &captureSink{}
+		cfg := &Config{Format: "auto", Validate: validate}
+		summary, outcomes, err := processFile(context.Background(), cfg, newRunState(cfg), sink, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !validate {
+			if summary.Invalid != 0 || summary.Ingested != 4 {
+				t.Errorf("without -validate: invalid=%d ingested=%d, want 0 and 4", summary.Invalid, summary.Ingested)
+			}
+			continue
+		}
+		if summary.Invalid != 3 || summary.Ingested != 1 {
+			t.Errorf("invalid=%d ingested=%d, want 3 and 1", summary.Invalid, summary.Ingested)
+		}
+		if summary.ByType["Condition"].Invalid != 2 || summary.ByType["Patient"].Invalid != 1 {
+			t.Errorf("invalid by type: Condition %d, Patient %d; want 2 and 1", summary.ByType["Condition"].Invalid, summary.ByType["Patient"].Invalid)
+		}
+		var errs []string
+		for _, o := range outcomes {
+			if o.Reason == "invalid" {
+				errs = append(errs, o.Error)
+			}
+		}
+		want := []string{
+			"id is missing",
+			"id is number, want string; code.coding is object, want array",
+			"identifier is object, want array",
+		}
+		if strings.Join(errs, "\n") != strings.Join(want, "\n") {
+			t.Errorf("validation errors = %q, want %q", errs, want)
+		}
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.json")
+	summary := newSummary()
+	summary.Ingested = 1
+	outcomes := []ResourceOutcome{{File: "a.json", ResourceType: "Condition", ID: "c1", Status: "ingested"}}
+	if err := writeReport(path, outcomes, summary, exitPartialFailure); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report Report
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Resources) != 1 || report.Resources[0] != outcomes[0] {
+		t.Errorf("resources = %+v", report.Resources)
+	}
+	if report.Summary.Ingested != 1 || report.ExitCode != exitPartialFailure {
+		t.Errorf("summary.ingested = %d, exitCode = %d", report.Summary.Ingested, report.ExitCode)
+	}
+	if !strings.Contains(string(data), `"status": "ingested"`) {
+		t.Errorf("report is not indented JSON:\n%s", data)
+	}
+}
+
+func TestEstimateTokens(t *testing.T) {
+	quietLogger(t)
+
+	for content, want := range map[string]int{
+		"":                          0,
+		"Medical Condition: Asthma": 7,
+		"a b c d e f":               6,
+	} {
+		if got := heuristicTokens(content); got != want {
+			t.Errorf("heuristicTokens(%q) = %d, want %d", content, got, want)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "bundle.json")
+	os.WriteFile(path, []byte(bundleJSON(
+		`{"resourceType": "Condition", "id": "c1", "code": {"text": "Asthma"}}`,
+		`{"resourceType": "Condition", "id": "c2", "code": {"text": "Eczema"}}`,
+		`{"resourceType": "Procedure", "id": "p1", "code": {"text": "Appendectomy"}}`,
+	)), 0o644)
+
+	cfg := &Config{Format: "auto"}
+	state := newRunState(cfg)
+	state.estimateTokens = func(content string) int { return len(strings.Fields(content)) }
+	summary, _, err := processFile(context.Background(), cfg, state, &captureSink{}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.EstimatedTokens != 9 || summary.ByType["Condition"].EstimatedTokens != 6 || summary.ByType["Procedure"].EstimatedTokens != 3 {
+		t.Errorf("estimated tokens: total %d, Condition %d, Procedure %d; want 9, 6, 3",
+			summary.EstimatedTokens, summary.ByType["Condition"].EstimatedTokens, summary.ByType["Procedure"].EstimatedTokens)
+	}
+}
+
+func TestOutputDirSink(t *testing.T) {
+	quietLogger(t)
+
+	dataDir := t.TempDir()
+	outDir := filepath.Join(t.TempDir(), "out")
+	os.MkdirAll(filepath.Join(dataDir, "site-a"), 0o755)
+	inputs := map[string]string{
+		filepath.Join(dataDir, "site-a", "p1.json"): bundleJSON(
+			`{"resourceType": "Condition", "id": "c1", "code": {"text": "Asthma"}}`,
+			`{"resourceType": "Condition", "id": "c2", "code": {"text": "Eczema"}}`),
+		filepath.Join(dataDir, "Condition.ndjson"): `{"resourceType": "Condition", "id": "c3", "code": {"text": "Migraine"}}`,
+	}
+	cfg := &Config{Format: "auto", OutputDir: outDir}
+	sink, err := openSink(cfg, newRunState(cfg), dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, data := range inputs {
+		os.WriteFile(path, []byte(data), 0o644)
+		if _, _, err := processFile(context.Background(), cfg, newRunState(cfg), sink, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]int{
+		filepath.Join(outDir, "site-a", "p1.json.extracted.jsonl"): 2,
+		filepath.Join(outDir, "Condition.ndjson.extracted.jsonl"):  1,
+	} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lines := strings.Count(string(data), "\n"); lines != want {
+			t.Errorf("%s has %d records, want %d", path, lines, want)
+		}
+	}
+
+	// Paths differing only in case don't share an output file
+	dirSink := newOutputDirSink(outDir, dataDir)
+	first := dirSink.outputPath(filepath.Join(dataDir, "P1.json"))
+	second := dirSink.outputPath(filepath.Join(dataDir, "p1.json"))
+	if first == second || second != filepath.Join(outDir, "p1.json-2.extracted.jsonl") {
+		t.Errorf("colliding output paths %q and %q", first, second)
+	}
+	if again := dirSink.outputPath(filepath.Join(dataDir, "P1.json")); again != first {
+		t.Errorf("output path changed from %q to %q", first, again)
+	}
+}
+
+// fakeKafkaWriter records the messages written to it and fails any whose
+// value is a record with id "bad".
+type fakeKafkaWriter struct {
+	mu       sync.Mutex
+	messages []kafka.Message
+}
+
+func (w *fakeKafkaWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, msg := range msgs {
+		if strings.Contains(string(msg.Value), `"id":"bad"`) {
+			return kafka.MessageSizeTooLarge
+		}
+		w.messages = append(w.messages, msg)
+	}
+	return nil
+}
+
+func (*fakeKafkaWriter) Close() error { return nil }
+
+func TestKafkaSink(t *testing.T) {
+	quietLogger(t)
+
+	writer := &fakeKafkaWriter{}
+	cfg := &Config{Sink: "kafka", KafkaBrokers: []string{"localhost:9092"}, KafkaTopic: "fhir-records", RequestTimeout: time.Second}
+	summary := newSummary()
+	out := newRecordSender(context.Background(), cfg, newRunState(cfg), &kafkaSink{cfg: cfg, writer: writer, state: newRunState(cfg)}, &summary)
+	out.send(map[string]string{"id": "o1", "resourceType": "Observation", "patientId": "p1"})
+	if len(writer.messages) != 1 {
+		t.Fatalf("wrote %d messages, want 1", len(writer.messages))
+	}
+	var value map[string]string
+	if msg := writer.messages[0]; string(msg.Key) != "p1" || json.Unmarshal(msg.Value, &value) != nil || value["id"] != "o1" || value["resourceType"] != "Observation" {
+		t.Errorf("message key %q, value %s", msg.Key, msg.Value)
+	}
+	out.send(map[string]string{"id": "bad", "resourceType": "Observation", "patientId": "p1"})
+	if summary.Ingested != 1 || summary.PipelineFailures != 1 {
+		t.Errorf("ingested=%d failures=%d, want 1 and 1", summary.Ingested, summary.PipelineFailures)
+	}
+}
+
+func TestKafkaRESTSink(t *testing.T) {
+	quietLogger(t)
+
+	var gotPath, gotType string
+	var gotKey string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath, gotType = r.URL.Path, r.Header.Get("Content-Type")
+		var body struct {
+			Records []struct {
+				Key   string            `json:"key"`
+				Value map[string]string `json:"value"`
+			} `json:"records"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.Records) != 1 {
+			t.Errorf("produce body: %v, %d records", err, len(body.Records))
+			return
+		}
+		gotKey = body.Records[0].Key
+		if body.Records[0].Value["id"] == "bad" {
+			w.Write([]byte(`{"offsets": [{"partition": null, "offset": null, "error_code": 40403, "error": "Schema not found"}]}`))
+			return
+		}
+		w.Write([]byte(`{"offsets": [{"partition": 2, "offset": 17, "error_code": null, "error": null}]}`))
+	}))
+	defer server.Close()
+
+	cfg := &Config{Sink: "kafka", KafkaRESTURLs: []string{server.URL + "/"}, KafkaTopic: "fhir-records", RequestTimeout: time.Second}
+	summary := newSummary()
+	state := newRunState(cfg)
+	out := newRecordSender(context.Background(), cfg, state, kafkaRESTSink{cfg, state}, &summary)
+	out.send(map[string]string{"id": "o1", "resourceType": "Observation", "patientId": "p1"})
+	if gotPath != "/topics/fhir-records" || gotType != "application/vnd.kafka.json.v2+json" || gotKey != "p1" {
+		t.Errorf("produce request: path %q, Content-Type %q, key %q", gotPath, gotType, gotKey)
+	}
+	out.send(map[string]string{"id": "bad", "resourceType": "Observation", "patientId": "p1"})
+	if summary.Ingested != 1 || summary.PipelineFailures != 1 {
+		t.Errorf("ingested=%d failures=%d, want 1 and 1", summary.Ingested, summary.PipelineFailures)
+	}
+}
+
+// ingestServer records the IngestRequests it receives and rejects any whose
+// id is "bad".
+type ingestServer struct {
+	ingestpb.UnimplementedIngestServiceServer
+	mu    sync.Mutex
+	auth  []string
+	calls []*ingestpb.IngestRequest
+}
+
+func (s *ingestServer) Ingest(ctx context.Context, req *ingestpb.IngestRequest) (*ingestpb.IngestResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	s.mu.Lock()
+	s.auth = append(s.auth, md.Get("authorization")...)
+	s.calls = append(s.calls, req)
+	s.mu.Unlock()
+	if req.GetId() == "bad" {
+		return nil, status.Error(codes.InvalidArgument, "missing patient")
+	}
+	return &ingestpb.IngestResponse{}, nil
+}
+
+func TestGRPCSink(t *testing.T) {
+	quietLogger(t)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &ingestServer{}
+	server := grpc.NewServer()
+	ingestpb.RegisterIngestServiceServer(server, srv)
+	go server.Serve(lis)
+	defer server.Stop()
+
+	cfg := &Config{Sink: "grpc", GRPCAddr: lis.Addr().String(), AuthToken: "secret", RequestTimeout: time.Second}
+	summary := newSummary()
+	sink, err := newGRPCSink(cfg, newRunState(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	out := newRecordSender(context.Background(), cfg, newRunState(cfg), sink, &summary)
+	out.send(map[string]string{"id": "o1", "resourceType": "Observation", "patientId": "p1", "content": "Lab: A1c", "sourceLine": "4"})
+	if len(srv.calls) != 1 || len(srv.auth) != 1 || srv.auth[0] != "Bearer secret" {
+		t.Fatalf("calls %v with authorization %q", srv.calls, srv.auth)
+	}
+	want := &ingestpb.IngestRequest{Id: "o1", ResourceType: "Observation", PatientId: "p1", Content: "Lab: A1c", Metadata: map[string]string{"sourceLine": "4"}}
+	if got := srv.calls[0]; !proto.Equal(got, want) {
+		t.Errorf("IngestRequest = %v, want %v", got, want)
+	}
+	out.send(map[string]string{"id": "bad", "resourceType": "Observation"})
+	if summary.Ingested != 1 || summary.PipelineFailures != 1 {
+		t.Errorf("ingested=%d failures=%d, want 1 and 1", summary.Ingested, summary.PipelineFailures)
+	}
+	err = sink.Send(context.Background(), map[string]string{"id": "bad"})
+	var ingestErr *IngestError
+	if !errors.As(err, &ingestErr) || ingestErr.StatusCode != http.StatusBadRequest || err.Error() != "gRPC status InvalidArgument: missing patient" {
+		t.Errorf("rejected call error = %v", err)
+	}
+
+	// Calls are paced by -rate-limit through the run's pacedTransport
+	cfg.RateLimit = 20
+	paced, err := newGRPCSink(cfg, newRunState(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer paced.Close()
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := paced.Send(context.Background(), map[string]string{"id": fmt.Sprint(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("3 calls at -rate-limit 20 took %v, want at least 100ms", elapsed)
+	}
+}
+
+func TestExtractBundleProcedure(t *testing.T) {
+	quietLogger(t)
+
+	bundle := bundleJSON(
+		`{"resourceType": "Condition", "id": "cond-1", "code": {"text": "Appendicitis"}}`,
+		`{"resourceType": "Procedure", "id": "proc-1", "status": "completed",
+			"code": {"coding": [{"display": "Appendectomy"}]},
+			"bodySite": [{"coding": [{"display": "Appendix structure"}]}],
+			"performedPeriod": {"start": "2021-05-01T08:00:00Z", "end": "2021-05-01T09:15:00Z"},
+			"reasonReference": [{"reference": "urn:uuid:entry-0"}]}`,
+		`{"resourceType": "Procedure", "id": "proc-2", "status": "completed", "code": {"text": "Flu shot"},
+			"performedDateTime": "2021-10-01", "reasonCode": [{"text": "Seasonal prevention"}]}`,
+	)
+	records, _, err := extractBundle(&Config{}, strings.NewReader(bundle), "test.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"proc-1": "Medical Procedure: Appendectomy Status: completed Body site: Appendix structure Performed: 2021-05-01T08:00:00Z to 2021-05-01T09:15:00Z Reason: Appendicitis",
+		"proc-2": "Medical Procedure: Flu shot Status: completed Performed: 2021-10-01 Reason: Seasonal prevention",
+	}
+	for _, record := range records {
+		if w, ok := want[record["id"]]; ok && record["content"] != w {
+			t.Errorf("%s content = %q, want %q", record["id"], record["content"], w)
+		}
+	}
+}
+
+func TestFHIRVersion(t *testing.T) {
+	quietLogger(t)
+
+	stu3 := bundleJSON(
+		`{"resourceType": "Immunization", "id": "imm", "vaccineCode": {"text": "Influenza"}, "date": "2017-10-01"}`,
+		`{"resourceType": "Encounter", "id": "enc", "type": [{"text": "Checkup"}], "reason": [{"text": "Annual exam"}, {"text": "Cough"}]}`,
+		`{"resourceType": "DocumentReference", "id": "doc", "type": {"text": "Note"}, "class": {"text": "Clinical note"}}`,
+		`{"resourceType": "Condition", "id": "cond", "code": {"text": "Asthma"}, "clinicalStatus": "active"}`,
+	)
+	r4 := bundleJSON(
+		`{"resourceType": "Immunization", "id": "imm", "vaccineCode": {"text": "Influenza"}, "occurrenceDateTime": "2021-10-01"}`,
+		`{"resourceType": "Encounter", "id": "enc", "type": [{"text": "Checkup"}], "reasonCode": [{"text": "Annual exam"}]}`,
+		`{"resourceType": "DocumentReference", "id": "doc", "type": {"text": "Note"}, "category": [{"text": "Clinical note"}]}`,
+		`{"resourceType": "Condition", "id": "cond", "code": {"text": "Asthma"}, "clinicalStatus": {"coding": [{"code": "active"}]}}`,
+	)
+	stu3Want := map[string]string{
+		"imm":  "Immunization: Influenza Date: 2017-10-01",
+		"enc":  "Healthcare Encounter: Checkup Reason: Annual exam, Cough",
+		"doc":  "Clinical Document: Note Category: Clinical note",
+		"cond": "Medical Condition: Asthma Status: active",
+	}
+	r4Want := map[string]string{
+		"imm":  "Immunization: Influenza Date: 2021-10-01",
+		"enc":  "Healthcare Encounter: Checkup Reason: Annual exam",
+		"doc":  "Clinical Document: Note Category: Clinical note",
+		"cond": "Medical Condition: Asthma Status: active",
+	}
+	// Read with the other release's names, the renamed elements are dropped,
+	// except reasonCode: STU3 Procedures and requests already have it.
+	stu3AsR4 := map[string]string{
+		"imm":  "Immunization: Influenza",
+		"enc":  "Healthcare Encounter: Checkup",
+		"doc":  "Clinical Document: Note",
+		"cond": "Medical Condition: Asthma Status: active",
+	}
+	r4AsSTU3 := map[string]string{
+		"imm":  "Immunization: Influenza",
+		"enc":  "Healthcare Encounter: Checkup Reason: Annual exam",
+		"doc":  "Clinical Document: Note",
+		"cond": "Medical Condition: Asthma Status: active",
+	}
+
+	tests := []struct {
+		version string
+		bundle  string
+		want    map[string]string
+	}{
+		{"stu3", stu3, stu3Want},
+		{"auto", stu3, stu3Want},
+		{"r4", stu3, stu3AsR4},
+		{"r4", r4, r4Want},
+		{"auto", r4, r4Want},
+		{"stu3", r4, r4AsSTU3},
+	}
+	for _, tt := range tests {
+		records, _, err := extractBundle(&Config{FHIRVersion: tt.version}, strings.NewReader(tt.bundle), "test.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != len(tt.want) {
+			t.Fatalf("%s: got %d records, want %d", tt.version, len(records), len(tt.want))
+		}
+		for _, record := range records {
+			if want := tt.want[record["id"]]; record["content"] != want {
+				t.Errorf("%s: %s content = %q, want %q", tt.version, record["id"], record["content"], want)
+			}
+		}
+	}
+}
+
+func TestIncludePII(t *testing.T) {
+	quietLogger(t)
+
+	bundle := bundleJSON(`{"resourceType": "Patient", "id": "p1", "gender": "female",
+		"address": [{"use": "old", "city": "Salem"}, {"use": "home", "line": ["12 Main St", "Apt 4"], "city": "Boston", "state": "MA", "postalCode": "02101", "country": "US"}],
+		"telecom": [{"system": "phone", "value": "555-0100", "use": "home"}, {"system": "email", "value": "jane@example.com"}, {"system": "fax", "value": "555-0199"}],
+		"maritalStatus": {"coding": [{"code": "M", "display": "M"}], "text": "M"}}`)
+
+	for _, include := range []bool{false, true} {
+		records, _, err := extractBundle(&Config{IncludePII: include}, strings.NewReader(bundle), "test.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		content := records[0]["content"]
+		want := "Patient Information: Gender: female"
+		if include {
+			want += " Address: 12 Main St, Apt 4, Boston, MA 02101, US Home phone: 555-0100 Email: jane@example.com Marital status: Married"
+		}
+		if content != want {
+			t.Errorf("include-pii=%v: content = %q, want %q", include, content, want)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	quietLogger(t)
+
+	bundle := bundleJSON(
+		`{"resourceType": "Patient", "id": "p1", "gender": "female",
+			"name": [{"use": "official", "given": ["Jane", "Q"], "family": "O\"Brien"}],
+			"identifier": [{"type": {"text": "MRN"}, "value": "MRN-0042"}]}`,
+		`{"resourceType": "Condition", "id": "c1", "subject": {"reference": "urn:uuid:entry-0"},
+			"text": {"status": "generated", "div": "<div>Jane O\"Brien (MRN-0042) has asthma; jane's inhaler was refilled. Janet is her sister.</div>"}}`,
+	)
+	records, _, err := extractBundle(&Config{Redact: true}, strings.NewReader(bundle), "test.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"p1": "Patient Information: Name: [REDACTED] Gender: female",
+		"c1": "[REDACTED] ([REDACTED]) has asthma; [REDACTED]'s inhaler was refilled. Janet is her sister.",
+	}
+	for _, record := range records {
+		if record["content"] != want[record["id"]] {
+			t.Errorf("%s content = %q, want %q", record["id"], record["content"], want[record["id"]])
+		}
+		for _, leaked := range []string{`Jane `, `"Jane"`, "Brien", "MRN-0042"} {
+			if strings.Contains(record["resourceJson"], leaked) {
+				t.Errorf("%s resourceJson still contains %q: %s", record["id"], leaked, record["resourceJson"])
+			}
+		}
+	}
+}
+
+func TestExtractBundleFamilyMemberHistory(t *testing.T) {
+	quietLogger(t)
+
+	bundle := bundleJSON(`{"resourceType": "FamilyMemberHistory", "id": "fmh-1", "status": "completed",
+		"relationship": {"coding": [{"code": "FTH", "display": "father"}]},
+		"condition": [
+			{"code": {"text": "Myocardial infarction"}, "onsetAge": {"value": 52, "unit": "yr"}, "note": [{"text": "Died of a second infarction at 60"}]},
+			{"code": {"coding": [{"display": "Type 2 diabetes"}]}},
+			{"onsetAge": {"value": 40, "unit": "yr"}}
+		],
+		"note": [{"text": "Reported by the patient"}]}`)
+	records, _, err := extractBundle(&Config{}, strings.NewReader(bundle), "test.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Family History: father Conditions: Myocardial infarction, onset age 52 yr, note: Died of a second infarction at 60; Type 2 diabetes Note: Reported by the patient"
+	if len(records) != 1 || records[0]["content"] != want {
+		t.Fatalf("records = %v, want content %q", records, want)
+	}
+}
+
+func TestExtractBundleSocialHistory(t *testing.T) {
+	quietLogger(t)
+
+	bundle := bundleJSON(
+		`{"resourceType": "Observation", "id": "smoking", "status": "final",
+			"category": [{"coding": [{"system": "http://terminology.hl7.org/CodeSystem/observation-category", "code": "social-history", "display": "Social History"}]}],
+			"code": {"coding": [{"system": "http://loinc.org", "code": "72166-2", "display": "Tobacco smoking status"}]},
+			"valueCodeableConcept": {"coding": [
+				{"system": "http://example.org/local", "code": "F"},
+				{"system": "http://snomed.info/sct", "code": "8517006", "display": "Former smoker"}
+			]},
+			"effectiveDateTime": "2021-06-01T10:00:00Z"}`,
+		`{"resourceType": "Observation", "id": "alcohol", "status": "final",
+			"category": [{"coding": [{"code": "social-history"}]}],
+			"code": {"text": "AUDIT-C"},
+			"valueInteger": 4,
+			"component": [
+				{"code": {"text": "How often do you have a drink containing alcohol"}, "valueCodeableConcept": {"text": "2-4 times a month"}},
+				{"code": {"text": "Drinks on a typical day"}, "valueCodeableConcept": {"coding": [{"display": "3 or 4"}]}}
+			]}`,
+	)
+	records, _, err := extractBundle(&Config{}, strings.NewReader(bundle), "test.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"smoking": "Clinical Observation: Tobacco smoking status Category: Social History Value: Former smoker Date: 2021-06-01T10:00:00Z",
+		"alcohol": "Clinical Observation: AUDIT-C Category: social-history Value: 4 How often do you have a drink containing alcohol: 2-4 times a month Drinks on a typical day: 3 or 4",
+	}
+	if len(records) != len(want) {
+		t.Fatalf("got %d records, want %d", len(records), len(want))
+	}
+	for _, record := range records {
+		if record["content"] != want[record["id"]] {
+			t.Errorf("%s content = %q, want %q", record["id"], record["content"], want[record["id"]])
+		}
+	}
+}
+
+func TestExtractBundleProvenance(t *testing.T) {
+	quietLogger(t)
+
+	bundle := bundleJSON(
+		`{"resourceType": "Practitioner", "id": "pr-1", "name": [{"prefix": ["Dr."], "given": ["Ann"], "family": "Lee"}]}`,
+		`{"resourceType": "Organization", "id": "org-1", "name": "General Hospital"}`,
+		`{"resourceType": "Condition", "id": "c1", "code": {"text": "Asthma"}}`,
+		`{"resourceType": "Provenance", "id": "prov-1",
+			"target": [{"reference": "urn:uuid:entry-2"}, {"reference": "Observation/elsewhere"}],
+			"recorded": "2021-06-01T10:00:00Z",
+			"activity": {"coding": [{"system": "http://terminology.hl7.org/CodeSystem/v3-DataOperation", "code": "CREATE", "display": "create"}]},
+			"agent": [
+				{"type": {"coding": [{"display": "Author"}]}, "who": {"reference": "urn:uuid:entry-0"}},
+				{"who": {"reference": "urn:uuid:entry-1"}}
+			]}`,
+	)
+	records, _, err := extractBundle(&Config{}, strings.NewReader(bundle), "test.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Provenance: Activity: create Recorded: 2021-06-01T10:00:00Z Agents: Dr. Ann Lee (Author), General Hospital Targets: Asthma (Condition), Observation/elsewhere"
+	if got := records[len(records)-1]; got["id"] != "prov-1" || got["content"] != want {
+		t.Errorf("%s content = %q, want %q", got["id"], got["content"], want)
+	}
+}
+
+func TestExtractBundleQuestionnaireResponse(t *testing.T) {
+	quietLogger(t)
+
+	bundle := bundleJSON(
+		`{"resourceType": "QuestionnaireResponse", "id": "qr-1", "status": "completed", "authored": "2024-03-02T09:30:00Z",
+			"item": [
+				{"linkId": "1", "text": "Over the last 2 weeks, how often have you felt down or hopeless?",
+					"answer": [{"valueCoding": {"code": "LA6569-3", "display": "Several days"}}]},
+				{"linkId": "2", "text": "Smoking history", "item": [
+					{"linkId": "2.1", "text": "Do you smoke?", "answer": [{"valueBoolean": true,
+						"item": [{"linkId": "2.1.1", "text": "Cigarettes per day", "answer": [{"valueInteger": 10}]}]}]},
+					{"linkId": "2.2", "text": "Comments", "answer": [{"valueString": "Trying to quit"}]},
+					{"linkId": "2.3", "text": "Unanswered"}
+				]}
+			]}`,
+	)
+	records, _, err := extractBundle(&Config{}, strings.NewReader(bundle), "test.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Questionnaire Response: Status: completed Authored: 2024-03-02T09:30:00Z" +
+		" Question: Over the last 2 weeks, how often have you felt down or hopeless? Answer: Several days" +
+		" Section: Smoking history" +
+		" Question: Do you smoke? Answer: Yes" +
+		" Question: Cigarettes per day Answer: 10" +
+		" Question: Comments Answer: Trying to quit"
+	if len(records) != 1 || records[0]["content"] != want {
+		t.Errorf("content = %q, want %q", records[0]["content"], want)
+	}
+}
+
+func TestExtractBundleLocation(t *testing.T) {
+	quietLogger(t)
+
+	bundle := bundleJSON(
+		`{"resourceType": "Organization", "id": "org-1", "name": "General Hospital"}`,
+		`{"resourceType": "Location", "id": "loc-1", "name": "Cardiology Clinic",
+			"type": [{"coding": [{"code": "CARD", "display": "Ambulatory Health Care Facilities; Clinic/Center; Rehabilitation: Cardiac Facilities"}]}],
+			"address": {"line": ["1 Hospital Way"], "city": "Boston", "state": "MA", "postalCode": "02114"},
+			"managingOrganization": {"reference": "urn:uuid:entry-0"}}`,
+		// STU3 has a single type
+		`{"resourceType": "Location", "id": "loc-2", "name": "Ward 3", "type": {"text": "Inpatient ward"}}`,
+	)
+	records, _, err := extractBundle(&Config{}, strings.NewReader(bundle), "test.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"loc-1": "Location: Cardiology Clinic Type: Ambulatory Health Care Facilities; Clinic/Center; Rehabilitation: Cardiac Facilities Address: 1 Hospital Way, Boston, MA 02114 Managed by: General Hospital",
+		"loc-2": "Location: Ward 3 Type: Inpatient ward",
+	}
+	for _, record := range records {
+		if w, ok := want[record["id"]]; ok && record["content"] != w {
+			t.Errorf("%s content = %q, want %q", record["id"], record["content"], w)
+		}
+	}
+}
+
+func TestExtractBundleHealthcareService(t *testing.T) {
+	quietLogger(t)
+
+	bundle := bundleJSON(`{"resourceType": "HealthcareService", "id": "hs-1", "name": "Sleep Clinic",
+		"category": [{"text": "Specialist"}],
+		"type": [{"coding": [{"display": "Sleep study"}]}],
+		"specialty": [{"text": "Sleep medicine"}, {"text": "Pulmonology"}],
+		"providedBy": {"display": "General Hospital"}}`)
+	records, _, err := extractBundle(&Config{}, strings.NewReader(bundle), "test.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Healthcare Service: Sleep Clinic Category: Specialist Type: Sleep study Specialty: Sleep medicine, Pulmonology Provided by: General Hospital"
+	if len(records) != 1 || records[0]["content"] != want {
+		t.Fatalf("records = %v, want content %q", records, want)
+	}
+}
+
+func TestExtractBundleEncounterParticipants(t *testing.T) {
+	quietLogger(t)
+
+	bundle := bundleJSON(
+		`{"resourceType": "Practitioner", "id": "pr-1", "name": [{"prefix": ["Dr."], "given": ["Ann"], "family": "Lee"}]}`,
+		`{"resourceType": "Encounter", "id": "enc-1", "type": [{"text": "Office visit"}],
+			"participant": [
+				{"type": [{"coding": [{"display": "primary performer"}]}], "individual": {"reference": "urn:uuid:entry-0", "display": "Ann Lee"}},
+				{"individual": {"reference": "Practitioner/elsewhere", "display": "Dr. Raj Patel"}},
+				{"type": [{"text": "escort"}]}
+			]}`,
+	)
+	records, _, err := extractBundle(&Config{}, strings.NewReader(bundle), "test.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Healthcare Encounter: Office visit Participants: Dr. Ann Lee (primary performer), Dr. Raj Patel"
+	if got := records[len(records)-1]; got["id"] != "enc-1" || got["content"] != want {
+		t.Errorf("%s content = %q, want %q", got["id"], got["content"], want)
+	}
+}
+
+func TestContentPointers(t *testing.T) {
+	quietLogger(t)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "pointers.json")
+	os.WriteFile(path, []byte(`{
+		"Basic": {"pointers": ["/code/text", "/extension/1/valueString", "/extension/9/valueString", "/a~1b~0c"], "replace": true},
+		"Condition": {"pointers": ["/note/0/text"]}
+	}`), 0o644)
+	rules, err := loadContentPointers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bundle := bundleJSON(
+		`{"resourceType": "Basic", "id": "b1", "code": {"text": "Advance directive"},
+			"text": {"div": "<div>Generated narrative</div>"},
+			"extension": [{"valueString": "ignored"}, {"valueString": "Do not resuscitate"}], "a/b~c": "Witnessed"}`,
+		`{"resourceType": "Condition", "id": "c1", "code": {"text": "Asthma"}, "note": [{"text": "Worse in winter"}]}`,
+	)
+	records, _, err := extractBundle(&Config{ContentPointers: rules}, strings.NewReader(bundle), "test.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"b1": "Advance directive Do not resuscitate Witnessed",
+		"c1": "Medical Condition: Asthma Worse in winter",
+	}
+	for _, record := range records {
+		if record["content"] != want[record["id"]] {
+			t.Errorf("%s content = %q, want %q", record["id"], record["content"], want[record["id"]])
+		}
+	}
+
+	for _, bad := range []string{
+		`{"Basic": {"pointers": ["code/text"]}}`,
+		`{"Basic": {"pointers": ["/code~2"]}}`,
+		`{"Basic": {"pointers": []}}`,
+		`{"Basic": {"pointer": ["/code"]}}`,
+	} {
+		os.WriteFile(path, []byte(bad), 0o644)
+		if _, err := loadContentPointers(path); err == nil {
+			t.Errorf("loadContentPointers(%s) succeeded, want an error", bad)
+		}
+	}
+}
+
+func TestExtractBundleDuplicateIDs(t *testing.T) {
+	quietLogger(t)
+
+	bundle := bundleJSON(
+		`{"resourceType": "Condition", "id": "c1", "code": {"text": "Asthma"}}`,
+		`{"resourceType": "Observation", "id": "c1", "code": {"text": "Peak flow"}}`,
+		`{"resourceType": "Condition", "id": "c1", "code": {"text": "Asthma, severe persistent"}}`,
+	)
+	for _, tt := range []struct {
+		mode string
+		want string
+	}{
+		{"last", "Medical Condition: Asthma, severe persistent"},
+		{"first", "Medical Condition: Asthma"},
+	} {
+		records, summary, err := extractBundle(&Config{DuplicateIDs: tt.mode}, strings.NewReader(bundle), "test.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 2 || summary.DuplicateIDs != 1 {
+			t.Fatalf("%s: got %d records, %d duplicate ids; want 2 and 1", tt.mode, len(records), summary.DuplicateIDs)
+		}
+		for _, record := range records {
+			if record["resourceType"] == "Condition" && record["content"] != tt.want {
+				t.Errorf("%s: kept %q, want %q", tt.mode, record["content"], tt.want)
+			}
+		}
+	}
+
+	// Read in one pass, the first is kept whatever the mode
+	summary := newSummary()
+	var kept []string
+	err := streamBundle(&Config{DuplicateIDs: "last"}, strings.NewReader(bundle), nil, "stdin", &summary, func(record map[string]string) error {
+		kept = append(kept, record["content"])
+		return nil
+	})
+	if err != nil || len(kept) != 2 || kept[0] != "Medical Condition: Asthma" || summary.DuplicateIDs != 1 {
+		t.Errorf("single pass: kept %q, %d duplicate ids, err %v", kept, summary.DuplicateIDs, err)
+	}
+}
+
+func TestStripEmptySections(t *testing.T) {
+	quietLogger(t)
+
+	bundle := bundleJSON(
+		`{"resourceType": "Observation", "id": "o1", "status": "final", "code": {"coding": [{"system": "http://example.org/local", "code": "X-17"}]}}`,
+		`{"resourceType": "Observation", "id": "o2", "code": {"text": "Heart rate"}, "valueQuantity": {"value": 72, "unit": "/min"}}`,
+		`{"resourceType": "Basic", "id": "b1"}`,
+	)
+	for _, strip := range []bool{false, true} {
+		records, summary, err := extractBundle(&Config{StripEmptySections: strip}, strings.NewReader(bundle), "test.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantRecords, wantHeadingOnly := 2, 0
+		if strip {
+			wantRecords, wantHeadingOnly = 1, 1
+		}
+		if len(records) != wantRecords || summary.SkippedHeadingOnly != wantHeadingOnly || summary.SkippedEmpty != 1 {
+			t.Errorf("strip=%v: %d records, %d heading-only, %d empty; want %d, %d, 1",
+				strip, len(records), summary.SkippedHeadingOnly, summary.SkippedEmpty, wantRecords, wantHeadingOnly)
+		}
+		if tc := summary.ByType["Observation"]; strip && (tc == nil || tc.SkippedHeadingOnly != 1) {
+			t.Errorf("Observation counts %+v, want 1 heading-only", tc)
+		}
+		if !strip && records[0]["content"] != "Clinical Observation:" {
+			t.Errorf("content = %q, want the bare heading", records[0]["content"])
+		}
+	}
+}
+
+func TestIncludeMeta(t *testing.T) {
+	quietLogger(t)
+
+	bundle := bundleJSON(
+		`{"resourceType": "Observation", "id": "o1", "code": {"text": "Heart rate"}, "valueInteger": 72,
+			"meta": {"versionId": "3", "lastUpdated": "2024-02-01T10:00:00Z", "source": "#lab",
+				"profile": ["http://hl7.org/fhir/us/core/StructureDefinition/us-core-vital-signs", "http://hl7.org/fhir/StructureDefinition/heartrate"]}}`,
+		`{"resourceType": "Condition", "id": "c1", "code": {"text": "Asthma"}, "meta": {"lastUpdated": "2023-11-05"}}`,
+	)
+	for _, include := range []bool{false, true} {
+		records, _, err := extractBundle(&Config{IncludeMeta: include}, strings.NewReader(bundle), "test.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := map[string]string{}
+		for _, record := range records {
+			got[record["id"]] = record["lastUpdated"] + " " + record["versionId"] + " " + record["profile"]
+			if _, ok := record["versionId"]; ok && record["id"] == "c1" {
+				t.Errorf("c1 has a versionId field with no meta.versionId")
+			}
+		}
+		want := map[string]string{"o1": "  ", "c1": "  "}
+		if include {
+			want = map[string]string{
+				"o1": "2024-02-01T10:00:00Z 3 http://hl7.org/fhir/us/core/StructureDefinition/us-core-vital-signs,http://hl7.org/fhir/StructureDefinition/heartrate",
+				"c1": "2023-11-05  ",
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("include=%v: meta fields %v, want %v", include, got, want)
+		}
+	}
+}
+
+func TestMinContentChars(t *testing.T) {
+	quietLogger(t)
+
+	bundle := bundleJSON(
+		`{"resourceType": "Condition", "id": "short", "code": {"text": "Flu"}}`,
+		`{"resourceType": "Condition", "id": "long", "code": {"text": "Type 2 diabetes mellitus"}, "onsetDateTime": "2019-04-02"}`,
+	)
+	for _, tt := range []struct {
+		min       int
+		wantIDs   string
+		wantShort int
+	}{
+		{0, "short long", 0},
+		{22, "short long", 0}, // "Medical Condition: Flu" is exactly 22
+		{23, "long", 1},
+	} {
+		records, summary, err := extractBundle(&Config{MinContentChars: tt.min}, strings.NewReader(bundle), "test.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, record := range records {
+			ids = append(ids, record["id"])
+		}
+		if strings.Join(ids, " ") != tt.wantIDs || summary.SkippedTooShort != tt.wantShort {
+			t.Errorf("min %d: ids %v, %d too short; want %s, %d", tt.min, ids, summary.SkippedTooShort, tt.wantIDs, tt.wantShort)
+		}
+		if tt.wantShort > 0 && (len(summary.Outcomes) == 0 || summary.Outcomes[0].Reason != "too-short") {
+			t.Errorf("min %d: outcomes %+v, want short skipped as too-short", tt.min, summary.Outcomes)
+		}
+		if tc := summary.ByType["Condition"]; tt.wantShort > 0 && (tc == nil || tc.SkippedTooShort != tt.wantShort) {
+			t.Errorf("min %d: Condition counts %+v, want %d too short", tt.min, tc, tt.wantShort)
+		}
+	}
+}
+
+func TestMergeNarrative(t *testing.T) {
+	resource := map[string]interface{}{
+		"resourceType": "Condition",
+		"text": map[string]interface{}{
+			"div": `<div xmlns="http://www.w3.org/1999/xhtml"><p>Type 2 diabetes mellitus.</p><p>Diagnosed after routine screening; diagnosed after routine screening.</p></div>`,
+		},
+		"code":               map[string]interface{}{"text": "Type 2 diabetes mellitus"},
+		"onsetDateTime":      "2019-04-02",
+		"clinicalStatus":     map[string]interface{}{"coding": []interface{}{map[string]interface{}{"code": "active"}}},
+		"verificationStatus": map[string]interface{}{"coding": []interface{}{map[string]interface{}{"code": "confirmed"}}},
+	}
+
+	if got, want := extractContent(&Config{}, resource, "Condition", nil), "Type 2 diabetes mellitus. Diagnosed after routine screening; diagnosed after routine screening."; got != want {
+		t.Errorf("narrative-first content = %q, want %q", got, want)
+	}
+
+	merge := &Config{MergeNarrative: true}
+	got := extractContent(merge, resource, "Condition", nil)
+	if !strings.HasPrefix(got, "Medical Condition: Type 2 diabetes mellitus") || !strings.HasSuffix(got, " Narrative: Diagnosed after routine screening.") {
+		t.Errorf("merged content = %q", got)
+	}
+	if n := strings.Count(strings.ToLower(got), "type 2 diabetes mellitus"); n != 1 {
+		t.Errorf("merged content repeats the code %d times: %q", n, got)
+	}
+	if n := strings.Count(strings.ToLower(got), "routine screening"); n != 1 {
+		t.Errorf("merged content repeats a narrative sentence %d times: %q", n, got)
+	}
+
+	// A narrative the fields already cover entirely adds nothing
+	resource["text"] = map[string]interface{}{"div": "<div>Type 2 diabetes mellitus</div>"}
+	if got := extractContent(merge, resource, "Condition", nil); strings.Contains(got, "Narrative:") {
+		t.Errorf("content = %q, want no narrative", got)
+	}
+}
+
+func TestPrefixTemplate(t *testing.T) {
+	quietLogger(t)
+
+	path := filepath.Join(t.TempDir(), "prefixes.json")
+	os.WriteFile(path, []byte(`{
+		"Condition": "Diagnosis for patient {{.patientId}}:",
+		"Observation": "",
+		"Procedure": "Procedure {{.id}} ({{.resource.status}}):",
+		"Immunization": "{{.missing}}"
+	}`), 0o644)
+	templates, err := loadPrefixTemplates(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bundle := bundleJSON(
+		`{"resourceType": "Patient", "id": "p1", "gender": "female"}`,
+		`{"resourceType": "Condition", "id": "c1", "code": {"text": "Asthma"}, "subject": {"reference": "Patient/p1"}}`,
+		`{"resourceType": "Observation", "id": "o1", "code": {"text": "Heart rate"}, "valueQuantity": {"value": 72}}`,
+		`{"resourceType": "Procedure", "id": "pr1", "status": "completed", "text": {"div": "<div>Appendectomy</div>"}}`,
+		`{"resourceType": "Immunization", "id": "i1", "vaccineCode": {"text": "Influenza"}}`,
+	)
+	records, _, err := extractBundle(&Config{PrefixTemplates: templates}, strings.NewReader(bundle), "test.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"p1":  "Patient Information: Gender: female",
+		"c1":  "Diagnosis for patient p1: Asthma",
+		"o1":  "Heart rate Value: 72.00",
+		"pr1": "Procedure pr1 (completed): Appendectomy",
+		"i1":  "Immunization: Influenza", // the template fails, so the built-in heading stays
+	}
+	if len(records) != len(want) {
+		t.Fatalf("got %d records, want %d", len(records), len(want))
+	}
+	for _, record := range records {
+		if record["content"] != want[record["id"]] {
+			t.Errorf("%s content = %q, want %q", record["id"], record["content"], want[record["id"]])
+		}
+	}
+
+	os.WriteFile(path, []byte(`{"Condition": "{{.patientId"}`), 0o644)
+	if _, err := loadPrefixTemplates(path); err == nil {
+		t.Error("loadPrefixTemplates accepted an unterminated action")
+	}
+}
+
+func TestIncludeCodes(t *testing.T) {
+	quietLogger(t)
+
+	bundle := bundleJSON(`{"resourceType": "Condition", "id": "c1",
+		"code": {"coding": [
+			{"system": "http://snomed.info/sct", "code": "44054006", "display": "Diabetes mellitus type 2"},
+			{"system": "http://hl7.org/fhir/sid/icd-10-cm", "code": "E11.9"},
+			{"system": "http://example.org/local", "code": "DM2"}
+		]},
+		"category": [{"coding": [{"system": "http://terminology.hl7.org/CodeSystem/condition-category", "code": "problem-list-item", "display": "Problem List Item"}]}]}`)
+	for _, include := range []bool{false, true} {
+		records, _, err := extractBundle(&Config{IncludeCodes: include}, strings.NewReader(bundle), "test.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "Medical Condition: Diabetes mellitus type 2 Category: Problem List Item"
+		if include {
+			want = "Medical Condition: Diabetes mellitus type 2 (SNOMED 44054006, ICD-10-CM E11.9) Category: Problem List Item"
+		}
+		if records[0]["content"] != want {
+			t.Errorf("include-codes=%v: content = %q, want %q", include, records[0]["content"], want)
+		}
+	}
+
+	if got := codeableConceptText(&Config{IncludeCodes: true}, map[string]interface{}{"coding": []interface{}{
+		map[string]interface{}{"system": "http://loinc.org", "code": "2339-0"},
+	}}); got != "LOINC 2339-0" {
+		t.Errorf("code-only concept = %q, want %q", got, "LOINC 2339-0")
+	}
+}
+
+func TestPrettyContent(t *testing.T) {
+	quietLogger(t)
+
+	bundle := bundleJSON(testPatient,
+		`{"resourceType": "Observation", "id": "o1", "subject": {"reference": "urn:uuid:entry-0"}, "code": {"text": "Glucose"},
+			"valueQuantity": {"value": 182, "unit": "mg/dL"}, "interpretation": [{"text": "High"}], "effectiveDateTime": "2021-06-01"}`)
+	records, _, err := extractBundle(&Config{Pretty: true, EmbedPatientContext: true}, strings.NewReader(bundle), "test.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Patient: 41-year-old female.\n" +
+		"Clinical Observation: Glucose\n" +
+		"  Value: 182.00 mg/dL\n" +
+		"  Interpretation: High\n" +
+		"  Date: 2021-06-01"
+	if records[1]["content"] != want {
+		t.Errorf("content =\n%s\nwant\n%s", records[1]["content"], want)
+	}
+
+	if got := prettyContent([]string{"Care Plan:", "Diabetes", "Status: active", "Follow up in 3 months"}); got != "Care Plan: Diabetes\n  Status: active Follow up in 3 months" {
+		t.Errorf("unlabeled part after a field: got %q", got)
+	}
+}
+
+func TestRateLimitAndRetryAfter(t *testing.T) {
+	quietLogger(t)
+
+	var mu sync.Mutex
+	var times []time.Time
+	limited := 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		times = append(times, time.Now())
+		if limited > 0 {
+			limited--
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer server.Close()
+
+	// A 429 pauses and retries the request instead of failing it
+	cfg := &Config{PipelineURL: server.URL, RequestTimeout: 5 * time.Second, Concurrency: 1, WorkersPerFile: 1}
+	state := newRunState(cfg)
+	if err := sendToPipeline(context.Background(), cfg, state, map[string]string{"id": "c1"}); err != nil {
+		t.Fatalf("after Retry-After: %v", err)
+	}
+	if len(times) != 2 || times[1].Sub(times[0]) < 900*time.Millisecond {
+		t.Errorf("got %d requests, %v apart; want a retry after about 1s", len(times), times[len(times)-1].Sub(times[0]))
+	}
+
+	// 20 requests per second leaves at least 50ms between requests
+	times = nil
+	cfg.RateLimit = 20
+	state = newRunState(cfg)
+	for i := 0; i < 5; i++ {
+		if err := sendToPipeline(context.Background(), cfg, state, map[string]string{"id": fmt.Sprint(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := times[4].Sub(times[0]); elapsed < 190*time.Millisecond {
+		t.Errorf("5 requests at -rate-limit 20 took %v, want at least 200ms", elapsed)
+	}
+
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	for value, want := range map[string]time.Duration{
+		"7":                             7 * time.Second,
+		"Fri, 02 Jan 2026 03:04:35 GMT": 30 * time.Second,
+		"3600":                          maxRetryAfter,
+	} {
+		if got, ok := retryAfter(value, now); !ok || got != want {
+			t.Errorf("retryAfter(%q) = %v, %v; want %v", value, got, ok, want)
+		}
+	}
+	if _, ok := retryAfter("soon", now); ok {
+		t.Error("retryAfter(\"soon\"): want not ok")
+	}
+}